@@ -29,6 +29,7 @@ import (
 	"github.com/untangle/packetd/plugins/predicttraffic"
 	"github.com/untangle/packetd/plugins/reporter"
 	"github.com/untangle/packetd/plugins/revdns"
+	"github.com/untangle/packetd/plugins/signatures"
 	"github.com/untangle/packetd/plugins/sni"
 	"github.com/untangle/packetd/plugins/stats"
 	"github.com/untangle/packetd/services/appclassmanager"
@@ -180,6 +181,7 @@ func printVersion() {
 // parseArguments parses the command line arguments
 func parseArguments() {
 	classdAddressStringPtr := flag.String("classd", "127.0.0.1:8123", "host:port for classd daemon")
+	classdConnectionsPtr := flag.Int("classd-connections", 4, "number of connections to the classd daemon")
 	disableDictPtr := flag.Bool("disable-dict", false, "disable dict")
 	cpuProfilePtr := flag.String("cpuprofile", "", "filename for CPU pprof output")
 	versionPtr := flag.Bool("version", false, "version")
@@ -199,6 +201,7 @@ func parseArguments() {
 	flag.Parse()
 
 	classify.SetHostPort(*classdAddressStringPtr)
+	classify.SetPoolSize(*classdConnectionsPtr)
 
 	if *disableDictPtr {
 		dict.Disable()
@@ -341,6 +344,7 @@ func startPlugins() {
 		certsniff.PluginStartup,
 		dns.PluginStartup,
 		revdns.PluginStartup,
+		signatures.PluginStartup,
 		sni.PluginStartup,
 		stats.PluginStartup,
 		reporter.PluginStartup}
@@ -370,6 +374,7 @@ func stopPlugins() {
 		certsniff.PluginShutdown,
 		dns.PluginShutdown,
 		revdns.PluginShutdown,
+		signatures.PluginShutdown,
 		sni.PluginShutdown,
 		stats.PluginShutdown,
 		reporter.PluginShutdown}
@@ -19,6 +19,7 @@ import (
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
 )
 
 const pluginName = "classify"
@@ -40,6 +41,7 @@ const (
 	daemonShutdown
 	daemonFinished
 	socketConnect
+	socketReload
 	systemStartup
 	systemShutdown
 )
@@ -50,6 +52,7 @@ var cloudChannel = make(chan daemonSignal, 1)
 var controlChannel = make(chan bool)
 var classdHostPort = "127.0.0.1:8123"
 var daemonAvailable = false
+var settingsSubscription int
 
 // PluginStartup is called to allow plugin specific initialization
 func PluginStartup() {
@@ -62,18 +65,27 @@ func PluginStartup() {
 	info, err = os.Stat(daemonBinary)
 	if err != nil {
 		logger.Notice("Unable to check status of classify daemon %s (%v)\n", daemonBinary, err)
+		startFallback()
 		return
 	}
 
 	//  make sure the classd binary is executable
 	if (info.Mode() & 0111) == 0 {
 		logger.Notice("Invalid file mode for classify daemon %s (%v)\n", daemonBinary, info.Mode())
+		startFallback()
 		return
 	}
 
 	// we found the daemon so set our flag
 	daemonAvailable = true
 
+	// the daemon address and connections in the settings replace the command line values
+	value, err := settings.GetSettings([]string{"classify", "daemon"})
+	if err != nil {
+		value = nil
+	}
+	daemonCurrent = getDaemonConfig(value)
+
 	// start the daemon manager to handle running the daemon process
 	go daemonProcessManager(controlChannel)
 	select {
@@ -103,6 +115,10 @@ func PluginStartup() {
 		}
 	}
 
+	settingsSubscription = settings.Subscribe("classify/daemon", func(oldValue interface{}, newValue interface{}) {
+		setDaemonConfig(getDaemonConfig(newValue))
+	})
+
 	// insert our nfqueue subscription
 	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ClassifyPriority, PluginNfqueueHandler)
 }
@@ -116,6 +132,8 @@ func PluginShutdown() {
 		return
 	}
 
+	settings.Unsubscribe(settingsSubscription)
+
 	// signal the socket manager that the system is shutting down
 	signalSocketManager(systemShutdown)
 	select {
@@ -276,7 +294,7 @@ func classifyTraffic(mess *dispatch.NfqueueMessage) string {
 
 	// send the packet to the daemon for classification
 	command = fmt.Sprintf("PACKET|%d|%s|%d\r\n", mess.Session.GetSessionID(), proto, len(fixer.Data()))
-	reply = daemonClassifyPacket(command, fixer.Data())
+	reply = daemonClassifyPacket(mess.Session.GetSessionID(), command, fixer.Data())
 	return reply
 }
 
@@ -291,17 +309,25 @@ func processReply(reply string, mess dispatch.NfqueueMessage, ctid uint32) (int,
 	var productivity uint8
 	var state int
 	var risk uint8
-	var attachments map[string]interface{}
 
 	// parse update classd information from reply
 	appid, name, protochain, detail, confidence, category, state, productivity, risk = parseReply(reply)
 
+	applyClassification(mess.Session, ctid, appid, name, protochain, detail, confidence, category, productivity, risk)
+	return state, confidence
+}
+
+// applyClassification updates the session application attachments with the classification
+// details and logs an event if anything changed
+func applyClassification(session *dispatch.Session, ctid uint32, appid string, name string, protochain string, detail string, confidence int32, category string, productivity uint8, risk uint8) {
+	var attachments map[string]interface{}
+
 	// WARNING - DO NOT USE Session GetAttachment or SetAttachment in this function
 	// Because we make decisions based on existing attachments and update multiple
 	// attachments, we lock the attachments and access them directly for efficiency.
 	// Other calls that lock the attachment mutex will hang forever if called from here.
-	attachments = mess.Session.LockAttachments()
-	defer mess.Session.UnlockAttachments()
+	attachments = session.LockAttachments()
+	defer session.UnlockAttachments()
 
 	// We look at the confidence and ignore any reply where the value is less
 	// than the confidence currently attached to the session. Because of the
@@ -314,12 +340,20 @@ func processReply(reply string, mess dispatch.NfqueueMessage, ctid uint32) (int,
 	// happen if the lower confidence reply is received and parsed after the
 	// higher confidence reply has already been handled.
 
+	// An application signature from the settings wins when the confidence is the same,
+	// so only a reply with a higher confidence replaces the signature classification.
 	checkdata := attachments["application_confidence"]
 	if checkdata != nil {
 		checkval := checkdata.(int32)
 		if confidence < checkval {
-			logger.Debug("%OC|Ignoring update with confidence %d < %d STATE:%d\n", "classify_confidence_regression", 0, confidence, checkval, state)
-			return state, confidence
+			logger.Debug("%OC|Ignoring update with confidence %d < %d\n", "classify_confidence_regression", 0, confidence, checkval)
+			return
+		}
+		if attachments["application_signature"] != nil {
+			if confidence == checkval {
+				return
+			}
+			delete(attachments, "application_signature")
 		}
 	}
 
@@ -351,10 +385,8 @@ func processReply(reply string, mess dispatch.NfqueueMessage, ctid uint32) (int,
 
 	// if something changed, log a new event
 	if len(changed) > 0 {
-		logEvent(mess.Session, attachments, changed)
+		logEvent(session, attachments, changed)
 	}
-
-	return state, confidence
 }
 
 // parseReply parses a reply from classd and returns
@@ -406,7 +438,7 @@ func parseReply(replyString string) (string, string, string, string, int32, stri
 	}
 
 	// lookup the category in the application table
-	appinfo, finder := appclassmanager.ApplicationTable[appid]
+	appinfo, finder := appclassmanager.LookupGUID(appid)
 	if finder == true {
 		name = appinfo.Name
 		category = appinfo.Category
@@ -458,6 +490,7 @@ func analyzePrediction(session *dispatch.Session) {
 }
 
 // logEvent logs a session_classify event that updates the application_* columns
+// and publishes the changes to the session event subscribers
 // provide the session and the changed column names
 func logEvent(session *dispatch.Session, attachments map[string]interface{}, changed []string) {
 	if len(changed) == 0 {
@@ -472,6 +505,7 @@ func logEvent(session *dispatch.Session, attachments map[string]interface{}, cha
 	}
 
 	reports.LogEvent(reports.CreateEvent("session_classify", "sessions", 2, columns, modifiedColumns))
+	dispatch.PublishSessionEvent(dispatch.SessionEventUpdate, session, modifiedColumns)
 }
 
 // updateClassifyDetail updates a key/value pair in the session attachments
@@ -518,6 +552,32 @@ func SetHostPort(value string) {
 	classdHostPort = value
 }
 
+// SetPoolSize sets the number of connections to the classdDaemon. Default is 4
+func SetPoolSize(value int) {
+	if value < 1 {
+		value = 1
+	}
+	daemonPoolSize = value
+}
+
+// getDaemonConfig returns the daemon configuration from the classify/daemon settings,
+// using the command line values for the address and connections if they are not set
+func getDaemonConfig(value interface{}) daemonConfig {
+	config := daemonConfig{address: classdHostPort, connections: daemonPoolSize}
+
+	daemon, ok := value.(map[string]interface{})
+	if !ok {
+		return config
+	}
+	if address, ok := daemon["address"].(string); ok && address != "" {
+		config.address = address
+	}
+	if connections, ok := daemon["connections"].(float64); ok && connections >= 1 {
+		config.connections = int(connections)
+	}
+	return config
+}
+
 // signalProcessManager sends a signal to the daemon manager goroutine
 func signalProcessManager(signal daemonSignal) {
 	select {
@@ -0,0 +1,177 @@
+package classify
+
+import (
+	"strings"
+
+	"github.com/untangle/packetd/services/appclassmanager"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The fallback classifier is used when the classd daemon is not installed. It makes a best
+// effort guess at the application using the protocol and port, and the SNI, certificate,
+// and DNS names matched against the application table, so the application attachments and
+// report columns are still filled in. The confidence is low so any other classification wins.
+
+const fallbackPortConfidence = 10     // The confidence for an application guessed from the port
+const fallbackHostnameConfidence = 30 // The confidence for an application guessed from a hostname
+const fallbackPacketCount = 10        // The number of packets to inspect waiting for a hostname
+
+// fallbackApplication holds the details used for an application that is not in the application table
+type fallbackApplication struct {
+	name         string
+	category     string
+	productivity uint8
+	risk         uint8
+}
+
+var fallbackTCPPorts = map[uint16]string{
+	20: "FTP", 21: "FTP", 22: "SSH", 23: "TELNET", 25: "SMTP", 53: "DNS", 80: "HTTP",
+	110: "POP3", 143: "IMAP", 443: "SSL", 465: "SMTP", 587: "SMTP", 993: "IMAP", 995: "POP3",
+	1723: "PPTP", 3306: "MYSQL", 3389: "RDP", 5222: "XMPP", 8080: "HTTP", 8443: "SSL",
+}
+
+var fallbackUDPPorts = map[uint16]string{
+	53: "DNS", 67: "DHCP", 68: "DHCP", 123: "NTP", 161: "SNMP", 443: "QUIC", 500: "IPSEC",
+	1194: "OPENVPN", 1900: "SSDP", 4500: "IPSEC", 5060: "SIP", 5353: "MDNS",
+}
+
+var fallbackProtocols = map[uint8]string{
+	1: "ICMP", 47: "GRE", 50: "IPSEC", 58: "ICMP",
+}
+
+var fallbackApplications = map[string]fallbackApplication{
+	"DHCP":    {"Dynamic Host Configuration Protocol", "Networking", 3, 1},
+	"DNS":     {"Domain Name System", "Networking", 3, 1},
+	"FTP":     {"File Transfer Protocol", "File Transfer", 3, 3},
+	"GRE":     {"Generic Routing Encapsulation", "Networking", 3, 2},
+	"HTTP":    {"HyperText Transfer Protocol", "Web Services", 3, 3},
+	"ICMP":    {"Internet Control Message Protocol", "Networking", 3, 1},
+	"IMAP":    {"Internet Message Access Protocol", "Mail", 4, 2},
+	"IPSEC":   {"IP Security", "Networking", 3, 2},
+	"MDNS":    {"Multicast DNS", "Networking", 3, 1},
+	"MYSQL":   {"MySQL", "Database", 4, 2},
+	"NTP":     {"Network Time Protocol", "Networking", 3, 1},
+	"OPENVPN": {"OpenVPN", "Tunneling", 3, 3},
+	"POP3":    {"Post Office Protocol", "Mail", 4, 2},
+	"PPTP":    {"Point-to-Point Tunneling Protocol", "Tunneling", 3, 3},
+	"QUIC":    {"QUIC", "Web Services", 3, 3},
+	"RDP":     {"Remote Desktop Protocol", "Remote Access", 3, 4},
+	"SIP":     {"Session Initiation Protocol", "Messaging", 3, 2},
+	"SMTP":    {"Simple Mail Transfer Protocol", "Mail", 4, 2},
+	"SNMP":    {"Simple Network Management Protocol", "Networking", 3, 2},
+	"SSDP":    {"Simple Service Discovery Protocol", "Networking", 3, 2},
+	"SSH":     {"Secure Shell", "Remote Access", 3, 3},
+	"SSL":     {"Secure Sockets Layer", "Web Services", 3, 2},
+	"TELNET":  {"Telnet", "Remote Access", 3, 5},
+	"XMPP":    {"Extensible Messaging and Presence Protocol", "Messaging", 3, 2},
+}
+
+// startFallback starts the fallback classifier in place of the classd daemon
+func startFallback() {
+	logger.Notice("Using the built-in fallback classifier\n")
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ClassifyPriority, fallbackNfqueueHandler)
+}
+
+// fallbackNfqueueHandler is the nfqueue handler used when the classd daemon is not available.
+// The application from the port is attached on the first packet, and replaced if a hostname
+// matches an application. The session is released once a hostname is found or after a few packets.
+func fallbackNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	if mess.Session == nil {
+		return dispatch.NfqueueResult{SessionRelease: true}
+	}
+
+	tuple := mess.Session.GetClientSideTuple()
+	appid, protochain := classifyProtocolPort(tuple)
+	confidence := int32(fallbackPortConfidence)
+
+	hostname := getFallbackHostname(mess.Session)
+	if hostname != "" {
+		if guid := findHostnameApplication(hostname); guid != "" {
+			appid = guid
+			protochain += "/" + guid
+			confidence = fallbackHostnameConfidence
+		}
+	}
+
+	if appid != "" {
+		name, category, productivity, risk := lookupApplication(appid)
+		applyClassification(mess.Session, ctid, appid, name, protochain, hostname, confidence, category, productivity, risk)
+	}
+
+	release := hostname != "" || mess.Session.GetPacketCount() >= fallbackPacketCount
+	return dispatch.NfqueueResult{SessionRelease: release}
+}
+
+// classifyProtocolPort returns the application and protochain for the protocol and server port
+func classifyProtocolPort(tuple dispatch.Tuple) (string, string) {
+	var appid string
+
+	switch tuple.Protocol {
+	case 6:
+		appid = fallbackTCPPorts[tuple.ServerPort]
+		if appid == "" {
+			return "", "/IP/TCP"
+		}
+		return appid, "/IP/TCP/" + appid
+	case 17:
+		appid = fallbackUDPPorts[tuple.ServerPort]
+		if appid == "" {
+			return "", "/IP/UDP"
+		}
+		return appid, "/IP/UDP/" + appid
+	}
+
+	appid = fallbackProtocols[tuple.Protocol]
+	if appid == "" {
+		return "", "/IP"
+	}
+	return appid, "/IP/" + appid
+}
+
+// getFallbackHostname returns the best hostname for the session, which is the SNI, the
+// certificate common name, or the DNS name the client used to find the server
+func getFallbackHostname(session *dispatch.Session) string {
+	if sni, ok := session.GetAttachment("ssl_sni").(string); ok && sni != "" {
+		return sni
+	}
+	if cn, ok := session.GetAttachment("certificate_subject_cn").(string); ok && cn != "" && !strings.Contains(cn, "*") {
+		return cn
+	}
+	if hint, ok := session.GetAttachment("server_dns_hint").(string); ok && hint != "" {
+		return hint
+	}
+	return ""
+}
+
+// findHostnameApplication returns the GUID of the application matching a label of the
+// hostname, starting with the label before the top level domain. Generic protocols are
+// only matched by port, since labels like www or mail do not identify the application.
+func findHostnameApplication(hostname string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(hostname, ".")), ".")
+	for i := len(labels) - 2; i >= 0; i-- {
+		info, found := appclassmanager.LookupGUID(strings.ToUpper(labels[i]))
+		if !found {
+			info, found = appclassmanager.LookupName(labels[i])
+		}
+		if !found {
+			continue
+		}
+		if _, generic := fallbackApplications[info.GUID]; !generic {
+			return info.GUID
+		}
+	}
+	return ""
+}
+
+// lookupApplication returns the name, category, productivity, and risk for the application
+// from the application table, or from the fallback details if it is not in the table
+func lookupApplication(appid string) (string, string, uint8, uint8) {
+	if info, found := appclassmanager.LookupGUID(appid); found {
+		return info.Name, info.Category, info.Productivity, info.Risk
+	}
+	if info, found := fallbackApplications[appid]; found {
+		return info.name, info.category, info.productivity, info.risk
+	}
+	return appid, "", 0, 0
+}
@@ -5,27 +5,85 @@
 package classify
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
 )
 
-var daemonSocket net.Conn
-var daemonBuffer = make([]byte, 1024)
-var socketMutex sync.Mutex
+// daemonRequestTimeout is the deadline for a classify request, including the time spent waiting for a connection
+const daemonRequestTimeout = 2 * time.Second
 
-// daemonSocketManager is a goroutine to handle the daemon socket connection
+// daemonMaxReply is the largest reply we accept from the daemon before we consider the connection broken
+const daemonMaxReply = 4096
+
+// daemonReplyIdle is how long we wait for more of a reply that does not end with an empty line
+const daemonReplyIdle = 50 * time.Millisecond
+
+var errDaemonReplySize = errors.New("reply exceeds maximum size")
+
+// the histograms for the classify requests are created once so each request only updates them
+var daemonWaitHistogram = overseer.GetHistogram("classify_daemon_wait_seconds", nil)
+var daemonOkHistogram = overseer.GetHistogram("classify_daemon_seconds", overseer.Labels{"result": "ok"})
+var daemonErrorHistogram = overseer.GetHistogram("classify_daemon_seconds", overseer.Labels{"result": "error"})
+var daemonTimeoutHistogram = overseer.GetHistogram("classify_daemon_seconds", overseer.Labels{"result": "timeout"})
+
+// daemonConnection is one of the connections in the pool. The lock channel holds a single token
+// so a request can give up waiting for the connection when its deadline expires. The socket
+// and reader must only be used by the holder of the lock.
+type daemonConnection struct {
+	index   int
+	address string
+	lock    chan bool
+	socket  net.Conn
+	reader  *bufio.Reader
+}
+
+// daemonConfig is the daemon address and the number of connections in the pool
+type daemonConfig struct {
+	address     string
+	connections int
+}
+
+// daemonPool is the list of connections to the daemon. Each session is always sent to the
+// same connection so the daemon receives the packets for a session in order, while packets
+// for different sessions are classified in parallel. The pool is replaced when the daemon
+// settings change so it must only be used through getDaemonPool.
+var daemonPool []*daemonConnection
+var daemonPoolMutex sync.RWMutex
+var daemonPoolSize = 4
+
+// daemonCurrent is the configuration of the pool and daemonPending is a new configuration
+// from the settings that the socket manager has not applied yet
+var daemonCurrent daemonConfig
+var daemonPending *daemonConfig
+var daemonConfigMutex sync.Mutex
+
+// daemonSocketManager is a goroutine to handle the daemon socket connections
 func daemonSocketManager(control chan bool) {
 	logger.Info("The daemonSocketManager is starting\n")
+
+	daemonPoolMutex.Lock()
+	daemonPool = createDaemonPool(daemonCurrent)
+	daemonPoolMutex.Unlock()
 	control <- true
 
 	for {
 		message := <-socketChannel
 
-		// +++ socketConnect is sent to initiate the daemon socket connection
-		if message == socketConnect {
+		// +++ socketConnect is sent to initiate the daemon socket connections and socketReload
+		// is sent when the daemon settings change. Signals are dropped when one is already
+		// waiting so we check for a new configuration on both.
+		if message == socketConnect || message == socketReload {
+			if takeDaemonConfig() {
+				daemonSocketReload()
+			}
 			daemonSocketConnect()
 		}
 
@@ -39,120 +97,278 @@ func daemonSocketManager(control chan bool) {
 	}
 }
 
-// daemonSocketConnect is called to establish the connection to the daemon
-func daemonSocketConnect() {
-	var err error
+// getDaemonPool returns the current list of connections to the daemon
+func getDaemonPool() []*daemonConnection {
+	daemonPoolMutex.RLock()
+	defer daemonPoolMutex.RUnlock()
+	return daemonPool
+}
 
-	socketMutex.Lock()
-	defer socketMutex.Unlock()
+// createDaemonPool creates the unconnected list of connections for the argumented configuration
+func createDaemonPool(config daemonConfig) []*daemonConnection {
+	pool := make([]*daemonConnection, config.connections)
+	for i := range pool {
+		pool[i] = &daemonConnection{index: i, address: config.address, lock: make(chan bool, 1)}
+	}
+	return pool
+}
 
-	// if the socket is already connected we don't do anything
-	if daemonSocket != nil {
+// setDaemonConfig stores a new daemon configuration and signals the socket manager
+// to replace the connection pool if it is different from the current configuration
+func setDaemonConfig(config daemonConfig) {
+	daemonConfigMutex.Lock()
+	if config == daemonCurrent {
+		daemonPending = nil
+		daemonConfigMutex.Unlock()
 		return
 	}
+	daemonPending = &config
+	daemonConfigMutex.Unlock()
 
-	logger.Info("Attempting to connect to classify daemon(%s)\n", classdHostPort) // FIXME
+	signalSocketManager(socketReload)
+}
 
-	// establish our connection to the daemon
-	daemonSocket, err = net.DialTimeout("tcp", classdHostPort, 2*time.Second)
-	if err != nil {
-		logger.Err("Error calling net.DialTimeout(%s): %v\n", classdHostPort, err)
+// takeDaemonConfig makes the pending daemon configuration current and returns true
+// if there was one. It is only called from the socket manager.
+func takeDaemonConfig() bool {
+	daemonConfigMutex.Lock()
+	defer daemonConfigMutex.Unlock()
+
+	if daemonPending == nil {
+		return false
+	}
+	daemonCurrent = *daemonPending
+	daemonPending = nil
+	return true
+}
+
+// daemonSocketReload replaces the connection pool after the daemon configuration has
+// changed. Requests already waiting on the old connections return an empty reply.
+func daemonSocketReload() {
+	logger.Info("Reconnecting to classify daemon(%s) with %d connections\n", daemonCurrent.address, daemonCurrent.connections)
+
+	daemonPoolMutex.Lock()
+	oldPool := daemonPool
+	daemonPool = createDaemonPool(daemonCurrent)
+	daemonPoolMutex.Unlock()
+
+	closeDaemonPool(oldPool)
+}
+
+// daemonSocketConnect is called to establish any missing connections to the daemon
+func daemonSocketConnect() {
+	failed := false
+
+	for _, conn := range getDaemonPool() {
+		conn.lock <- true
+
+		// if the socket is already connected we don't do anything
+		if conn.socket != nil {
+			<-conn.lock
+			continue
+		}
+
+		logger.Info("Attempting to connect to classify daemon(%s) for connection %d\n", conn.address, conn.index)
+
+		// establish our connection to the daemon
+		socket, err := net.DialTimeout("tcp", conn.address, 2*time.Second)
+		if err != nil {
+			logger.Err("Error calling net.DialTimeout(%s): %v\n", conn.address, err)
+			<-conn.lock
+			failed = true
+			break
+		}
+
+		conn.socket = socket
+		conn.reader = bufio.NewReaderSize(socket, daemonMaxReply)
+		<-conn.lock
+
+		logger.Info("Successfully connected to classify daemon(%s) for connection %d\n", conn.address, conn.index)
+	}
+
+	if failed {
 		time.Sleep(time.Second)
 		signalSocketManager(socketConnect)
-		return
 	}
-
-	logger.Info("Successfully connected to classify daemon(%s)\n", classdHostPort)
 }
 
-// daemonSocketClose is called to close the daemon socket connection
+// daemonSocketClose is called to close the daemon socket connections
 func daemonSocketClose() {
-	socketMutex.Lock()
-	defer socketMutex.Unlock()
+	closeDaemonPool(getDaemonPool())
+}
 
-	if daemonSocket == nil {
-		return
+// closeDaemonPool closes the connections in the argumented pool
+func closeDaemonPool(pool []*daemonConnection) {
+	for _, conn := range pool {
+		conn.lock <- true
+		if conn.socket != nil {
+			conn.socket.Close()
+			conn.socket = nil
+			conn.reader = nil
+		}
+		<-conn.lock
 	}
-
-	daemonSocket.Close()
-	daemonSocket = nil
 }
 
-// daemonSocketReset is called when any socket send or receive error is detected
-// we already hold the mutex so we close, clear, and send the signal to reconnect
-func daemonSocketRecycle() {
-	if daemonSocket != nil {
-		daemonSocket.Close()
-		daemonSocket = nil
+// recycle is called when any socket send or receive error is detected. We already
+// hold the connection lock so we close, clear, and send the signal to reconnect.
+func (conn *daemonConnection) recycle() {
+	if conn.socket != nil {
+		conn.socket.Close()
+		conn.socket = nil
+		conn.reader = nil
 	}
 	signalSocketManager(socketConnect)
 }
 
-// daemonClassifyPacket sends data to the daemon for classification and returns the reply
-func daemonClassifyPacket(command string, buffer []byte) string {
-	var reply string
-	var tot int
-	var err error
-
-	socketMutex.Lock()
-	defer socketMutex.Unlock()
-
-	// if the socket is nil we can't classify the data
-	if daemonSocket == nil {
+// daemonClassifyPacket sends data to the daemon for classification and returns the reply.
+// An empty reply is returned if the daemon is not connected or does not reply in time.
+func daemonClassifyPacket(sessionID int64, command string, buffer []byte) string {
+	pool := getDaemonPool()
+	if len(pool) == 0 {
 		return ""
 	}
 
-	logger.Trace("DAEMON COMMAND: %s\n", command)
-
-	// write the command to the daemon socket
-	daemonSocket.SetWriteDeadline(time.Now().Add(2 * time.Second))
-	tot, err = daemonSocket.Write([]byte(command))
+	conn := pool[uint64(sessionID)%uint64(len(pool))]
+	start := time.Now()
+	deadline := start.Add(daemonRequestTimeout)
 
-	// on write error recycle the socket connection and return empty result
-	if err != nil {
-		logger.Err("Error writing command to daemon socket: %v\n", err)
-		daemonSocketRecycle()
+	// wait for the connection without waiting longer than the request deadline
+	timer := time.NewTimer(daemonRequestTimeout)
+	select {
+	case conn.lock <- true:
+		timer.Stop()
+	case <-timer.C:
+		logger.Warn("Timeout waiting for classify daemon connection %d\n", conn.index)
+		overseer.AddCounter("classify_daemon_busy", 1)
 		return ""
 	}
+	defer func() { <-conn.lock }()
+	daemonWaitHistogram.ObserveDuration(time.Since(start))
 
-	// on short write recycle the socket connection and return empty result
-	if tot != len(command) {
-		logger.Err("Underrun %d of %d writing command to daemon socket\n", tot, len(command))
-		daemonSocketRecycle()
+	// if the socket is nil we can't classify the data
+	if conn.socket == nil {
 		return ""
 	}
 
-	// write the packet data to the daemon socket
-	daemonSocket.SetWriteDeadline(time.Now().Add(2 * time.Second))
-	tot, err = daemonSocket.Write(buffer)
-
-	// on write error recycle the socket connection and return empty result
+	reply, err := conn.request(command, buffer, deadline)
 	if err != nil {
-		logger.Err("Error writing data to daemon socket: %v\n", err)
-		daemonSocketRecycle()
+		histogram := daemonErrorHistogram
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			histogram = daemonTimeoutHistogram
+		}
+		logger.Err("Error talking to classify daemon on connection %d: %v\n", conn.index, err)
+		histogram.ObserveDuration(time.Since(start))
+		conn.recycle()
 		return ""
 	}
 
-	// on short write recycle the socket connection and return empty result
-	if tot != len(buffer) {
-		logger.Err("Underrun %d of %d writing data to daemon socket\n", tot, len(buffer))
-		daemonSocketRecycle()
-		return ""
+	daemonOkHistogram.ObserveDuration(time.Since(start))
+	return reply
+}
+
+// request writes the command and packet data to the daemon and reads the reply. The
+// caller must hold the connection lock and recycle the connection if an error is returned.
+func (conn *daemonConnection) request(command string, buffer []byte, deadline time.Time) (string, error) {
+	// anything still buffered is left over from an earlier reply so we throw it away
+	// rather than returning it as the reply to this request
+	if stale := conn.reader.Buffered(); stale > 0 {
+		logger.Warn("Discarding %d stale bytes from classify daemon connection %d\n", stale, conn.index)
+		overseer.AddCounter("classify_daemon_stale", 1)
+		conn.reader.Discard(stale)
 	}
 
-	// read the reply from the daemon
-	daemonSocket.SetReadDeadline(time.Now().Add(2 * time.Second))
-	tot, err = daemonSocket.Read(daemonBuffer)
+	logger.Trace("DAEMON COMMAND: %s\n", command)
+
+	conn.socket.SetDeadline(deadline)
 
-	// on read error recycle the socket connection and return empty result
+	// write the command and packet data to the daemon socket
+	data := net.Buffers{[]byte(command), buffer}
+	total := int64(len(command) + len(buffer))
+	tot, err := data.WriteTo(conn.socket)
 	if err != nil {
-		logger.Err("Error reading reply from daemon socket: %v\n", err)
-		daemonSocketRecycle()
-		return ""
+		return "", fmt.Errorf("writing command: %v", err)
+	}
+	if tot != total {
+		return "", fmt.Errorf("underrun %d of %d writing command", tot, total)
+	}
+
+	reply, err := conn.readReply(deadline)
+	if err != nil {
+		return "", err
 	}
 
-	// convert the buffer to a string and return the classification result
-	reply = string(daemonBuffer[:tot])
 	logger.Trace("DAEMON REPLY: %s\n", reply)
-	return reply
+	return reply, nil
+}
+
+// readReply reads a reply from the daemon one line at a time so a reply split across
+// several reads is returned whole. A reply is a list of "NAME: value" lines that end with
+// CRLF, such as the APPLICATION, PROTOCHAIN, DETAIL, CONFIDENCE, and STATE lines of a
+// classification, followed by an empty line. Some daemon versions leave out the empty
+// line so a STATE line also ends the reply if nothing more has been received. Replies
+// without a STATE line, such as errors, may also leave out the empty line so once a
+// complete line has been received the reply ends when nothing more arrives within
+// daemonReplyIdle. Any late data is discarded before the next request.
+func (conn *daemonConnection) readReply(deadline time.Time) (string, error) {
+	var reply strings.Builder
+	var partial string
+	var state bool
+
+	for {
+		// only wait for the idle time after a complete line has been received
+		wait := deadline
+		if reply.Len() > 0 && partial == "" {
+			if idle := time.Now().Add(daemonReplyIdle); idle.Before(deadline) {
+				wait = idle
+			}
+		}
+		conn.socket.SetReadDeadline(wait)
+
+		line, err := conn.reader.ReadString('\n')
+		line = partial + line
+		partial = ""
+
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() || reply.Len() == 0 {
+				return "", err
+			}
+			// nothing more arrived after the last line so the reply is complete
+			if line == "" {
+				break
+			}
+			// part of a line arrived so we wait for the rest until the deadline
+			if !wait.Before(deadline) {
+				return "", err
+			}
+			partial = line
+			if reply.Len()+len(partial) > daemonMaxReply {
+				return "", errDaemonReplySize
+			}
+			continue
+		}
+
+		if line == "\r\n" || line == "\n" {
+			// an empty line before the reply is the end of an earlier reply
+			if reply.Len() == 0 {
+				continue
+			}
+			break
+		}
+
+		reply.WriteString(line)
+		if reply.Len() > daemonMaxReply {
+			return "", errDaemonReplySize
+		}
+
+		if strings.HasPrefix(line, "STATE: ") {
+			state = true
+		}
+		if state && conn.reader.Buffered() == 0 {
+			break
+		}
+	}
+
+	return reply.String(), nil
 }
@@ -26,6 +26,19 @@ var shutdownChannel = make(chan bool)
 var geoDatabaseReader *geoip2.Reader
 var geoMutex sync.Mutex
 var privateIPBlocks []*net.IPNet
+var settingsSubscription int
+
+// defaultPrivateNetworks always get the XL local country code. More networks, such as
+// a LAN using public addresses, can be added with the geoip/localNetworks setting.
+var defaultPrivateNetworks = []string{
+	"127.0.0.0/8",    // IPv4 loopback
+	"10.0.0.0/8",     // RFC1918
+	"172.16.0.0/12",  // RFC1918
+	"192.168.0.0/16", // RFC1918
+	"::1/128",        // IPv6 loopback
+	"fe80::/10",      // IPv6 link-local
+	"fc00::/7",       // IPv6 unique local addr
+}
 
 // PluginStartup is called to allow plugin specific initialization.
 // We initialize an instance of the GeoIP engine using any existing
@@ -53,18 +66,19 @@ func PluginStartup() {
 		geoDatabaseReader = db
 	}
 
-	for _, cidr := range []string{
-		"127.0.0.0/8",    // IPv4 loopback
-		"10.0.0.0/8",     // RFC1918
-		"172.16.0.0/12",  // RFC1918
-		"192.168.0.0/16", // RFC1918
-		"::1/128",        // IPv6 loopback
-		"fe80::/10",      // IPv6 link-local
-		"fc00::/7",       // IPv6 unique local addr
-	} {
-		_, block, _ := net.ParseCIDR(cidr)
-		privateIPBlocks = append(privateIPBlocks, block)
+	value, err := settings.GetSettings([]string{"geoip", "localNetworks"})
+	if err != nil {
+		value = nil
 	}
+	privateIPBlocks = getPrivateNetworks(value)
+
+	settingsSubscription = settings.Subscribe("geoip/localNetworks", func(oldValue interface{}, newValue interface{}) {
+		blocks := getPrivateNetworks(newValue)
+		geoMutex.Lock()
+		privateIPBlocks = blocks
+		geoMutex.Unlock()
+		logger.Info("Loaded %d local networks\n", len(blocks))
+	})
 
 	go downloadTask()
 	dispatch.InsertNfqueueSubscription(pluginName, dispatch.GeoipPriority, PluginNfqueueHandler)
@@ -76,6 +90,7 @@ func PluginStartup() {
 func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
 
+	settings.Unsubscribe(settingsSubscription)
 	shutdownChannel <- true
 
 	select {
@@ -168,6 +183,37 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	return result
 }
 
+// getPrivateNetworks returns the default private networks and the networks in the
+// argumented geoip/localNetworks setting. Invalid networks are logged and ignored.
+func getPrivateNetworks(value interface{}) []*net.IPNet {
+	var blocks []*net.IPNet
+
+	for _, cidr := range defaultPrivateNetworks {
+		_, block, _ := net.ParseCIDR(cidr)
+		blocks = append(blocks, block)
+	}
+
+	list, _ := value.([]interface{})
+	for _, item := range list {
+		cidr, _ := item.(string)
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Warn("Ignoring invalid local network %v\n", item)
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
 func isPrivateIP(ip net.IP) bool {
 	for _, block := range privateIPBlocks {
 		if block.Contains(ip) {
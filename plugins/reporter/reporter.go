@@ -79,6 +79,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		"family":                session.GetFamily(),
 	}
 	reports.LogEvent(reports.CreateEvent("session_new", "sessions", 1, columns, nil))
+	dispatch.PublishSessionEvent(dispatch.SessionEventNew, session, columns)
 	for k, v := range columns {
 		session.PutAttachment(k, v)
 		if k == "time_stamp" {
@@ -115,6 +116,7 @@ func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
 				"server_interface_type": session.GetServerInterfaceType(),
 			}
 			reports.LogEvent(reports.CreateEvent("session_nat", "sessions", 2, columns, modifiedColumns))
+			dispatch.PublishSessionEvent(dispatch.SessionEventUpdate, session, modifiedColumns)
 			for k, v := range modifiedColumns {
 				session.PutAttachment(k, v)
 				dict.AddSessionEntry(session.GetConntrackID(), k, v)
@@ -0,0 +1,445 @@
+// Package signatures classifies sessions using the application signatures in the
+// settings. The signatures label traffic that classd does not know, like internal
+// applications that classd only reports as SSL, and write the same application
+// attachments as the classify plugin.
+package signatures
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const pluginName = "signatures"
+
+// maxPacketCount is the number of packets we inspect waiting for the SNI, certificate, and DNS details
+const maxPacketCount = 20
+
+// defaultConfidence is used when a signature does not set the confidence. Since it is the
+// highest confidence classd reports, signatures override classd unless they set a lower value.
+const defaultConfidence = 100
+
+// signatureRule is an application signature from the settings. A session matches when it
+// matches every criteria that is set, and a criteria matches when any of its values match.
+// The hostnames globs are checked against the SNI, the certificate names, and the DNS hint.
+type signatureRule struct {
+	ID               string   `json:"id"`
+	Name             string   `json:"name"`
+	Category         string   `json:"category"`
+	Productivity     uint8    `json:"productivity"`
+	Risk             uint8    `json:"risk"`
+	Confidence       *int32   `json:"confidence"`
+	Enabled          *bool    `json:"enabled"`
+	Hostnames        []string `json:"hostnames"`
+	SNI              []string `json:"sni"`
+	CertificateNames []string `json:"certificateNames"`
+	DNSNames         []string `json:"dnsNames"`
+	Addresses        []string `json:"addresses"`
+	Ports            []string `json:"ports"`
+	Protocols        []string `json:"protocols"`
+	JA3              []string `json:"ja3"`
+}
+
+// signature is a signatureRule prepared for matching
+type signature struct {
+	rule       signatureRule
+	confidence int32
+	hostnames  []string
+	sni        []string
+	certNames  []string
+	dnsNames   []string
+	networks   []*net.IPNet
+	ports      [][2]uint16
+	protocols  []uint8
+	ja3        []string
+}
+
+// sessionDetails are the session values the signatures are matched against
+type sessionDetails struct {
+	sni       string
+	certNames []string
+	dnsHint   string
+	address   net.IP
+	port      uint16
+	protocol  uint8
+	ja3       string
+}
+
+var protocolNumbers = map[string]uint8{"icmp": 1, "tcp": 6, "udp": 17, "icmpv6": 58, "sctp": 132}
+
+var signatureList []*signature
+var signatureMutex sync.RWMutex
+var settingsSubscription int
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+
+	loadSignatures()
+	settingsSubscription = settings.Subscribe("classify/signatures", func(oldValue interface{}, newValue interface{}) {
+		loadSignatures()
+	})
+
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.SignaturesPriority, PluginNfqueueHandler)
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+	settings.Unsubscribe(settingsSubscription)
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. We check the session
+// against the signatures until one matches, or until we have seen enough packets that
+// the SNI, certificate, and DNS details should have been found by the other plugins.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+
+	signatureMutex.RLock()
+	list := signatureList
+	signatureMutex.RUnlock()
+
+	if len(list) == 0 || mess.Session == nil {
+		result.SessionRelease = true
+		return result
+	}
+
+	details := getSessionDetails(mess.Session)
+	for _, item := range list {
+		if item.matches(details) {
+			applySignature(mess.Session, ctid, item)
+			result.SessionRelease = true
+			return result
+		}
+	}
+
+	result.SessionRelease = mess.Session.GetPacketCount() >= maxPacketCount
+	return result
+}
+
+// loadSignatures reads the signatures from the settings. Invalid signatures are logged and ignored.
+func loadSignatures() {
+	var rules []signatureRule
+	var list []*signature
+
+	value, err := settings.GetSettings([]string{"classify", "signatures"})
+	if err == nil && value != nil {
+		raw, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(raw, &rules)
+		}
+		if err != nil {
+			logger.Warn("Invalid application signatures: %v\n", err)
+		}
+	}
+
+	for i, rule := range rules {
+		if rule.Enabled != nil && !*rule.Enabled {
+			continue
+		}
+		item, err := compileSignature(rule)
+		if err != nil {
+			logger.Warn("Ignoring application signature %d (%s): %v\n", i, rule.ID, err)
+			continue
+		}
+		list = append(list, item)
+	}
+
+	signatureMutex.Lock()
+	signatureList = list
+	signatureMutex.Unlock()
+
+	logger.Info("Loaded %d application signatures\n", len(list))
+}
+
+// compileSignature checks the signature and prepares it for matching
+func compileSignature(rule signatureRule) (*signature, error) {
+	if rule.ID == "" || rule.Name == "" {
+		return nil, fmt.Errorf("missing id or name")
+	}
+
+	item := &signature{rule: rule, confidence: defaultConfidence}
+	if rule.Confidence != nil {
+		if *rule.Confidence < 0 || *rule.Confidence > 100 {
+			return nil, fmt.Errorf("invalid confidence %d", *rule.Confidence)
+		}
+		item.confidence = *rule.Confidence
+	}
+
+	var err error
+	if item.hostnames, err = compileGlobs(rule.Hostnames); err != nil {
+		return nil, err
+	}
+	if item.sni, err = compileGlobs(rule.SNI); err != nil {
+		return nil, err
+	}
+	if item.certNames, err = compileGlobs(rule.CertificateNames); err != nil {
+		return nil, err
+	}
+	if item.dnsNames, err = compileGlobs(rule.DNSNames); err != nil {
+		return nil, err
+	}
+
+	for _, value := range rule.Addresses {
+		if !strings.Contains(value, "/") {
+			if strings.Contains(value, ":") {
+				value += "/128"
+			} else {
+				value += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s", value)
+		}
+		item.networks = append(item.networks, network)
+	}
+
+	for _, value := range rule.Ports {
+		low, high := value, value
+		if spot := strings.Index(value, "-"); spot > 0 {
+			low, high = value[:spot], value[spot+1:]
+		}
+		first, err1 := strconv.ParseUint(low, 10, 16)
+		last, err2 := strconv.ParseUint(high, 10, 16)
+		if err1 != nil || err2 != nil || first > last {
+			return nil, fmt.Errorf("invalid port %s", value)
+		}
+		item.ports = append(item.ports, [2]uint16{uint16(first), uint16(last)})
+	}
+
+	for _, value := range rule.Protocols {
+		number, found := protocolNumbers[strings.ToLower(value)]
+		if !found {
+			parsed, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid protocol %s", value)
+			}
+			number = uint8(parsed)
+		}
+		item.protocols = append(item.protocols, number)
+	}
+
+	for _, value := range rule.JA3 {
+		item.ja3 = append(item.ja3, strings.ToLower(value))
+	}
+
+	if len(item.hostnames)+len(item.sni)+len(item.certNames)+len(item.dnsNames)+len(item.networks)+len(item.ports)+len(item.protocols)+len(item.ja3) == 0 {
+		return nil, fmt.Errorf("no match criteria")
+	}
+
+	return item, nil
+}
+
+// compileGlobs returns the lower case hostname globs after checking the syntax
+func compileGlobs(globs []string) ([]string, error) {
+	var list []string
+	for _, value := range globs {
+		value = strings.ToLower(value)
+		if _, err := path.Match(value, ""); err != nil || value == "" {
+			return nil, fmt.Errorf("invalid hostname glob %s", value)
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// getSessionDetails gets the values the signatures are matched against from the session
+func getSessionDetails(session *dispatch.Session) sessionDetails {
+	tuple := session.GetClientSideTuple()
+	details := sessionDetails{
+		address:  tuple.ServerAddress,
+		port:     tuple.ServerPort,
+		protocol: tuple.Protocol,
+	}
+
+	details.sni, _ = session.GetAttachment("ssl_sni").(string)
+	details.dnsHint, _ = session.GetAttachment("server_dns_hint").(string)
+	details.ja3, _ = session.GetAttachment("ssl_ja3").(string)
+
+	// the certificate names are the common name and subject alternative names separated by |
+	if names, ok := session.GetAttachment("cert_dns_names").(string); ok {
+		for _, name := range strings.Split(names, "|") {
+			if name != "" {
+				details.certNames = append(details.certNames, name)
+			}
+		}
+	}
+
+	return details
+}
+
+// matches returns true if the session details match every criteria in the signature
+func (item *signature) matches(details sessionDetails) bool {
+	if len(item.hostnames) > 0 {
+		names := append([]string{details.sni, details.dnsHint}, details.certNames...)
+		if !matchGlobs(item.hostnames, names...) {
+			return false
+		}
+	}
+	if len(item.sni) > 0 && !matchGlobs(item.sni, details.sni) {
+		return false
+	}
+	if len(item.certNames) > 0 && !matchGlobs(item.certNames, details.certNames...) {
+		return false
+	}
+	if len(item.dnsNames) > 0 && !matchGlobs(item.dnsNames, details.dnsHint) {
+		return false
+	}
+
+	if len(item.networks) > 0 {
+		found := false
+		for _, network := range item.networks {
+			if details.address != nil && network.Contains(details.address) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(item.ports) > 0 {
+		found := false
+		for _, ports := range item.ports {
+			if details.port >= ports[0] && details.port <= ports[1] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(item.protocols) > 0 {
+		found := false
+		for _, protocol := range item.protocols {
+			if details.protocol == protocol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(item.ja3) > 0 {
+		found := false
+		for _, ja3 := range item.ja3 {
+			if details.ja3 == ja3 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchGlobs returns true if any of the names match any of the globs
+func matchGlobs(globs []string, names ...string) bool {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, glob := range globs {
+			if found, _ := path.Match(glob, name); found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applySignature writes the application details of the signature to the session. A signature
+// does not replace a classification from classd with a higher confidence, and classd does
+// not replace a signature unless it has a higher confidence.
+func applySignature(session *dispatch.Session, ctid uint32, item *signature) {
+	// WARNING - DO NOT USE Session GetAttachment or SetAttachment while the attachments are locked
+	attachments := session.LockAttachments()
+	defer session.UnlockAttachments()
+
+	if attachments["application_signature"] == item.rule.ID {
+		return
+	}
+	if current, ok := attachments["application_confidence"].(int32); ok && attachments["application_signature"] == nil && current > item.confidence {
+		logger.Debug("Ignoring signature %s with confidence %d < %d ctid:%d\n", item.rule.ID, item.confidence, current, ctid)
+		return
+	}
+
+	logger.Debug("Matched application signature %s ctid:%d\n", item.rule.ID, ctid)
+	attachments["application_signature"] = item.rule.ID
+
+	var changed []string
+	if updateClassifyDetail(attachments, ctid, "application_id", item.rule.ID) {
+		changed = append(changed, "application_id")
+	}
+	if updateClassifyDetail(attachments, ctid, "application_name", item.rule.Name) {
+		changed = append(changed, "application_name")
+	}
+	if updateClassifyDetail(attachments, ctid, "application_confidence", item.confidence) {
+		changed = append(changed, "application_confidence")
+	}
+	if updateClassifyDetail(attachments, ctid, "application_category", item.rule.Category) {
+		changed = append(changed, "application_category")
+	}
+	if updateClassifyDetail(attachments, ctid, "application_productivity", item.rule.Productivity) {
+		changed = append(changed, "application_productivity")
+	}
+	if updateClassifyDetail(attachments, ctid, "application_risk", item.rule.Risk) {
+		changed = append(changed, "application_risk")
+	}
+
+	if len(changed) > 0 {
+		logEvent(session, attachments, changed)
+	}
+}
+
+// updateClassifyDetail updates a key/value pair in the session attachments and the
+// nf_dict session table. Returns true if the value changed.
+func updateClassifyDetail(attachments map[string]interface{}, ctid uint32, pairname string, pairdata interface{}) bool {
+	// we don't want to put empty strings in the attachments or the dictionary
+	if value, ok := pairdata.(string); ok && len(value) == 0 {
+		return false
+	}
+
+	if attachments[pairname] == pairdata {
+		return false
+	}
+
+	attachments[pairname] = pairdata
+	dict.AddSessionEntry(ctid, pairname, pairdata)
+	return true
+}
+
+// logEvent logs a session_classify event that updates the application_* columns
+// and publishes the changes to the session event subscribers
+func logEvent(session *dispatch.Session, attachments map[string]interface{}, changed []string) {
+	columns := map[string]interface{}{
+		"session_id": session.GetSessionID(),
+	}
+	modifiedColumns := make(map[string]interface{})
+	for _, v := range changed {
+		modifiedColumns[v] = attachments[v]
+	}
+
+	reports.LogEvent(reports.CreateEvent("session_classify", "sessions", 2, columns, modifiedColumns))
+	dispatch.PublishSessionEvent(dispatch.SessionEventUpdate, session, modifiedColumns)
+}
@@ -1,6 +1,11 @@
 package sni
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
@@ -47,10 +52,19 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	// ClientHello, but hostname could still be nil if SNI isn't found
 	release, hostname := extractSNIhostname(mess.Payload)
 
+	// once we find the ClientHello we attach the JA3 fingerprint of the client
+	if release {
+		if ja3 := calculateJA3(mess.Payload); ja3 != "" {
+			logger.Debug("Calculated JA3 %s ctid:%d\n", ja3, ctid)
+			mess.Session.PutAttachment("ssl_ja3", ja3)
+		}
+	}
+
 	// if we found the hostname write to the dictionary and release the session
 	if hostname != "" {
 		logger.Debug("Extracted SNI %s ctid:%d\n", hostname, ctid)
 		dict.AddSessionEntry(ctid, "ssl_sni", hostname)
+		mess.Session.PutAttachment("ssl_sni", hostname)
 		logEvent(mess.Session, hostname)
 		result.SessionRelease = true
 		return result
@@ -202,7 +216,111 @@ func extractSNIhostname(buffer []byte) (bool, string) {
 	return true, hostname
 }
 
+// calculateJA3 returns the JA3 fingerprint of the TLS ClientHello in the buffer, which is the
+// MD5 hash of the client version, cipher suites, extensions, elliptic curves, and point formats.
+// GREASE values are ignored. An empty string is returned if the ClientHello is not complete.
+func calculateJA3(buffer []byte) string {
+	var ciphers, extensions, curves, formats []string
+
+	maxlen := len(buffer)
+	if maxlen < 44 || buffer[0] != 0x16 || buffer[5] != 0x01 {
+		return ""
+	}
+
+	version := (int(buffer[9]) << 8) + int(buffer[10])
+
+	// skip over the session ID
+	current := 43
+	current += 1 + int(buffer[current])
+	if current+2 > maxlen {
+		return ""
+	}
+
+	// collect the cipher suites
+	cipherSuiteLength := (int(buffer[current]) << 8) + int(buffer[current+1])
+	current += 2
+	if current+cipherSuiteLength > maxlen {
+		return ""
+	}
+	for i := current; i+1 < current+cipherSuiteLength; i += 2 {
+		value := (int(buffer[i]) << 8) + int(buffer[i+1])
+		if !isGreaseValue(value) {
+			ciphers = append(ciphers, strconv.Itoa(value))
+		}
+	}
+	current += cipherSuiteLength
+
+	// skip over the compression methods
+	if current >= maxlen {
+		return ""
+	}
+	current += 1 + int(buffer[current])
+
+	// the extensions are optional
+	if current+2 <= maxlen {
+		extensionsLength := (int(buffer[current]) << 8) + int(buffer[current+1])
+		current += 2
+		finish := current + extensionsLength
+		if finish > maxlen {
+			return ""
+		}
+
+		for current+4 <= finish {
+			extensionType := (int(buffer[current]) << 8) + int(buffer[current+1])
+			extensionDataLength := (int(buffer[current+2]) << 8) + int(buffer[current+3])
+			current += 4
+			if current+extensionDataLength > finish {
+				return ""
+			}
+			data := buffer[current : current+extensionDataLength]
+			current += extensionDataLength
+
+			if isGreaseValue(extensionType) {
+				continue
+			}
+			extensions = append(extensions, strconv.Itoa(extensionType))
+
+			switch extensionType {
+			case 10: // supported groups
+				if len(data) < 2 {
+					continue
+				}
+				for i := 2; i+1 < len(data) && i < 2+(int(data[0])<<8)+int(data[1]); i += 2 {
+					value := (int(data[i]) << 8) + int(data[i+1])
+					if !isGreaseValue(value) {
+						curves = append(curves, strconv.Itoa(value))
+					}
+				}
+			case 11: // ec point formats
+				if len(data) < 1 {
+					continue
+				}
+				for i := 1; i < len(data) && i <= int(data[0]); i++ {
+					formats = append(formats, strconv.Itoa(int(data[i])))
+				}
+			}
+		}
+	}
+
+	fields := []string{
+		strconv.Itoa(version),
+		strings.Join(ciphers, "-"),
+		strings.Join(extensions, "-"),
+		strings.Join(curves, "-"),
+		strings.Join(formats, "-"),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// isGreaseValue returns true for the reserved GREASE values that clients add to the
+// ClientHello at random, which must be ignored to get a stable fingerprint
+func isGreaseValue(value int) bool {
+	return (value&0x0f0f) == 0x0a0a && (value>>8) == (value&0xff)
+}
+
 // logEvent logs an update event that updates the ssl_sni column
+// and publishes the change to the session event subscribers
 // provide the session, and the sni string
 func logEvent(session *dispatch.Session, sslSni string) {
 	columns := map[string]interface{}{
@@ -213,4 +331,5 @@ func logEvent(session *dispatch.Session, sslSni string) {
 	modifiedColumns["ssl_sni"] = sslSni
 
 	reports.LogEvent(reports.CreateEvent("session_sni", "sessions", 2, columns, modifiedColumns))
+	dispatch.PublishSessionEvent(dispatch.SessionEventUpdate, session, modifiedColumns)
 }
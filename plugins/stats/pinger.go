@@ -15,12 +15,14 @@ package stats
 import (
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -136,6 +138,7 @@ func pingerWorker() {
 	pingLocker.Lock()
 	for index, entry := range pingMap {
 		logger.Debug("Detected ping timeout for %s on interface %s\n", entry.dstAddress, entry.srcAddress)
+		overseer.IncLabeledCounter("stats_ping_timeouts", overseer.Labels{"interface_id": strconv.Itoa(entry.interfaceID)})
 		interfaceMetricLocker.Lock()
 		interfaceMetricList[entry.interfaceID].PingTimeout++
 		interfaceMetricLocker.Unlock()
@@ -286,6 +289,7 @@ func watchNetworkSocket(socket *pingSocket) {
 		statsLocker[target.interfaceID].Unlock()
 
 		activeLocker[target.interfaceID].Lock()
+		latencyHistogram(&activeHistogram, "stats_active_latency_seconds", target.interfaceID).ObserveDuration(duration)
 		activeCollector[target.interfaceID].AddDataPoint(float64(duration.Nanoseconds()) / 1000000.0)
 		activeLocker[target.interfaceID].Unlock()
 
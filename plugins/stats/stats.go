@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -45,8 +46,17 @@ var interfaceStatsMap map[string]*linux.NetworkStat
 var interfaceDiffMap map[string]*linux.NetworkStat
 var interfaceDiffLocker sync.RWMutex
 
+// latencyBuckets are the histogram buckets in seconds used to record the passive and active latency
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2}
+
+// passiveHistogram and activeHistogram hold the latency histogram for each interface. They are
+// guarded by the passive and active lockers and only created for interfaces that see traffic.
+var passiveHistogram [256]*overseer.Histogram
+var activeHistogram [256]*overseer.Histogram
+
 var interfaceChannel = make(chan bool, 1)
 var pingerChannel = make(chan bool, 1)
+var settingsSubscription int
 
 type interfaceDetail struct {
 	interfaceID   int
@@ -62,6 +72,19 @@ type interfaceMetric struct {
 	lastPingTimeout uint64
 }
 
+// InterfaceLatencyStats holds the current latency details for an interface
+type InterfaceLatencyStats struct {
+	InterfaceID   int
+	InterfaceName string
+	DeviceName    string
+	Wan           bool
+	Combined      Collector
+	Passive       Collector
+	Active        Collector
+	Jitter        Collector
+	PingTimeouts  uint64
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
@@ -74,11 +97,18 @@ func PluginStartup() {
 		interfaceMetricList[x] = new(interfaceMetric)
 	}
 
+	overseer.RegisterHistogram("stats_passive_latency_seconds", latencyBuckets)
+	overseer.RegisterHistogram("stats_active_latency_seconds", latencyBuckets)
+
 	interfaceStatsMap = make(map[string]*linux.NetworkStat)
 	interfaceDiffMap = make(map[string]*linux.NetworkStat)
 
 	loadInterfaceDetailMap()
 	refreshActivePingInfo()
+	settingsSubscription = settings.Subscribe("network/interfaces", func(oldValue interface{}, newValue interface{}) {
+		logger.Info("Reloading interface details after network settings change\n")
+		reloadInterfaceDetails()
+	})
 
 	// the first check will record current status used to check for changes in subsequent calls
 	checkForInterfaceChanges()
@@ -93,6 +123,7 @@ func PluginStartup() {
 func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
 
+	settings.Unsubscribe(settingsSubscription)
 	interfaceChannel <- true
 
 	select {
@@ -116,13 +147,17 @@ func PluginShutdown() {
 func PluginSignal(message syscall.Signal) {
 	switch message {
 	case syscall.SIGHUP:
-		// reload the interface map and ping info and signal the pinger task to refresh the ICMP sockets
-		loadInterfaceDetailMap()
-		refreshActivePingInfo()
-		pingerChannel <- false
+		reloadInterfaceDetails()
 	}
 }
 
+// reloadInterfaceDetails reloads the interface map and ping info and signals the pinger task to refresh the ICMP sockets
+func reloadInterfaceDetails() {
+	loadInterfaceDetailMap()
+	refreshActivePingInfo()
+	pingerChannel <- false
+}
+
 // PluginNfqueueHandler is called to handle nfqueue packet data.
 func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
 	var result dispatch.NfqueueResult
@@ -173,6 +208,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 
 	statsLocker[interfaceID].Lock()
 	passiveLocker[interfaceID].Lock()
+	latencyHistogram(&passiveHistogram, "stats_passive_latency_seconds", int(interfaceID)).ObserveDuration(duration)
 	statsCollector[interfaceID].AddDataPointLimited(float64(duration.Nanoseconds())/1000000.0, 2.0)
 	passiveCollector[interfaceID].AddDataPointLimited(float64(duration.Nanoseconds())/1000000.0, 2.0)
 	statsLocker[interfaceID].Unlock()
@@ -181,6 +217,15 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	return result
 }
 
+// latencyHistogram returns the latency histogram for the interface from the argumented list,
+// creating it the first time it is used. The caller must hold the locker for the list.
+func latencyHistogram(list *[256]*overseer.Histogram, name string, interfaceID int) *overseer.Histogram {
+	if list[interfaceID] == nil {
+		list[interfaceID] = overseer.GetHistogram(name, overseer.Labels{"interface_id": strconv.Itoa(interfaceID)})
+	}
+	return list[interfaceID]
+}
+
 func interfaceTask() {
 
 	for {
@@ -665,6 +710,57 @@ func logHopCount(ctid uint32, mess dispatch.NfqueueMessage, name string) {
 	reports.LogEvent(reports.CreateEvent(name, "sessions", 2, columns, modifiedColumns))
 }
 
+// GetInterfaceLatencyStats returns copies of the latency collectors and
+// the total active ping timeouts for each of the known interfaces
+func GetInterfaceLatencyStats() []InterfaceLatencyStats {
+	var list []InterfaceLatencyStats
+
+	interfaceDetailLocker.RLock()
+	details := make([]interfaceDetail, 0, len(interfaceDetailMap))
+	for _, item := range interfaceDetailMap {
+		details = append(details, *item)
+	}
+	interfaceDetailLocker.RUnlock()
+
+	for _, item := range details {
+		id := item.interfaceID
+		if id < 0 || id >= len(statsCollector) || statsCollector[id] == nil {
+			continue
+		}
+
+		stat := InterfaceLatencyStats{
+			InterfaceID:   id,
+			InterfaceName: item.interfaceName,
+			DeviceName:    item.deviceName,
+			Wan:           item.wanFlag,
+		}
+
+		statsLocker[id].RLock()
+		stat.Combined = statsCollector[id].MakeCopy()
+		statsLocker[id].RUnlock()
+
+		passiveLocker[id].RLock()
+		stat.Passive = passiveCollector[id].MakeCopy()
+		passiveLocker[id].RUnlock()
+
+		activeLocker[id].RLock()
+		stat.Active = activeCollector[id].MakeCopy()
+		activeLocker[id].RUnlock()
+
+		jitterLocker[id].RLock()
+		stat.Jitter = jitterCollector[id].MakeCopy()
+		jitterLocker[id].RUnlock()
+
+		interfaceMetricLocker.Lock()
+		stat.PingTimeouts = interfaceMetricList[id].PingTimeout
+		interfaceMetricLocker.Unlock()
+
+		list = append(list, stat)
+	}
+
+	return list
+}
+
 // GetInterfaceRateDetails returns the per second rate for available interface metrics
 func GetInterfaceRateDetails(facename string) map[string]uint64 {
 	var retmap map[string]uint64
@@ -6,7 +6,11 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/untangle/packetd/services/logger"
 )
@@ -25,39 +29,67 @@ type ApplicationInfo struct {
 	Plugin       string `json:"plugin"`
 }
 
-// CategoryInfo contains details about a category (used when converting ApplicationTable to categories for extjs store)
+// CategoryInfo contains details about a category (used when converting the application table to categories for extjs store)
 type CategoryInfo struct {
 	Name string `json:"name"`
 }
 
+// SearchQuery holds the options for SearchApplications. Text is matched against the GUID,
+// name, and description, allowing for partial words and skipped characters. Categories
+// limits the results to the listed categories. The productivity and risk limits are
+// ignored when less than zero, and a Limit less than one returns all matches.
+type SearchQuery struct {
+	Text            string
+	Categories      []string
+	MinProductivity int
+	MaxProductivity int
+	MinRisk         int
+	MaxRisk         int
+	Limit           int
+}
+
 const guidInfoFile = "/usr/share/untangle-classd/protolist.csv"
 
-// ApplicationTable stores the details for each known application
-var ApplicationTable map[string]*ApplicationInfo
+// reloadCheckInterval is how often in seconds the application file is checked for changes
+const reloadCheckInterval = 60
+
+// applicationTable stores the details for each known application by GUID, with indexes
+// by number and lower case name. The tables are replaced, never modified, when the
+// file is reloaded so the ApplicationInfo pointers returned are safe to keep.
+var applicationTable = make(map[string]*ApplicationInfo)
+var applicationIndexes = make(map[int]*ApplicationInfo)
+var applicationNames = make(map[string]*ApplicationInfo)
+var tableMutex sync.RWMutex
+var tableModTime time.Time
+var tableSize int64
+
+var shutdownChannel = make(chan bool)
 
 // Startup is called when the packetd service starts
 func Startup() {
 	logger.Info("Starting up the Application Classification Table manager service\n")
 	loadApplicationTable()
+	go reloadTask()
 }
 
 // Shutdown is called when the packetd service stops
 func Shutdown() {
 	logger.Info("Shutting down the Application Classification Table manager service\n")
+
+	// Send shutdown signal to reloadTask and wait for it to return
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown appclassmanager reloadTask\n")
+	}
 }
 
 // GetApplicationTable returns the application table as JSON
 func GetApplicationTable() (string, error) {
 	logger.Debug("Getting application table...\n")
 
-	// convert it to a slice first
-	appTable := []*ApplicationInfo{}
-
-	for _, val := range ApplicationTable {
-		appTable = append(appTable, val)
-	}
-
-	jsonData, err := json.Marshal(appTable)
+	jsonData, err := json.Marshal(GetApplications())
 
 	if err != nil {
 		logger.Err("Unable to get ClassD application table: %s\n", err.Error())
@@ -67,7 +99,7 @@ func GetApplicationTable() (string, error) {
 	return string(jsonData), nil
 }
 
-// GetCategoryTable returns a distinct list of the categories we currently have in the ApplicationTable
+// GetCategoryTable returns a distinct list of the categories we currently have in the application table
 func GetCategoryTable() (string, error) {
 	logger.Debug("Getting Category table...\n")
 
@@ -76,7 +108,7 @@ func GetCategoryTable() (string, error) {
 	catSlice := []*CategoryInfo{}
 
 	// Iterate the table, if the map contains the slice then continue, otherwise add it to the map
-	for _, val := range ApplicationTable {
+	for _, val := range GetApplications() {
 		if catMap[val.Category] {
 			continue
 		}
@@ -97,6 +129,166 @@ func GetCategoryTable() (string, error) {
 
 }
 
+// GetApplications returns all of the applications sorted by GUID
+func GetApplications() []*ApplicationInfo {
+	tableMutex.RLock()
+	list := make([]*ApplicationInfo, 0, len(applicationTable))
+	for _, val := range applicationTable {
+		list = append(list, val)
+	}
+	tableMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].GUID < list[j].GUID })
+	return list
+}
+
+// LookupGUID returns the application with the argumented GUID
+func LookupGUID(guid string) (*ApplicationInfo, bool) {
+	tableMutex.RLock()
+	defer tableMutex.RUnlock()
+	info, found := applicationTable[guid]
+	return info, found
+}
+
+// LookupIndex returns the application with the argumented index
+func LookupIndex(index int) (*ApplicationInfo, bool) {
+	tableMutex.RLock()
+	defer tableMutex.RUnlock()
+	info, found := applicationIndexes[index]
+	return info, found
+}
+
+// LookupName returns the application with the argumented name, ignoring case
+func LookupName(name string) (*ApplicationInfo, bool) {
+	tableMutex.RLock()
+	defer tableMutex.RUnlock()
+	info, found := applicationNames[strings.ToLower(name)]
+	return info, found
+}
+
+// SearchApplications returns the applications matching the query with the best matches first
+func SearchApplications(query SearchQuery) []*ApplicationInfo {
+	type searchResult struct {
+		info  *ApplicationInfo
+		score int
+	}
+
+	var results []searchResult
+	text := strings.ToLower(strings.TrimSpace(query.Text))
+
+	categories := make(map[string]bool)
+	for _, value := range query.Categories {
+		categories[strings.ToLower(value)] = true
+	}
+
+	for _, info := range GetApplications() {
+		if len(categories) > 0 && !categories[strings.ToLower(info.Category)] {
+			continue
+		}
+		if !inRange(int(info.Productivity), query.MinProductivity, query.MaxProductivity) || !inRange(int(info.Risk), query.MinRisk, query.MaxRisk) {
+			continue
+		}
+
+		score := 1
+		if text != "" {
+			score = matchScore(text, strings.ToLower(info.GUID))
+			if value := matchScore(text, strings.ToLower(info.Name)); value > score {
+				score = value
+			}
+			if score == 0 && strings.Contains(strings.ToLower(info.Description), text) {
+				score = 5
+			}
+			if score == 0 {
+				continue
+			}
+		}
+		results = append(results, searchResult{info: info, score: score})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return strings.ToLower(results[i].info.Name) < strings.ToLower(results[j].info.Name)
+	})
+
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+
+	list := make([]*ApplicationInfo, len(results))
+	for i, item := range results {
+		list[i] = item.info
+	}
+	return list
+}
+
+// matchScore returns how well the lower case search text matches the lower case value.
+// Exact matches score highest, then prefixes, word prefixes, substrings, and finally
+// values that contain all of the characters in order. Returns zero if there is no match.
+func matchScore(text string, value string) int {
+	switch {
+	case value == text:
+		return 100
+	case strings.HasPrefix(value, text):
+		return 80
+	case strings.Contains(value, " "+text) || strings.Contains(value, "-"+text) || strings.Contains(value, "_"+text):
+		return 60
+	case strings.Contains(value, text):
+		return 40
+	}
+
+	// check for all of the characters in order, with a lower score for each skipped character
+	spot := 0
+	skipped := 0
+	for _, char := range text {
+		found := strings.IndexRune(value[spot:], char)
+		if found < 0 {
+			return 0
+		}
+		skipped += found
+		spot += found + len(string(char))
+	}
+	if skipped >= 20 {
+		return 10
+	}
+	return 30 - skipped
+}
+
+// inRange returns true if the value is within the limits, ignoring limits less than zero
+func inRange(value int, min int, max int) bool {
+	if min >= 0 && value < min {
+		return false
+	}
+	if max >= 0 && value > max {
+		return false
+	}
+	return true
+}
+
+// reloadTask periodically checks the application file and reloads it when it changes
+func reloadTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(reloadCheckInterval * time.Second):
+			info, err := os.Stat(guidInfoFile)
+			if err != nil {
+				continue
+			}
+			tableMutex.RLock()
+			changed := !info.ModTime().Equal(tableModTime) || info.Size() != tableSize
+			tableMutex.RUnlock()
+			if changed {
+				logger.Info("Reloading changed application details: %s\n", guidInfoFile)
+				loadApplicationTable()
+			}
+		}
+	}
+}
+
 // loadApplicationTable loads the details for each application
 func loadApplicationTable() {
 	var file *os.File
@@ -105,7 +297,9 @@ func loadApplicationTable() {
 	var list []string
 	var err error
 
-	ApplicationTable = make(map[string]*ApplicationInfo)
+	table := make(map[string]*ApplicationInfo)
+	indexes := make(map[int]*ApplicationInfo)
+	names := make(map[string]*ApplicationInfo)
 
 	// open the guid info file provided by Sandvine
 	file, err = os.Open(guidInfoFile)
@@ -116,6 +310,13 @@ func loadApplicationTable() {
 		return
 	}
 
+	stat, err := file.Stat()
+	if err != nil {
+		logger.Warn("Unable to check application details: %s\n", guidInfoFile)
+		file.Close()
+		return
+	}
+
 	// create a new CSV reader
 	reader := csv.NewReader(bufio.NewReader(file))
 	for {
@@ -174,11 +375,28 @@ func loadApplicationTable() {
 		info.Plugin = list[9]
 
 		// store the object in the table using the guid as the index
-		ApplicationTable[info.GUID] = info
+		table[info.GUID] = info
+		indexes[info.Index] = info
+		names[strings.ToLower(info.Name)] = info
 		infocount++
 	}
 
 	file.Close()
+
+	// a file that could not be parsed at all does not replace a table that was loaded
+	tableMutex.Lock()
+	tableModTime = stat.ModTime()
+	tableSize = stat.Size()
+	if infocount == 0 && len(applicationTable) > 0 {
+		tableMutex.Unlock()
+		logger.Warn("Ignoring empty application info file: %s\n", guidInfoFile)
+		return
+	}
+	applicationTable = table
+	applicationIndexes = indexes
+	applicationNames = names
+	tableMutex.Unlock()
+
 	logger.Info("Loaded classification details for %d applications\n", infocount)
 
 	// if there were any bad lines in the file log a warning
@@ -1,222 +1,414 @@
 package certmanager
 
 import (
-	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/settings"
 )
 
+// the local CA and the certificate it issues for the admin interface are kept with the
+// imported certificate so they survive a reboot and clients only need to trust the CA once
+const caCertPath = configuredCertDir + "/ca.crt"
+const caKeyPath = configuredCertDir + "/ca.key"
+const localCertPath = configuredCertDir + "/local.crt"
+const localKeyPath = configuredCertDir + "/local.key"
+
+// localCertDays is the lifetime of the local certificate, which is the longest browsers accept
+const localCertDays = 397
+
+// renewBeforeDays is how long before expiration the local certificate is renewed
+const renewBeforeDays = 30
+
+// renewCheckInterval is how often in seconds the certificates are checked for expiration
+const renewCheckInterval = 12 * 60 * 60
+
+var shutdownChannel = make(chan bool)
+var localCertMutex sync.Mutex
+var localCertChecked bool
+var settingsSubscriptions []int
+
 // Startup is called when the packetd service starts
 func Startup() {
 	logger.Info("Starting up the certificate manager service\n")
+
+	// a new hostname or domain name needs a new local certificate
+	for _, path := range []string{"system/hostName", "system/domainName"} {
+		settingsSubscriptions = append(settingsSubscriptions, settings.Subscribe(path, func(oldValue interface{}, newValue interface{}) {
+			checkCertificates()
+		}))
+	}
+
+	go renewTask()
 }
 
 // Shutdown is called when the packetd service stops
 func Shutdown() {
 	logger.Info("Shutting down the certificate manager service\n")
+
+	for _, id := range settingsSubscriptions {
+		settings.Unsubscribe(id)
+	}
+	settingsSubscriptions = nil
+
+	// Send shutdown signal to renewTask and wait for it to return
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown certmanager renewTask\n")
+	}
 }
 
-// GetConfiguredCert should retrieve configured certificates, or generate a self signed cert for mfw_admin
+// GetConfiguredCert returns the imported certificate if there is one, or the certificate issued by the local CA for mfw_admin
 func GetConfiguredCert() (certPath string, keyPath string) {
+	if fileExists(configuredCertPath) && fileExists(configuredKeyPath) {
+		return configuredCertPath, configuredKeyPath
+	}
 	certPath, keyPath = generateSelfSigned()
 	return
 }
 
-// generateSelfSigned will generate a self signed cert into the /tmp/ directory, the cert will be valid for 10 years
-// most of the logic taken from here: https://golang.org/src/crypto/tls/generate_cert.go
+// GetCACertificate returns the PEM certificate of the local CA so clients can trust it
+func GetCACertificate() ([]byte, error) {
+	localCertMutex.Lock()
+	defer localCertMutex.Unlock()
+
+	ca, _, err := loadOrCreateCA()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), nil
+}
+
+// generateSelfSigned returns the certificate issued by the local CA, issuing a new one if it is missing,
+// expiring, or does not have the current names. The certificate is fully checked the first time it is
+// used and after that by the renewTask, so this is cheap enough to call for every TLS handshake.
 func generateSelfSigned() (certPath string, keyPath string) {
-	var ca *x509.Certificate
-	var caPrivKey *ecdsa.PrivateKey
-	var certKey *ecdsa.PrivateKey
-	var certBytes []byte
+	localCertMutex.Lock()
+	defer localCertMutex.Unlock()
 
-	certPath = "/tmp/cert.pem"
-	keyPath = "/tmp/cert.key"
+	if !localCertChecked || !fileExists(localCertPath) || !fileExists(localKeyPath) {
+		renewLocalCertificate()
+		localCertChecked = true
+	}
+	return localCertPath, localKeyPath
+}
 
-	logger.Debug("Validating existing cert and path...\n")
-	if !checkCertKeyValidity(certPath, keyPath) {
-		logger.Debug("Create CA key info...\n")
-		ca, caPrivKey = createCACert()
+// renewTask periodically checks the certificates for expiration
+func renewTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(renewCheckInterval * time.Second):
+			checkCertificates()
+		}
+	}
+}
 
-		logger.Debug("Create MFW Certificate info...\n")
-		certBytes, certKey = createCert(ca, caPrivKey)
+// checkCertificates renews the local certificate if needed and warns if the imported certificate is expiring
+func checkCertificates() {
+	localCertMutex.Lock()
+	renewLocalCertificate()
+	localCertChecked = true
+	localCertMutex.Unlock()
 
-		logger.Debug("Save MFW cert info...\n")
-		saveCertificates(certPath, certBytes, keyPath, certKey)
+	if !fileExists(configuredCertPath) {
+		return
 	}
-	logger.Debug("Self signed cert and key generation complete.\n")
-	return
+	if err := checkCertKeyValidity(configuredCertPath, configuredKeyPath, renewBeforeDays, nil, nil); err != nil {
+		logger.Warn("The imported admin certificate should be replaced: %v\n", err)
+	}
+}
+
+// renewLocalCertificate issues a new local certificate if the current one is not valid.
+// The caller must hold the localCertMutex.
+func renewLocalCertificate() {
+	hostnames, addresses := getLocalNames()
+
+	err := checkCertKeyValidity(localCertPath, localKeyPath, renewBeforeDays, hostnames, addresses)
+	if err == nil {
+		return
+	}
+	logger.Info("Issuing a new local certificate: %v\n", err)
+
+	ca, caPrivKey, err := loadOrCreateCA()
+	if err != nil {
+		logger.Err("Failed to load the local CA: %v\n", err)
+		return
+	}
+
+	certBytes, certKey, err := createCert(ca, caPrivKey, hostnames, addresses)
+	if err != nil {
+		logger.Err("Failed to create the local certificate: %v\n", err)
+		return
+	}
+
+	// include the CA so clients get the whole chain
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	if err = saveCertificates(localCertPath, chain, localKeyPath, certKey); err != nil {
+		logger.Err("Failed to save the local certificate: %v\n", err)
+	}
+}
+
+// checkCertKeyValidity checks that the certificate and key files exist and match, that the certificate
+// is valid for at least the argumented number of days, and that it has all of the argumented names
+// and addresses. Returns an error describing the first problem found or nil if the certificate is valid.
+func checkCertKeyValidity(certPath string, keyPath string, days int, hostnames []string, addresses []net.IP) error {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.AddDate(0, 0, days).After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expires %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	for _, name := range hostnames {
+		if leaf.VerifyHostname(name) != nil {
+			return fmt.Errorf("certificate is not valid for %s", name)
+		}
+	}
+	for _, address := range addresses {
+		if leaf.VerifyHostname(address.String()) != nil {
+			return fmt.Errorf("certificate is not valid for %s", address.String())
+		}
+	}
+	return nil
 }
 
-// checkCertKeyValidity will validate the certpath and keypath files to determine if the input certificate and key is valid
-func checkCertKeyValidity(certPath string, keyPath string) bool {
-	if info, err := os.Stat(certPath); os.IsNotExist(err) || info.IsDir() {
-		return false
+// loadOrCreateCA loads the local CA, creating and saving a new one if it is missing or expired.
+// The caller must hold the localCertMutex.
+func loadOrCreateCA() (*x509.Certificate, crypto.Signer, error) {
+	err := checkCertKeyValidity(caCertPath, caKeyPath, 0, nil, nil)
+	if err == nil {
+		pair, err := tls.LoadX509KeyPair(caCertPath, caKeyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, errors.New("invalid CA private key")
+		}
+		return ca, signer, nil
+	}
+	if fileExists(caCertPath) {
+		logger.Warn("Replacing the local CA: %v\n", err)
 	}
 
-	if info, err := os.Stat(keyPath); os.IsNotExist(err) || info.IsDir() {
-		return false
+	ca, caPrivKey, err := createCACert()
+	if err != nil {
+		return nil, nil, err
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	if err = saveCertificates(caCertPath, caPEM, caKeyPath, caPrivKey); err != nil {
+		return nil, nil, err
 	}
 
-	return true
+	logger.Info("Created the local CA %s\n", ca.Subject.CommonName)
+	return ca, caPrivKey, nil
 }
 
-// createCACert will generate a ca certificate and private key
-func createCACert() (ca *x509.Certificate, caPrivKey *ecdsa.PrivateKey) {
-	ca = &x509.Certificate{
-		SerialNumber: big.NewInt(2019),
+// createCACert will generate a ca certificate and private key. The CA is only allowed to
+// sign end entity certificates and is valid for 10 years.
+func createCACert() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	serialNumber, err := createSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the serial makes the name unique so clients can trust the CAs of several boxes
+	suffix := serialNumber.Text(16)
+	if len(suffix) > 8 {
+		suffix = suffix[:8]
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName:         "www.untangle.com",
+			CommonName:         "Untangle Local CA " + suffix,
 			OrganizationalUnit: []string{"Security"},
 			Organization:       []string{"Untangle"},
 			Locality:           []string{"Sunnyvale"},
 			Province:           []string{"California"},
 			Country:            []string{"US"},
 		},
-		NotBefore:             time.Now(),
+		NotBefore:             time.Now().Add(-time.Hour),
 		NotAfter:              time.Now().AddDate(10, 0, 0),
 		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}
 
 	caPrivKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		logger.Warn("Failed to generate P256 private key: %s", err)
+		return nil, nil, fmt.Errorf("failed to generate P256 private key: %v", err)
 	}
 
-	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
+	caBytes, err := x509.CreateCertificate(rand.Reader, template, template, &caPrivKey.PublicKey, caPrivKey)
 	if err != nil {
-		logger.Warn("Failed to create P256 CA private key: %s", err)
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %v", err)
 	}
 
-	caPEM := new(bytes.Buffer)
-	pem.Encode(caPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	})
-
-	caPrivKeyPEM := new(bytes.Buffer)
-	caPrivBytes, err := x509.MarshalECPrivateKey(caPrivKey)
+	ca, err := x509.ParseCertificate(caBytes)
 	if err != nil {
-		logger.Warn("Failed to Marshal EC Private key for CA: %s", err)
+		return nil, nil, err
 	}
-
-	pem.Encode(caPrivKeyPEM, &pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: caPrivBytes,
-	})
-
-	return
+	return ca, caPrivKey, nil
 }
 
-// createCert will create a certificate (in bytes) and private key and sign using a given CA
-func createCert(ca *x509.Certificate, caPrivKey *ecdsa.PrivateKey) (certBytes []byte, privateKey *ecdsa.PrivateKey) {
-	var hostIps []net.IP
-	var hostnames []string
-	domainName := getSystemSetting("domainName")
-
-	hostIps = append(hostIps, net.IPv4(127, 0, 0, 1))
-	hostnames = append(hostnames, "localhost")
-	hostnames = append(hostnames, getSystemSetting("hostName"))
-
+// createCert will create a certificate (in bytes) and private key for the argumented names and addresses and sign using a given CA
+func createCert(ca *x509.Certificate, caPrivKey crypto.Signer, hostnames []string, addresses []net.IP) ([]byte, *ecdsa.PrivateKey, error) {
 	logger.Debug("Generating new private key...\n")
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		logger.Warn("Failed to generate P256 private key: %s", err)
+		return nil, nil, fmt.Errorf("failed to generate P256 private key: %v", err)
 	}
 
 	logger.Debug("Generating new serial number for certificate...\n")
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := createSerialNumber()
 	if err != nil {
-		logger.Warn("failed to generate serial number: %s", err)
+		return nil, nil, err
+	}
+
+	// the most specific name is last
+	commonName := "localhost"
+	if len(hostnames) > 0 {
+		commonName = hostnames[len(hostnames)-1]
 	}
 
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName:   string(domainName),
-			Organization: []string{domainName},
+			CommonName:   commonName,
+			Organization: []string{"Untangle"},
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(0, 0, localCertDays),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		IPAddresses:           hostIps,
+		IPAddresses:           addresses,
 		DNSNames:              hostnames,
 	}
 
 	logger.Debug("Creating certificate...\n")
-	certBytes, err = x509.CreateCertificate(rand.Reader, &template, ca, privateKey.Public(), caPrivKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, privateKey.Public(), caPrivKey)
 	if err != nil {
-		logger.Warn("Failed to create certificate: %v", err)
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
 	}
 
-	return
+	return certBytes, privateKey, nil
 }
 
-// saveCertificates will save the certificate bytes and certificate private keys into given certPath and keyPath files
-func saveCertificates(certPath string, certBytes []byte, keyPath string, certKey *ecdsa.PrivateKey) {
-
-	logger.Debug("Writing out %s...\n", certPath)
-	certOut, err := os.Create(certPath)
+// createSerialNumber returns a random 128 bit certificate serial number
+func createSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		logger.Warn("Failed to open %s for writing: %s", certPath, err)
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
 	}
-	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes}); err != nil {
-		logger.Warn("failed to write data to %s: %s", certPath, err)
+	return serialNumber, nil
+}
+
+// getLocalNames returns the hostnames and addresses the local certificate should be valid for
+func getLocalNames() ([]string, []net.IP) {
+	hostnames := []string{"localhost"}
+	if hostname := getSystemSetting("hostName"); hostname != "" && hostname != "localhost" && net.ParseIP(hostname) == nil {
+		hostnames = append(hostnames, hostname)
 	}
-	if err := certOut.Close(); err != nil {
-		logger.Warn("error closing %s: %s", certPath, err)
+	if fqdn := getHostname(); fqdn != "" && fqdn != hostnames[len(hostnames)-1] && net.ParseIP(fqdn) == nil {
+		hostnames = append(hostnames, fqdn)
 	}
 
-	logger.Debug("Writing out %s...\n", keyPath)
-	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	addresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	list, err := net.InterfaceAddrs()
 	if err != nil {
-		logger.Warn("failed to open %s for writing: %v", keyPath, err)
-		return
+		logger.Warn("Unable to get interface addresses: %v\n", err)
 	}
-	if err := pem.Encode(keyOut, pemBlockForKey(certKey)); err != nil {
-		logger.Warn("failed to write data to %s: %s", keyPath, err)
+	for _, item := range list {
+		network, ok := item.(*net.IPNet)
+		if !ok || !network.IP.IsGlobalUnicast() {
+			continue
+		}
+		addresses = append(addresses, network.IP)
 	}
-	if err := keyOut.Close(); err != nil {
-		logger.Warn("error closing %s: %s", keyPath, err)
+
+	return hostnames, addresses
+}
+
+// saveCertificates will save the PEM certificates and the private key into the given certPath and keyPath files
+func saveCertificates(certPath string, certPEM []byte, keyPath string, certKey crypto.Signer) error {
+	block, err := pemBlockForKey(certKey)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(configuredCertDir, 0700); err != nil {
+		return err
+	}
+
+	logger.Debug("Writing out %s...\n", keyPath)
+	if err = writeFileAtomic(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
 	}
+
+	logger.Debug("Writing out %s...\n", certPath)
+	return writeFileAtomic(certPath, certPEM, 0644)
 }
 
 // pemBlockForKey will return the pem block begin/end statements for a given private key
-func pemBlockForKey(priv interface{}) *pem.Block {
+func pemBlockForKey(priv interface{}) (*pem.Block, error) {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
 	case *ecdsa.PrivateKey:
 		b, err := x509.MarshalECPrivateKey(k)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-			os.Exit(2)
+			return nil, fmt.Errorf("unable to marshal ECDSA private key: %v", err)
 		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
 	default:
-		return nil
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
 	}
 }
 
+// fileExists returns true if the argumented file exists and is not a directory
+func fileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && !info.IsDir()
+}
+
 // getSystemSetting will use a setting name as input to retrieve system settings
 func getSystemSetting(settingName string) string {
 	settingValue, err := settings.GetSettings([]string{"system", settingName})
@@ -225,5 +417,9 @@ func getSystemSetting(settingName string) string {
 		return ""
 	}
 
-	return settingValue.(string)
+	value, ok := settingValue.(string)
+	if !ok {
+		logger.Warn("Invalid setting value for setting %s: %v\n", settingName, settingValue)
+	}
+	return value
 }
@@ -0,0 +1,250 @@
+package certmanager
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// configuredCertDir holds the certificate imported by the user for the admin interface
+const configuredCertDir = "/etc/config/certificates"
+const configuredCertPath = configuredCertDir + "/admin.crt"
+const configuredKeyPath = configuredCertDir + "/admin.key"
+
+// CertificateInfo describes the certificate used by the admin interface
+type CertificateInfo struct {
+	Source      string   `json:"source"`
+	Subject     string   `json:"subject"`
+	Issuer      string   `json:"issuer"`
+	DNSNames    []string `json:"dns_names"`
+	IPAddresses []string `json:"ip_addresses"`
+	NotBefore   int64    `json:"not_before"`
+	NotAfter    int64    `json:"not_after"`
+	Fingerprint string   `json:"fingerprint"`
+	ChainLength int      `json:"chain_length"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+// activeCertificate is the loaded certificate returned by GetCertificate. It is reloaded
+// when the certificate files change so new certificates are used without a restart.
+var activeCertificate *tls.Certificate
+var activeCertPath string
+var activeCertTime time.Time
+var activeCertMutex sync.Mutex
+
+// GetCertificate returns the certificate for TLS connections to the admin interface.
+// It is used as the tls.Config GetCertificate callback.
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPath, keyPath := GetConfiguredCert()
+
+	modTime := getModTime(certPath)
+	if keyTime := getModTime(keyPath); keyTime.After(modTime) {
+		modTime = keyTime
+	}
+
+	activeCertMutex.Lock()
+	defer activeCertMutex.Unlock()
+
+	if activeCertificate != nil && activeCertPath == certPath && activeCertTime.Equal(modTime) {
+		return activeCertificate, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		logger.Warn("Failed to load certificate %s: %v\n", certPath, err)
+		if activeCertificate != nil {
+			return activeCertificate, nil
+		}
+		return nil, err
+	}
+
+	logger.Info("Loaded admin certificate %s\n", certPath)
+	activeCertificate = &cert
+	activeCertPath = certPath
+	activeCertTime = modTime
+	return activeCertificate, nil
+}
+
+// GetCertificateInfo returns the details of the certificate used by the admin interface
+func GetCertificateInfo() (*CertificateInfo, error) {
+	certPath, _ := GetConfiguredCert()
+
+	raw, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parseCertificateChain(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	info := createCertificateInfo(chain)
+	info.Source = "local"
+	if certPath == configuredCertPath {
+		info.Source = "configured"
+	}
+	if time.Now().AddDate(0, 0, renewBeforeDays).After(chain[0].NotAfter) {
+		info.Warnings = append(info.Warnings, "Certificate expires "+chain[0].NotAfter.Format(time.RFC3339))
+	}
+	return info, nil
+}
+
+// ImportCertificate validates the PEM certificate chain and private key and saves them as
+// the certificate for the admin interface. The leaf certificate must come first, must
+// match the key, must be currently valid, and must have a subject alternative name.
+// If the key is empty the key of the last certificate signing request is used.
+func ImportCertificate(certPEM []byte, keyPEM []byte) (*CertificateInfo, error) {
+	chain, err := parseCertificateChain(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	pendingCSR := len(keyPEM) == 0
+	if pendingCSR {
+		if keyPEM, err = getCSRKey(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("Certificate and key do not match: %v", err)
+	}
+
+	leaf := chain[0]
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("Certificate is not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("Certificate expired %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	if len(leaf.DNSNames) == 0 && len(leaf.IPAddresses) == 0 {
+		return nil, errors.New("Certificate has no subject alternative names")
+	}
+	for i := 1; i < len(chain); i++ {
+		if err = chain[i-1].CheckSignatureFrom(chain[i]); err != nil {
+			return nil, fmt.Errorf("Certificate %d is not signed by the next certificate in the chain: %v", i-1, err)
+		}
+	}
+
+	if err = os.MkdirAll(configuredCertDir, 0700); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(configuredKeyPath, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(configuredCertPath, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	if pendingCSR {
+		if err = os.Remove(csrKeyPath); err != nil {
+			logger.Warn("Failed to remove %s: %v\n", csrKeyPath, err)
+		}
+	}
+
+	info := createCertificateInfo(chain)
+	info.Source = "configured"
+	if hostname := getHostname(); hostname != "" && leaf.VerifyHostname(hostname) != nil {
+		info.Warnings = append(info.Warnings, "Certificate is not valid for "+hostname)
+	}
+
+	logger.Info("Imported admin certificate for %s expiring %s\n", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	return info, nil
+}
+
+// RemoveCertificate removes the imported certificate so the certificate issued by the local CA is used
+func RemoveCertificate() error {
+	if err := os.Remove(configuredCertPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(configuredKeyPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logger.Info("Removed admin certificate\n")
+	return nil
+}
+
+// parseCertificateChain parses the PEM certificates in the argumented data
+func parseCertificateChain(data []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid certificate: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("No PEM certificates found")
+	}
+	return chain, nil
+}
+
+// createCertificateInfo returns the details of the leaf certificate in the chain
+func createCertificateInfo(chain []*x509.Certificate) *CertificateInfo {
+	leaf := chain[0]
+	sum := sha256.Sum256(leaf.Raw)
+
+	info := &CertificateInfo{
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		DNSNames:    leaf.DNSNames,
+		NotBefore:   leaf.NotBefore.Unix(),
+		NotAfter:    leaf.NotAfter.Unix(),
+		Fingerprint: strings.ToUpper(hex.EncodeToString(sum[:])),
+		ChainLength: len(chain),
+	}
+	for _, ip := range leaf.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// getHostname returns the fully qualified hostname from the system settings
+func getHostname() string {
+	hostname := getSystemSetting("hostName")
+	domainName := getSystemSetting("domainName")
+	if hostname != "" && domainName != "" && net.ParseIP(hostname) == nil {
+		return hostname + "." + domainName
+	}
+	return hostname
+}
+
+// getModTime returns the modification time of the file or the zero time if it does not exist
+func getModTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// writeFileAtomic writes the file through a temporary file so readers never see a partial file
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpName := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := ioutil.WriteFile(tmpName, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
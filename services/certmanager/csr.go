@@ -0,0 +1,131 @@
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// csrKeyPath holds the private key of the last certificate signing request until the
+// signed certificate is imported
+const csrKeyPath = configuredCertDir + "/admin.csr.key"
+
+// CSRRequest is the subject, names, and key type of a certificate signing request. If no
+// names are given the hostnames and addresses of the local certificate are used.
+type CSRRequest struct {
+	CommonName         string   `json:"common_name"`
+	Organization       string   `json:"organization"`
+	OrganizationalUnit string   `json:"organizational_unit"`
+	Locality           string   `json:"locality"`
+	Province           string   `json:"province"`
+	Country            string   `json:"country"`
+	DNSNames           []string `json:"dns_names"`
+	IPAddresses        []string `json:"ip_addresses"`
+	KeyType            string   `json:"key_type"`
+}
+
+// CreateCSR creates a new private key and returns a PEM certificate signing request for it
+// that can be signed by another CA. The key is saved so the signed certificate can be
+// imported without a key, and is replaced by the next request.
+func CreateCSR(request CSRRequest) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: request.CommonName},
+	}
+	if request.Organization != "" {
+		template.Subject.Organization = []string{request.Organization}
+	}
+	if request.OrganizationalUnit != "" {
+		template.Subject.OrganizationalUnit = []string{request.OrganizationalUnit}
+	}
+	if request.Locality != "" {
+		template.Subject.Locality = []string{request.Locality}
+	}
+	if request.Province != "" {
+		template.Subject.Province = []string{request.Province}
+	}
+	if request.Country != "" {
+		if len(request.Country) != 2 {
+			return nil, fmt.Errorf("Invalid country code %s", request.Country)
+		}
+		template.Subject.Country = []string{strings.ToUpper(request.Country)}
+	}
+
+	for _, item := range request.DNSNames {
+		if item == "" || strings.ContainsAny(item, " /:") {
+			return nil, fmt.Errorf("Invalid DNS name %s", item)
+		}
+		template.DNSNames = append(template.DNSNames, item)
+	}
+	for _, item := range request.IPAddresses {
+		address := net.ParseIP(item)
+		if address == nil {
+			return nil, fmt.Errorf("Invalid IP address %s", item)
+		}
+		template.IPAddresses = append(template.IPAddresses, address)
+	}
+	if len(template.DNSNames) == 0 && len(template.IPAddresses) == 0 {
+		template.DNSNames, template.IPAddresses = getLocalNames()
+	}
+	if template.Subject.CommonName == "" {
+		if len(template.DNSNames) > 0 {
+			template.Subject.CommonName = template.DNSNames[len(template.DNSNames)-1]
+		} else {
+			template.Subject.CommonName = template.IPAddresses[0].String()
+		}
+	}
+
+	var key crypto.Signer
+	var err error
+	switch request.KeyType {
+	case "", "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("Invalid key type %s", request.KeyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := pemBlockForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(configuredCertDir, 0700); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(csrKeyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Created certificate signing request for %s\n", template.Subject.CommonName)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes}), nil
+}
+
+// getCSRKey returns the PEM private key of the last certificate signing request
+func getCSRKey() ([]byte, error) {
+	keyPEM, err := ioutil.ReadFile(csrKeyPath)
+	if os.IsNotExist(err) {
+		return nil, errors.New("No private key was provided and there is no pending certificate signing request")
+	}
+	return keyPEM, err
+}
@@ -768,6 +768,21 @@ func GetSessions() (map[uint32]map[string]interface{}, error) {
 	return m, nil
 }
 
+// GetSession gets all of the entries for the argumented key in the sessions table as a map
+func GetSession(key uint32) (map[string]interface{}, error) {
+	entries, err := GetDictionary("sessions", key)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	for _, e := range entries {
+		m[e.Field] = e.Value
+	}
+
+	return m, nil
+}
+
 // periodic task to clean the address table
 func cleanupTask() {
 	cleanDictionary()
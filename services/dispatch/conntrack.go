@@ -277,9 +277,10 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			logger.Debug("Calling conntrack APP:%s PRIORITY:%d\n", key, priority)
 			wg.Add(1)
 			go func(val SubscriptionHolder) {
+				start := time.Now()
 				val.ConntrackFunc(int(eventType), conntrack)
+				val.histogram.ObserveDuration(time.Since(start))
 				wg.Done()
-				logger.Debug("Finished conntrack APP:%s PRIORITY:%d\n", val.Owner, val.Priority)
 			}(val)
 			subcount++
 		}
@@ -339,11 +340,13 @@ func removeConntrackStale(ctid uint32, conntrack *Conntrack) {
 	removeConntrack(ctid)
 	dict.DeleteSession(ctid)
 	kernel.RemoveBypassEntry(ctid)
+	removeBlockedSession(ctid)
 
 	// We only want to remove the specific session
 	// There is a race, we may get this DELETE event after the ctid has been reused by a new session
 	// and we don't want to remove that mapping from the session table
 	if conntrack != nil && conntrack.Session != nil {
+		PublishSessionEvent(SessionEventEnd, conntrack.Session, nil)
 		conntrack.Session.removeFromSessionTable()
 	}
 }
@@ -14,6 +14,7 @@ import (
 
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
 )
 
 // SubscriptionHolder stores the details of a data callback subscription
@@ -23,6 +24,7 @@ type SubscriptionHolder struct {
 	NfqueueFunc   NfqueueHandlerFunction
 	ConntrackFunc ConntrackHandlerFunction
 	NetloggerFunc NetloggerHandlerFunction
+	histogram     *overseer.Histogram
 }
 
 // maxSubscriberTime sets the maximum amount time a subscriber is allowed to process a packet
@@ -77,6 +79,9 @@ const RevDNSPriority = 2
 // SniPriority ...
 const SniPriority = 2
 
+// SignaturesPriority ... We want this to be called after the plugins that find the SNI, certificate, and DNS details
+const SignaturesPriority = 3
+
 // list of subscribers to each of the three data sources
 var nfqueueSubList map[string]SubscriptionHolder
 var conntrackSubList map[string]SubscriptionHolder
@@ -125,6 +130,9 @@ func Startup(ctInterval int) {
 
 	// start cleaner tasks to clean tables
 	go cleanerTask()
+
+	// start the task that delivers session events to the subscribers
+	go sessionEventTask()
 }
 
 // Shutdown stops the event handling service
@@ -171,6 +179,7 @@ func InsertNfqueueSubscription(owner string, priority int, function NfqueueHandl
 	holder.Owner = owner
 	holder.Priority = priority
 	holder.NfqueueFunc = function
+	holder.histogram = overseer.GetHistogram("nfqueue_subscriber_seconds", overseer.Labels{"subscriber": owner})
 	nfqueueSubMutex.Lock()
 	_, existing := nfqueueSubList[owner]
 	nfqueueSubList[owner] = holder
@@ -213,6 +222,7 @@ func InsertConntrackSubscription(owner string, priority int, function ConntrackH
 	holder.Owner = owner
 	holder.Priority = priority
 	holder.ConntrackFunc = function
+	holder.histogram = overseer.GetHistogram("conntrack_subscriber_seconds", overseer.Labels{"subscriber": owner})
 	conntrackSubMutex.Lock()
 	conntrackSubList[owner] = holder
 	conntrackSubMutex.Unlock()
@@ -226,6 +236,7 @@ func InsertNetloggerSubscription(owner string, priority int, function NetloggerH
 	holder.Owner = owner
 	holder.Priority = priority
 	holder.NetloggerFunc = function
+	holder.histogram = overseer.GetHistogram("netlogger_subscriber_seconds", overseer.Labels{"subscriber": owner})
 	netloggerSubMutex.Lock()
 	netloggerSubList[owner] = holder
 	netloggerSubMutex.Unlock()
@@ -271,6 +282,13 @@ func HandleWarehouseCleanup() {
 	}
 }
 
+// GetConntrackTableSize returns the number of entries in the conntrack table
+func GetConntrackTableSize() int {
+	conntrackTableMutex.RLock()
+	defer conntrackTableMutex.RUnlock()
+	return len(conntrackTable)
+}
+
 // GetConntrackTable table
 // Note: this returns a copy of the table, but with the same pointers
 // do not modify the values in the conntrack entries
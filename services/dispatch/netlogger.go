@@ -70,8 +70,9 @@ func netloggerCallback(version uint8,
 			wg.Add(1)
 			go func(val SubscriptionHolder, wg *sync.WaitGroup, key string, priority int) {
 				defer wg.Done()
+				start := time.Now()
 				val.NetloggerFunc(&netlogger)
-				logger.Debug("Finished netlogger APP:%s PRIORITY:%d\n", key, priority)
+				val.histogram.ObserveDuration(time.Since(start))
 			}(val, &wg, key, priority)
 			subcount++
 
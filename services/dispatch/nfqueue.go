@@ -5,8 +5,10 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
 )
 
 // NfDrop is NF_DROP constant
@@ -77,6 +79,11 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 	var mess NfqueueMessage
 	//printSessionTable()
 
+	// drop everything for sessions that have been blocked from the API
+	if isSessionBlocked(ctid) {
+		return NfDrop
+	}
+
 	mess.Family = int(family)
 	mess.Packet = packet
 	mess.PacketMark = pmark
@@ -287,7 +294,9 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 
 				// call the subscriber hook on another goroutine so we can timeout while waiting for the result
 				go func() {
+					start := time.Now()
 					result := val.NfqueueFunc(mess, ctid, newSession)
+					val.histogram.ObserveDuration(time.Since(start))
 					stat := timeoutTimer.Stop()
 					// if we stopped the timer then stat will be true and we need to write the subscriber result
 					// to the channel, otherwise don't bother since a release was written by the timeout handler
@@ -303,7 +312,8 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 					resultsChannel <- result
 				case <-timeoutTimer.C:
 					// the subscriber took too long so put a release in the result channel on behalf of the subscriber
-					logger.Crit("%OC|Timeout while processing nfqueue - subscriber:%s\n", "timeout_nfqueue_"+key, 0, key)
+					overseer.IncLabeledCounter("nfqueue_subscriber_timeouts", overseer.Labels{"subscriber": key})
+					logger.Crit("Timeout while processing nfqueue - subscriber:%s\n", key)
 					resultsChannel <- subscriberResult{owner: key, sessionRelease: true}
 				}
 			}(key, val, priority)
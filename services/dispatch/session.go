@@ -437,6 +437,13 @@ func insertSessionTable(ctid uint32, sess *Session) {
 	dict.AddSessionEntry(sess.GetConntrackID(), "session_id", sess.GetSessionID())
 }
 
+// GetSessionTableSize returns the number of entries in the session table
+func GetSessionTableSize() int {
+	sessionMutex.RLock()
+	defer sessionMutex.RUnlock()
+	return len(sessionTable)
+}
+
 // cleanSessionTable cleans the session table by removing stale entries
 func cleanSessionTable() {
 	sessionMutex.Lock()
@@ -453,7 +460,9 @@ func cleanSessionTable() {
 				logger.Err("%OC|Removing stale (%v) session [%v] %v\n", "stale_session_removed", 0, time.Now().Sub(session.GetLastActivity()), ctid, session.GetClientSideTuple())
 				dict.DeleteSession(ctid)
 				kernel.RemoveBypassEntry(ctid)
+				removeBlockedSession(ctid)
 				delete(sessionTable, ctid)
+				PublishSessionEvent(SessionEventEnd, session, nil)
 			}
 		} else {
 			// We remove unconfirmed sessions after 60 seconds to keep things lean and clean
@@ -464,7 +473,9 @@ func cleanSessionTable() {
 				overseer.AddCounter("unconfirmed_session_removed", 1)
 				dict.DeleteSession(ctid)
 				kernel.RemoveBypassEntry(ctid)
+				removeBlockedSession(ctid)
 				delete(sessionTable, ctid)
+				PublishSessionEvent(SessionEventEnd, session, nil)
 			}
 		}
 	}
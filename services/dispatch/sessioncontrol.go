@@ -0,0 +1,118 @@
+package dispatch
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// ErrSessionNotFound is returned when an action is requested for an unknown conntrack ID
+var ErrSessionNotFound = errors.New("Session not found")
+
+// sessionResetTimeout is how long in milliseconds a killed session stays in the reset set
+const sessionResetTimeout = 30000
+
+// sessionResetDelay is how long we wait for the endpoints to send a packet and receive
+// a reset before the conntrack entry for a killed session is destroyed
+const sessionResetDelay = 5 * time.Second
+
+var blockedTable = make(map[uint32]bool)
+var blockedMutex sync.RWMutex
+var blockedCount int32
+
+// findSessionTuple returns the session ID, family, and client side tuple for
+// the argumented conntrack ID from the conntrack or session table
+func findSessionTuple(ctid uint32) (int64, uint8, Tuple, bool) {
+	if conntrack, found := findConntrack(ctid); found {
+		conntrack.Guardian.RLock()
+		defer conntrack.Guardian.RUnlock()
+		return conntrack.SessionID, conntrack.Family, conntrack.ClientSideTuple, true
+	}
+
+	// the conntrack is not confirmed until the first packet has been queued
+	// so check the session table for new sessions
+	if session := findSession(ctid); session != nil {
+		return session.GetSessionID(), session.GetFamily(), session.GetClientSideTuple(), true
+	}
+
+	return 0, 0, Tuple{}, false
+}
+
+// KillSession destroys the conntrack entry for the argumented conntrack ID. If reset
+// is true and the session is TCP, the next packet from each endpoint is rejected with
+// a reset before the entry is destroyed so both sides close the connection.
+// Returns the session ID and client side tuple of the session.
+func KillSession(ctid uint32, reset bool) (int64, Tuple, error) {
+	sessionID, family, tuple, found := findSessionTuple(ctid)
+	if !found {
+		return 0, tuple, ErrSessionNotFound
+	}
+
+	// only TCP has resets so other protocols are destroyed immediately
+	if reset && tuple.Protocol == 6 {
+		kernel.ResetViaNftSet(ctid, sessionResetTimeout)
+		time.AfterFunc(sessionResetDelay, func() {
+			if err := kernel.DestroyConntrack(ctid, family, tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ClientPort, tuple.ServerPort); err != nil {
+				logger.Debug("Unable to destroy reset session %d: %v\n", ctid, err)
+			}
+		})
+		logger.Info("Reset session %d %v\n", ctid, tuple)
+		return sessionID, tuple, nil
+	}
+
+	if err := kernel.DestroyConntrack(ctid, family, tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ClientPort, tuple.ServerPort); err != nil {
+		return sessionID, tuple, err
+	}
+
+	logger.Info("Killed session %d %v\n", ctid, tuple)
+	return sessionID, tuple, nil
+}
+
+// BlockSession drops all future packets for the argumented conntrack ID. Packets still
+// being queued are dropped with the nfqueue verdict and all others are dropped using
+// the block_packetd nft set. Returns the session ID and client side tuple of the session.
+func BlockSession(ctid uint32) (int64, Tuple, error) {
+	sessionID, _, tuple, found := findSessionTuple(ctid)
+	if !found {
+		return 0, tuple, ErrSessionNotFound
+	}
+
+	blockedMutex.Lock()
+	blockedTable[ctid] = true
+	atomic.StoreInt32(&blockedCount, int32(len(blockedTable)))
+	blockedMutex.Unlock()
+
+	kernel.BlockViaNftSet(ctid)
+	logger.Info("Blocked session %d %v\n", ctid, tuple)
+	return sessionID, tuple, nil
+}
+
+// isSessionBlocked returns true if the argumented conntrack ID has been blocked
+func isSessionBlocked(ctid uint32) bool {
+	// most of the time nothing is blocked so skip the lock
+	if atomic.LoadInt32(&blockedCount) == 0 {
+		return false
+	}
+
+	blockedMutex.RLock()
+	defer blockedMutex.RUnlock()
+	return blockedTable[ctid]
+}
+
+// removeBlockedSession removes the block for the argumented conntrack ID when the conntrack is removed
+func removeBlockedSession(ctid uint32) {
+	if !isSessionBlocked(ctid) {
+		return
+	}
+
+	blockedMutex.Lock()
+	delete(blockedTable, ctid)
+	atomic.StoreInt32(&blockedCount, int32(len(blockedTable)))
+	blockedMutex.Unlock()
+
+	kernel.RemoveBlockEntry(ctid)
+}
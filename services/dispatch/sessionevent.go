@@ -0,0 +1,164 @@
+package dispatch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// SessionEventNew is the type of the event published when a session is created
+const SessionEventNew = "new"
+
+// SessionEventUpdate is the type of the event published when session details change
+const SessionEventUpdate = "update"
+
+// SessionEventEnd is the type of the event published when a session is removed
+const SessionEventEnd = "end"
+
+// SessionEvent describes a change to a session that is sent to the session event subscribers.
+// Changed holds the values that were added or changed and Session holds the current
+// values for the session including the changes.
+type SessionEvent struct {
+	Type        string                 `json:"type"`
+	Time        time.Time              `json:"time"`
+	SessionID   int64                  `json:"session_id"`
+	ConntrackID uint32                 `json:"conntrack_id"`
+	Changed     map[string]interface{} `json:"changed,omitempty"`
+	Session     map[string]interface{} `json:"session"`
+}
+
+// pendingSessionEvent holds a published event until it is processed by the sessionEventTask
+type pendingSessionEvent struct {
+	eventType string
+	time      time.Time
+	session   *Session
+	changed   map[string]interface{}
+}
+
+var sessionEventQueue = make(chan pendingSessionEvent, 1000)
+var sessionEventSubscribers = make(map[chan SessionEvent]bool)
+var sessionEventMutex sync.RWMutex
+var sessionEventCount int32
+
+// SubscribeSessionEvents returns a channel that receives session events, or nil if there
+// are already limit subscribers. Events are dropped if the channel is full so the
+// subscriber must read the channel promptly.
+func SubscribeSessionEvents(size int, limit int) chan SessionEvent {
+	sessionEventMutex.Lock()
+	defer sessionEventMutex.Unlock()
+
+	if len(sessionEventSubscribers) >= limit {
+		return nil
+	}
+
+	channel := make(chan SessionEvent, size)
+	sessionEventSubscribers[channel] = true
+	atomic.StoreInt32(&sessionEventCount, int32(len(sessionEventSubscribers)))
+	return channel
+}
+
+// UnsubscribeSessionEvents stops sending session events to the argumented channel
+func UnsubscribeSessionEvents(channel chan SessionEvent) {
+	sessionEventMutex.Lock()
+	delete(sessionEventSubscribers, channel)
+	atomic.StoreInt32(&sessionEventCount, int32(len(sessionEventSubscribers)))
+	sessionEventMutex.Unlock()
+}
+
+// GetSessionEventSubscriberCount returns the number of session event subscribers
+func GetSessionEventSubscriberCount() int {
+	return int(atomic.LoadInt32(&sessionEventCount))
+}
+
+// PublishSessionEvent is called to send a session event to the subscribers. The
+// event is built and delivered on another goroutine so it is safe to call while
+// holding the session attachments lock.
+func PublishSessionEvent(eventType string, session *Session, changed map[string]interface{}) {
+	if session == nil || atomic.LoadInt32(&sessionEventCount) == 0 {
+		return
+	}
+
+	// copy the changed values since the caller may continue to use the map
+	var changes map[string]interface{}
+	if len(changed) != 0 {
+		changes = make(map[string]interface{}, len(changed))
+		for key, value := range changed {
+			changes[key] = value
+		}
+	}
+
+	select {
+	case sessionEventQueue <- pendingSessionEvent{eventType: eventType, time: time.Now(), session: session, changed: changes}:
+	default:
+		// only log the first and every hundredth dropped event
+		if total := overseer.IncCounter("session_event_queue_full"); total == 1 || total%100 == 0 {
+			logger.Warn("Session event queue at capacity[%d]. Dropping event\n", cap(sessionEventQueue))
+		}
+	}
+}
+
+// sessionEventTask builds the events from the session event queue and sends them to the subscribers
+func sessionEventTask() {
+	for pending := range sessionEventQueue {
+		event := SessionEvent{
+			Type:        pending.eventType,
+			Time:        pending.time,
+			SessionID:   pending.session.GetSessionID(),
+			ConntrackID: pending.session.GetConntrackID(),
+			Changed:     pending.changed,
+			Session:     getSessionEventDetails(pending.session),
+		}
+		for key, value := range pending.changed {
+			event.Session[key] = value
+		}
+
+		sessionEventMutex.RLock()
+		for channel := range sessionEventSubscribers {
+			select {
+			case channel <- event:
+			default:
+				overseer.IncCounter("session_event_subscriber_overrun")
+			}
+		}
+		sessionEventMutex.RUnlock()
+	}
+}
+
+// getSessionEventDetails returns the session tuple and interface details merged with the session attachments
+func getSessionEventDetails(session *Session) map[string]interface{} {
+	details := make(map[string]interface{})
+
+	attachments := session.LockAttachments()
+	for key, value := range attachments {
+		details[key] = value
+	}
+	session.UnlockAttachments()
+
+	clientSideTuple := session.GetClientSideTuple()
+	details["session_id"] = session.GetSessionID()
+	details["conntrack_id"] = session.GetConntrackID()
+	details["family"] = session.GetFamily()
+	details["ip_protocol"] = clientSideTuple.Protocol
+	details["client_address"] = clientSideTuple.ClientAddress
+	details["client_port"] = clientSideTuple.ClientPort
+	details["server_address"] = clientSideTuple.ServerAddress
+	details["server_port"] = clientSideTuple.ServerPort
+	details["client_interface_id"] = session.GetClientInterfaceID()
+	details["client_interface_type"] = session.GetClientInterfaceType()
+
+	// the server side details are not known until the conntrack is confirmed
+	if session.GetConntrackConfirmed() {
+		serverSideTuple := session.GetServerSideTuple()
+		details["client_address_new"] = serverSideTuple.ClientAddress
+		details["client_port_new"] = serverSideTuple.ClientPort
+		details["server_address_new"] = serverSideTuple.ServerAddress
+		details["server_port_new"] = serverSideTuple.ServerPort
+		details["server_interface_id"] = session.GetServerInterfaceID()
+		details["server_interface_type"] = session.GetServerInterfaceType()
+	}
+
+	return details
+}
@@ -131,6 +131,7 @@ int conntrack_startup(void);
 void conntrack_shutdown(void);
 int conntrack_thread(void);
 void conntrack_dump(void);
+int conntrack_destroy(uint8_t family,uint8_t protocol,void *saddr,void *daddr,uint16_t sport,uint16_t dport,uint32_t ctid);
 int conntrack_update_mark(uint32_t ctid, uint32_t mask, uint32_t value);
 
 int nfq_get_ct_info(struct nfq_data *nfad, unsigned char **data);
@@ -156,3 +157,6 @@ struct timespec calculate_pause(struct timespec start,struct timespec end,int sp
 
 void bypass_via_nft_set(uint32_t ctid, uint64_t timeout);
 void remove_bypass_entry(uint32_t ctid);
+void block_via_nft_set(uint32_t ctid);
+void remove_block_entry(uint32_t ctid);
+void reset_via_nft_set(uint32_t ctid, uint64_t timeout);
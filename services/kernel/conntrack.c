@@ -218,3 +218,50 @@ void conntrack_dump(void)
 	ret = nfct_send(nfcth,NFCT_Q_DUMP,&family);
 	if (ret < 0) logmessage(LOG_WARNING,logsrc,"nfct_send() result:%d errno:%d\n",ret,errno);
 }
+
+int conntrack_destroy(uint8_t family,uint8_t protocol,void *saddr,void *daddr,uint16_t sport,uint16_t dport,uint32_t ctid)
+{
+	struct nfct_handle	*handle;
+	struct nf_conntrack	*ct;
+	int					ret;
+
+	ct = nfct_new();
+
+	if (ct == NULL) {
+		logmessage(LOG_ERR,logsrc,"Error %d returned from nfct_new()\n",errno);
+		return(-1);
+	}
+
+	// the kernel finds the entry using the original tuple and checks the id if we pass it
+	nfct_set_attr_u8(ct,ATTR_L3PROTO,family);
+	if (family == AF_INET) {
+		nfct_set_attr(ct,ATTR_IPV4_SRC,saddr);
+		nfct_set_attr(ct,ATTR_IPV4_DST,daddr);
+	} else {
+		nfct_set_attr(ct,ATTR_IPV6_SRC,saddr);
+		nfct_set_attr(ct,ATTR_IPV6_DST,daddr);
+	}
+
+	nfct_set_attr_u8(ct,ATTR_L4PROTO,protocol);
+	if (protocol == IPPROTO_TCP || protocol == IPPROTO_UDP) {
+		nfct_set_attr_u16(ct,ATTR_PORT_SRC,htobe16(sport));
+		nfct_set_attr_u16(ct,ATTR_PORT_DST,htobe16(dport));
+	}
+	nfct_set_attr_u32(ct,ATTR_ID,ctid);
+
+	// we use a separate handle since the event handle is busy in the conntrack thread
+	handle = nfct_open(CONNTRACK,0);
+
+	if (handle == NULL) {
+		logmessage(LOG_ERR,logsrc,"Error %d returned from nfct_open()\n",errno);
+		nfct_destroy(ct);
+		return(-1);
+	}
+
+	ret = nfct_query(handle,NFCT_Q_DESTROY,ct);
+	if (ret < 0) logmessage(LOG_WARNING,logsrc,"nfct_query(DESTROY) ctid:%u result:%d errno:%d\n",ctid,ret,errno);
+
+	nfct_close(handle);
+	nfct_destroy(ct);
+	return(ret);
+}
@@ -8,9 +8,12 @@ package kernel
 import "C"
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -473,3 +476,45 @@ func BypassViaNftSet(ctid uint32, timeout uint64) {
 func RemoveBypassEntry(ctid uint32) {
 	C.remove_bypass_entry(C.uint32_t(ctid))
 }
+
+// BlockViaNftSet adds the given ct id to the block_packetd set in the
+// packetd table so all future packets for the connection are dropped
+func BlockViaNftSet(ctid uint32) {
+	C.block_via_nft_set(C.uint32_t(ctid))
+}
+
+// RemoveBlockEntry removes the given ct id from the block_packetd set
+func RemoveBlockEntry(ctid uint32) {
+	C.remove_block_entry(C.uint32_t(ctid))
+}
+
+// ResetViaNftSet adds the given ct id to the reset_packetd set in the packetd
+// table so the next TCP packet in either direction is rejected with a reset.
+// The timeout parameter is in milliseconds.
+func ResetViaNftSet(ctid uint32, timeout uint64) {
+	C.reset_via_nft_set(C.uint32_t(ctid), C.uint64_t(timeout))
+}
+
+// DestroyConntrack removes the conntrack entry with the argumented id and original
+// direction tuple from the kernel conntrack table
+func DestroyConntrack(ctid uint32, family uint8, protocol uint8, clientAddress net.IP, serverAddress net.IP, clientPort uint16, serverPort uint16) error {
+	var saddr, daddr net.IP
+
+	if family == syscall.AF_INET {
+		saddr = clientAddress.To4()
+		daddr = serverAddress.To4()
+	} else {
+		saddr = clientAddress.To16()
+		daddr = serverAddress.To16()
+	}
+
+	if saddr == nil || daddr == nil {
+		return errors.New("Invalid conntrack address")
+	}
+
+	ret := C.conntrack_destroy(C.uint8_t(family), C.uint8_t(protocol), unsafe.Pointer(&saddr[0]), unsafe.Pointer(&daddr[0]), C.uint16_t(clientPort), C.uint16_t(serverPort), C.uint32_t(ctid))
+	if ret < 0 {
+		return fmt.Errorf("Unable to destroy conntrack %d", ctid)
+	}
+	return nil
+}
@@ -147,4 +147,19 @@ void remove_bypass_entry(uint32_t ctid)
 	del_set_elem("inet", "packetd", "bypass_packetd", ctid);
 }
 
+void block_via_nft_set(uint32_t ctid)
+{
+	add_set_elem("inet", "packetd", "block_packetd", ctid, 0);
+}
+
+void remove_block_entry(uint32_t ctid)
+{
+	del_set_elem("inet", "packetd", "block_packetd", ctid);
+}
+
+void reset_via_nft_set(uint32_t ctid, uint64_t timeout)
+{
+	add_set_elem("inet", "packetd", "reset_packetd", ctid, timeout);
+}
+
 
@@ -0,0 +1,459 @@
+package overseer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Typed metrics that complement the plain named counters. Each metric is
+	identified by a name and an optional set of labels, so dimensions like the
+	subscriber or interface no longer need to be encoded in the name. Like the
+	counters, the series are created the first time they are updated and the
+	table is only write locked when a new series is added.
+*/
+
+// Labels holds the label names and values that identify a metric series
+type Labels map[string]string
+
+// DefaultLatencyBuckets are the histogram bucket upper bounds in seconds used
+// for histograms that are observed without first being registered
+var DefaultLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// metricSeries holds the value of a single labeled counter or gauge
+type metricSeries struct {
+	name   string
+	labels Labels
+	value  uint64
+}
+
+// histogramSeries holds the bucket counts of a single labeled histogram
+type histogramSeries struct {
+	name   string
+	labels Labels
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+	locker sync.Mutex
+}
+
+var labeledCounterTable = make(map[string]*metricSeries)
+var gaugeTable = make(map[string]*metricSeries)
+var histogramTable = make(map[string]*histogramSeries)
+var histogramBuckets = make(map[string][]float64)
+var metricsMutex sync.RWMutex
+
+// CounterSample is the value of a counter at the time of a snapshot
+type CounterSample struct {
+	Name   string `json:"name"`
+	Labels Labels `json:"labels,omitempty"`
+	Value  int64  `json:"value"`
+}
+
+// GaugeSample is the value of a gauge at the time of a snapshot
+type GaugeSample struct {
+	Name   string  `json:"name"`
+	Labels Labels  `json:"labels,omitempty"`
+	Value  float64 `json:"value"`
+}
+
+// HistogramSample holds the state of a histogram at the time of a snapshot. The
+// Counts are cumulative and match the Bounds, the implicit +Inf bucket is Count.
+type HistogramSample struct {
+	Name   string    `json:"name"`
+	Labels Labels    `json:"labels,omitempty"`
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// Snapshot holds a copy of every counter, gauge and histogram
+type Snapshot struct {
+	Time       time.Time         `json:"time"`
+	Counters   []CounterSample   `json:"counters"`
+	Gauges     []GaugeSample     `json:"gauges"`
+	Histograms []HistogramSample `json:"histograms"`
+}
+
+// CounterRate is the change in a counter between two snapshots
+type CounterRate struct {
+	Name   string  `json:"name"`
+	Labels Labels  `json:"labels,omitempty"`
+	Delta  int64   `json:"delta"`
+	Rate   float64 `json:"rate"`
+}
+
+// SnapshotDelta holds the changes between two snapshots. Counters include the
+// per-second rate, histograms hold the observations made during the interval
+// and gauges are the values from the newer snapshot.
+type SnapshotDelta struct {
+	Seconds    float64           `json:"seconds"`
+	Counters   []CounterRate     `json:"counters"`
+	Gauges     []GaugeSample     `json:"gauges"`
+	Histograms []HistogramSample `json:"histograms"`
+}
+
+// seriesKey returns the unique key for a metric name and set of labels
+func seriesKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.WriteString(name)
+	key.WriteString("{")
+	for i, label := range names {
+		if i != 0 {
+			key.WriteString(",")
+		}
+		key.WriteString(label)
+		key.WriteString("=")
+		key.WriteString(fmt.Sprintf("%q", labels[label]))
+	}
+	key.WriteString("}")
+	return key.String()
+}
+
+// copyLabels returns a copy of the argumented labels so callers can reuse their map
+func copyLabels(labels Labels) Labels {
+	if len(labels) == 0 {
+		return nil
+	}
+	result := make(Labels, len(labels))
+	for label, value := range labels {
+		result[label] = value
+	}
+	return result
+}
+
+// findSeries returns the series for the name and labels from the argumented table, creating it if needed
+func findSeries(table map[string]*metricSeries, name string, labels Labels) *metricSeries {
+	key := seriesKey(name, labels)
+
+	metricsMutex.RLock()
+	series, found := table[key]
+	metricsMutex.RUnlock()
+
+	if found {
+		return series
+	}
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	// check again since another goroutine may have created it while we were unlocked
+	if series, found = table[key]; !found {
+		series = &metricSeries{name: name, labels: copyLabels(labels)}
+		table[key] = series
+	}
+	return series
+}
+
+// AddLabeledCounter is called to add the argumented value to a labeled counter
+func AddLabeledCounter(name string, labels Labels, amount int64) int64 {
+	series := findSeries(labeledCounterTable, name, labels)
+	return int64(atomic.AddUint64(&series.value, uint64(amount)))
+}
+
+// IncLabeledCounter is called to increment a labeled counter
+func IncLabeledCounter(name string, labels Labels) int64 {
+	return AddLabeledCounter(name, labels, 1)
+}
+
+// SetGauge is called to set the value of a gauge
+func SetGauge(name string, labels Labels, value float64) {
+	series := findSeries(gaugeTable, name, labels)
+	atomic.StoreUint64(&series.value, math.Float64bits(value))
+}
+
+// AddGauge is called to add the argumented value to a gauge and returns the new value
+func AddGauge(name string, labels Labels, amount float64) float64 {
+	series := findSeries(gaugeTable, name, labels)
+
+	for {
+		old := atomic.LoadUint64(&series.value)
+		value := math.Float64frombits(old) + amount
+		if atomic.CompareAndSwapUint64(&series.value, old, math.Float64bits(value)) {
+			return value
+		}
+	}
+}
+
+// GetGauge is called to get the value of a gauge
+func GetGauge(name string, labels Labels) float64 {
+	metricsMutex.RLock()
+	series, found := gaugeTable[seriesKey(name, labels)]
+	metricsMutex.RUnlock()
+
+	if found {
+		return math.Float64frombits(atomic.LoadUint64(&series.value))
+	}
+	return 0
+}
+
+// RegisterHistogram is called to set the bucket upper bounds for a named histogram.
+// It must be called before the first observation to take effect. Histograms that
+// are not registered use the DefaultLatencyBuckets.
+func RegisterHistogram(name string, buckets []float64) {
+	bounds := make([]float64, len(buckets))
+	copy(bounds, buckets)
+	sort.Float64s(bounds)
+
+	metricsMutex.Lock()
+	histogramBuckets[name] = bounds
+	metricsMutex.Unlock()
+}
+
+// findHistogram returns the histogram for the name and labels, creating it if needed
+func findHistogram(name string, labels Labels) *histogramSeries {
+	key := seriesKey(name, labels)
+
+	metricsMutex.RLock()
+	series, found := histogramTable[key]
+	metricsMutex.RUnlock()
+
+	if found {
+		return series
+	}
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	if series, found = histogramTable[key]; !found {
+		bounds, registered := histogramBuckets[name]
+		if !registered {
+			bounds = DefaultLatencyBuckets
+		}
+		series = &histogramSeries{name: name, labels: copyLabels(labels), bounds: bounds, counts: make([]uint64, len(bounds))}
+		histogramTable[key] = series
+	}
+	return series
+}
+
+// ObserveHistogram is called to add a value to a histogram
+func ObserveHistogram(name string, labels Labels, value float64) {
+	findHistogram(name, labels).observe(value)
+}
+
+// ObserveDuration is called to add a duration in seconds to a histogram
+func ObserveDuration(name string, labels Labels, duration time.Duration) {
+	ObserveHistogram(name, labels, duration.Seconds())
+}
+
+// Histogram is a handle for a single histogram series. It is used on hot paths
+// where the series is known in advance, so each observation does not have to
+// build the labels and find the series.
+type Histogram struct {
+	series *histogramSeries
+}
+
+// GetHistogram returns the handle for the histogram with the name and labels, creating it if needed
+func GetHistogram(name string, labels Labels) *Histogram {
+	return &Histogram{series: findHistogram(name, labels)}
+}
+
+// Observe is called to add a value to the histogram
+func (h *Histogram) Observe(value float64) {
+	h.series.observe(value)
+}
+
+// ObserveDuration is called to add a duration in seconds to the histogram
+func (h *Histogram) ObserveDuration(duration time.Duration) {
+	h.series.observe(duration.Seconds())
+}
+
+// observe adds a value to the histogram series
+func (h *histogramSeries) observe(value float64) {
+	index := sort.SearchFloat64s(h.bounds, value)
+
+	h.locker.Lock()
+	if index < len(h.counts) {
+		h.counts[index]++
+	}
+	h.sum += value
+	h.count++
+	h.locker.Unlock()
+}
+
+// sample returns a copy of the histogram with cumulative bucket counts
+func (h *histogramSeries) sample() HistogramSample {
+	result := HistogramSample{Name: h.name, Labels: copyLabels(h.labels), Bounds: h.bounds, Counts: make([]uint64, len(h.counts))}
+
+	h.locker.Lock()
+	var total uint64
+	for i, count := range h.counts {
+		total += count
+		result.Counts[i] = total
+	}
+	result.Sum = h.sum
+	result.Count = h.count
+	h.locker.Unlock()
+
+	return result
+}
+
+// GetSnapshot is called to get a copy of every counter, gauge and histogram.
+// The plain named counters are included as counters without labels.
+func GetSnapshot() *Snapshot {
+	snapshot := &Snapshot{Time: time.Now()}
+
+	for name, value := range GetCounters() {
+		snapshot.Counters = append(snapshot.Counters, CounterSample{Name: name, Value: value})
+	}
+
+	metricsMutex.RLock()
+	for _, series := range labeledCounterTable {
+		snapshot.Counters = append(snapshot.Counters, CounterSample{Name: series.name, Labels: copyLabels(series.labels), Value: int64(atomic.LoadUint64(&series.value))})
+	}
+	for _, series := range gaugeTable {
+		snapshot.Gauges = append(snapshot.Gauges, GaugeSample{Name: series.name, Labels: copyLabels(series.labels), Value: math.Float64frombits(atomic.LoadUint64(&series.value))})
+	}
+	for _, series := range histogramTable {
+		snapshot.Histograms = append(snapshot.Histograms, series.sample())
+	}
+	metricsMutex.RUnlock()
+
+	sort.Slice(snapshot.Counters, func(i, j int) bool {
+		return seriesKey(snapshot.Counters[i].Name, snapshot.Counters[i].Labels) < seriesKey(snapshot.Counters[j].Name, snapshot.Counters[j].Labels)
+	})
+	sort.Slice(snapshot.Gauges, func(i, j int) bool {
+		return seriesKey(snapshot.Gauges[i].Name, snapshot.Gauges[i].Labels) < seriesKey(snapshot.Gauges[j].Name, snapshot.Gauges[j].Labels)
+	})
+	sort.Slice(snapshot.Histograms, func(i, j int) bool {
+		return seriesKey(snapshot.Histograms[i].Name, snapshot.Histograms[i].Labels) < seriesKey(snapshot.Histograms[j].Name, snapshot.Histograms[j].Labels)
+	})
+
+	return snapshot
+}
+
+// Delta is called to compute the changes since the argumented earlier snapshot.
+// Series that did not exist in the earlier snapshot are treated as starting from
+// zero and a counter that went backwards is treated as having been reset.
+func (s *Snapshot) Delta(prev *Snapshot) *SnapshotDelta {
+	delta := &SnapshotDelta{Seconds: s.Time.Sub(prev.Time).Seconds(), Gauges: s.Gauges}
+
+	counters := make(map[string]int64, len(prev.Counters))
+	for _, item := range prev.Counters {
+		counters[seriesKey(item.Name, item.Labels)] = item.Value
+	}
+
+	for _, item := range s.Counters {
+		change := item.Value - counters[seriesKey(item.Name, item.Labels)]
+		if change < 0 {
+			change = item.Value
+		}
+		rate := CounterRate{Name: item.Name, Labels: item.Labels, Delta: change}
+		if delta.Seconds > 0 {
+			rate.Rate = float64(change) / delta.Seconds
+		}
+		delta.Counters = append(delta.Counters, rate)
+	}
+
+	histograms := make(map[string]HistogramSample, len(prev.Histograms))
+	for _, item := range prev.Histograms {
+		histograms[seriesKey(item.Name, item.Labels)] = item
+	}
+
+	for _, item := range s.Histograms {
+		old, found := histograms[seriesKey(item.Name, item.Labels)]
+		if !found || old.Count > item.Count || len(old.Counts) != len(item.Counts) {
+			delta.Histograms = append(delta.Histograms, item)
+			continue
+		}
+
+		change := HistogramSample{Name: item.Name, Labels: item.Labels, Bounds: item.Bounds, Counts: make([]uint64, len(item.Counts))}
+		for i := range item.Counts {
+			change.Counts[i] = item.Counts[i] - old.Counts[i]
+		}
+		change.Sum = item.Sum - old.Sum
+		change.Count = item.Count - old.Count
+		delta.Histograms = append(delta.Histograms, change)
+	}
+
+	return delta
+}
+
+// GenerateJSONReport is called to write a snapshot of all metrics as JSON
+func GenerateJSONReport(buffer *bytes.Buffer) error {
+	return json.NewEncoder(buffer).Encode(GetSnapshot())
+}
+
+// generateMetricsReport is called to add the labeled counters, gauges and histograms to the HTML report
+func generateMetricsReport(buffer *bytes.Buffer) {
+	snapshot := GetSnapshot()
+
+	buffer.WriteString("<BR><BR>\r\n")
+	buffer.WriteString("<TABLE BORDER=2 CELLPADDING=4 BGCOLOR=#EEEEEE>\r\n")
+	buffer.WriteString("<TR><TH COLSPAN=2>Overseer Labeled Counters and Gauges</TH></TR>\r\n")
+	buffer.WriteString("<TR><TD><B>Metric</B></TD><TD><B>Value</B></TD></TR>\r\n")
+
+	for _, item := range snapshot.Counters {
+		if len(item.Labels) == 0 {
+			continue
+		}
+		writeReportRow(buffer, seriesKey(item.Name, item.Labels), fmt.Sprintf("%v", item.Value))
+	}
+	for _, item := range snapshot.Gauges {
+		writeReportRow(buffer, seriesKey(item.Name, item.Labels), fmt.Sprintf("%v", item.Value))
+	}
+
+	buffer.WriteString("</TABLE>\r\n")
+
+	buffer.WriteString("<BR><BR>\r\n")
+	buffer.WriteString("<TABLE BORDER=2 CELLPADDING=4 BGCOLOR=#EEEEEE>\r\n")
+	buffer.WriteString("<TR><TH COLSPAN=4>Overseer Histograms</TH></TR>\r\n")
+	buffer.WriteString("<TR><TD><B>Histogram</B></TD><TD><B>Count</B></TD><TD><B>Average</B></TD><TD><B>Buckets</B></TD></TR>\r\n")
+
+	for _, item := range snapshot.Histograms {
+		var average float64
+		if item.Count != 0 {
+			average = item.Sum / float64(item.Count)
+		}
+		buckets := make([]string, 0, len(item.Bounds)+1)
+		for i, bound := range item.Bounds {
+			buckets = append(buckets, fmt.Sprintf("&le;%v:%v", bound, item.Counts[i]))
+		}
+		buckets = append(buckets, fmt.Sprintf("+Inf:%v", item.Count))
+
+		buffer.WriteString("<TR><TD><TT>")
+		buffer.WriteString(htmlEscape(seriesKey(item.Name, item.Labels)))
+		buffer.WriteString("</TT></TD><TD><TT>")
+		buffer.WriteString(fmt.Sprintf("%v", item.Count))
+		buffer.WriteString("</TT></TD><TD><TT>")
+		buffer.WriteString(fmt.Sprintf("%.6f", average))
+		buffer.WriteString("</TT></TD><TD><TT>")
+		buffer.WriteString(strings.Join(buckets, " "))
+		buffer.WriteString("</TT></TD></TR>\n\n")
+	}
+
+	buffer.WriteString("</TABLE>\r\n")
+}
+
+// writeReportRow is called to add a name and value row to an HTML report table
+func writeReportRow(buffer *bytes.Buffer, name string, value string) {
+	buffer.WriteString("<TR><TD><TT>")
+	buffer.WriteString(htmlEscape(name))
+	buffer.WriteString("</TT></TD><TD><TT>")
+	buffer.WriteString(value)
+	buffer.WriteString("</TT></TD></TR>\n\n")
+}
+
+// htmlEscape is called to escape the label values that are shown in the HTML report
+func htmlEscape(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;").Replace(value)
+}
@@ -104,8 +104,27 @@ func GetCounter(name string) int64 {
 	return 0
 }
 
+// GetCounters is called to get a copy of all named counters and their current values
+func GetCounters() map[string]int64 {
+	counterMutex.RLock()
+	defer counterMutex.RUnlock()
+
+	result := make(map[string]int64, len(counterTable))
+	for name, ptr := range counterTable {
+		result[name] = atomic.LoadInt64(ptr)
+	}
+	return result
+}
+
 // GenerateReport is called to create a dynamic HTTP page that shows all named counters
+// followed by the labeled counters, gauges and histograms
 func GenerateReport(buffer *bytes.Buffer) {
+	generateCounterReport(buffer)
+	generateMetricsReport(buffer)
+}
+
+// generateCounterReport is called to add the named counters to the HTML report
+func generateCounterReport(buffer *bytes.Buffer) {
 	counterMutex.RLock()
 	defer counterMutex.RUnlock()
 
@@ -0,0 +1,112 @@
+package reports
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// percentileAggregator implements the percentile(value, p) SQLite aggregate
+// function. It collects every non-null value in the group and returns the p-th
+// percentile (0-100) using linear interpolation between the closest ranks.
+type percentileAggregator struct {
+	values     []float64
+	percentile float64
+}
+
+// newPercentileAggregator creates a percentileAggregator for a new group
+func newPercentileAggregator() *percentileAggregator {
+	return &percentileAggregator{}
+}
+
+// Step adds a single value to the aggregate
+func (a *percentileAggregator) Step(value interface{}, percentile interface{}) error {
+	pval, ok := aggregateValue(percentile)
+	if !ok || pval < 0 || pval > 100 {
+		return fmt.Errorf("percentile must be between 0 and 100: %v", percentile)
+	}
+	a.percentile = pval
+
+	if val, ok := aggregateValue(value); ok {
+		a.values = append(a.values, val)
+	}
+	return nil
+}
+
+// Done returns the percentile of the collected values or 0 if there were none
+func (a *percentileAggregator) Done() float64 {
+	return percentileOf(a.values, a.percentile)
+}
+
+// medianAggregator implements the median(value) SQLite aggregate function
+type medianAggregator struct {
+	values []float64
+}
+
+// newMedianAggregator creates a medianAggregator for a new group
+func newMedianAggregator() *medianAggregator {
+	return &medianAggregator{}
+}
+
+// Step adds a single value to the aggregate
+func (a *medianAggregator) Step(value interface{}) {
+	if val, ok := aggregateValue(value); ok {
+		a.values = append(a.values, val)
+	}
+}
+
+// Done returns the median of the collected values or 0 if there were none
+func (a *medianAggregator) Done() float64 {
+	return percentileOf(a.values, 50)
+}
+
+// registerAggregates registers the custom aggregate functions on a database connection
+func registerAggregates(conn *sqlite3.SQLiteConn) error {
+	if err := conn.RegisterAggregator("percentile", newPercentileAggregator, true); err != nil {
+		return err
+	}
+	if err := conn.RegisterAggregator("median", newMedianAggregator, true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// aggregateValue converts a value passed to an aggregate function to a float64.
+// NULL and non-numeric values are ignored the same as the built-in aggregates.
+func aggregateValue(value interface{}) (float64, bool) {
+	switch val := value.(type) {
+	case int64:
+		return float64(val), true
+	case float64:
+		if math.IsNaN(val) {
+			return 0, false
+		}
+		return val, true
+	case string:
+		num, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return 0, false
+		}
+		return num, true
+	}
+	return 0, false
+}
+
+// percentileOf returns the p-th percentile of the values, sorting them in place
+func percentileOf(values []float64, percentile float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sort.Float64s(values)
+	rank := percentile / 100 * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return values[lower]
+	}
+	return values[lower] + (values[upper]-values[lower])*(rank-float64(lower))
+}
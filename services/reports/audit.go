@@ -0,0 +1,102 @@
+package reports
+
+import (
+	"errors"
+	"time"
+)
+
+// AuditRecord is a settings change recorded in the audit table
+type AuditRecord struct {
+	TimeStamp     int64  `json:"time_stamp"`
+	Username      string `json:"username"`
+	ClientAddress string `json:"client_address"`
+	Action        string `json:"action"`
+	Path          string `json:"path"`
+	Status        string `json:"status"`
+	Diff          string `json:"diff"`
+	Error         string `json:"error"`
+}
+
+// LogAuditRecord logs the argumented record to the audit table
+func LogAuditRecord(record AuditRecord) error {
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"username":       record.Username,
+		"client_address": record.ClientAddress,
+		"action":         record.Action,
+		"path":           record.Path,
+		"status":         record.Status,
+		"diff":           record.Diff,
+		"error":          record.Error,
+	}
+	return LogEvent(CreateEvent("settings_"+record.Action, "audit", 1, columns, nil))
+}
+
+// GetAuditRecords returns the audit records between the start and end times, newest
+// first. Records are limited to the argumented username and path prefix if not empty.
+func GetAuditRecords(start time.Time, end time.Time, username string, path string, limit int) ([]AuditRecord, error) {
+	if dbMain == nil {
+		return nil, errors.New("Reports database is not open")
+	}
+
+	sqlStr := `SELECT time_stamp, username, client_address, action, path, status, diff, error FROM audit
+		WHERE time_stamp >= ? AND time_stamp <= ?`
+	values := []interface{}{start.UnixNano() / 1e6, end.UnixNano() / 1e6}
+
+	if username != "" {
+		sqlStr += " AND username = ?"
+		values = append(values, username)
+	}
+	if path != "" {
+		sqlStr += " AND path LIKE ? ESCAPE '\\'"
+		values = append(values, escapeLike(path)+"%")
+	}
+
+	sqlStr += " ORDER BY time_stamp DESC LIMIT ?"
+	values = append(values, limit)
+
+	rows, err := dbMain.Query(sqlStr, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []AuditRecord{}
+	for rows.Next() {
+		var record AuditRecord
+		var username, address, action, path, status, diff, message *string
+		if err = rows.Scan(&record.TimeStamp, &username, &address, &action, &path, &status, &diff, &message); err != nil {
+			return nil, err
+		}
+		record.Username = stringValue(username)
+		record.ClientAddress = stringValue(address)
+		record.Action = stringValue(action)
+		record.Path = stringValue(path)
+		record.Status = stringValue(status)
+		record.Diff = stringValue(diff)
+		record.Error = stringValue(message)
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in the argumented string
+func escapeLike(value string) string {
+	var escaped []rune
+	for _, r := range value {
+		if r == '%' || r == '_' || r == '\\' {
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, r)
+	}
+	return string(escaped)
+}
+
+// stringValue returns the string or an empty string for NULL columns
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
@@ -0,0 +1,339 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// snapshotPrefix and snapshotSuffix are used to name and find the snapshot files
+const snapshotPrefix = "reports-"
+const snapshotSuffix = ".db"
+
+// snapshotTimeFormat is the timestamp format used in the snapshot file names
+const snapshotTimeFormat = "20060102-150405"
+
+// backupStepPages is the number of database pages copied in each backup step
+const backupStepPages = 1024
+
+// backupStepDelay is the pause between backup steps that lets other connections write
+const backupStepDelay = 20 * time.Millisecond
+
+// sqliteHeader is the magic string at the start of every SQLite database file
+const sqliteHeader = "SQLite format 3\x00"
+
+// BackupSettings holds the reports database backup configuration
+// that is read from the reports/backup settings
+type BackupSettings struct {
+	Enabled         bool   `json:"enabled"`
+	Path            string `json:"path"`
+	IntervalMinutes int    `json:"intervalMinutes"`
+	Retain          int    `json:"retain"`
+	RestoreOnBoot   bool   `json:"restoreOnBoot"`
+}
+
+// backupLock serializes snapshots so the scheduled backup and downloads
+// do not compete for the database
+var backupLock sync.Mutex
+
+// GetBackupSettings returns the backup settings with defaults applied
+// for any values that are missing from the settings file
+func GetBackupSettings() BackupSettings {
+	config := BackupSettings{
+		Enabled:         false,
+		Path:            "/etc/packetd/reports",
+		IntervalMinutes: 60,
+		Retain:          3,
+		RestoreOnBoot:   false,
+	}
+
+	value, err := settings.GetSettings([]string{"reports", "backup"})
+	if err != nil {
+		logger.Debug("Using default backup settings: %v\n", err)
+		return config
+	}
+
+	raw, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(raw, &config)
+	}
+	if err != nil {
+		logger.Warn("Invalid backup settings: %v\n", err)
+	}
+
+	if config.IntervalMinutes < 1 {
+		config.IntervalMinutes = 1
+	}
+	if config.Retain < 1 {
+		config.Retain = 1
+	}
+	return config
+}
+
+// WriteSnapshot uses the SQLite online backup API to write a consistent copy
+// of the reports database to the argumented file while other connections
+// continue to read and write the database.
+func WriteSnapshot(ctx context.Context, filename string) error {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+
+	if dbMain == nil {
+		return errors.New("The reports database is not open")
+	}
+
+	// the snapshot is written to a temporary file and renamed when complete
+	// so an interrupted backup never replaces a good snapshot
+	tempname := filename + ".tmp"
+	os.Remove(tempname)
+
+	dest, err := (&sqlite3.SQLiteDriver{}).Open(tempname)
+	if err != nil {
+		return err
+	}
+	destConn := dest.(*sqlite3.SQLiteConn)
+
+	conn, err := dbMain.Conn(ctx)
+	if err != nil {
+		destConn.Close()
+		os.Remove(tempname)
+		return err
+	}
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		srcConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("Unexpected database connection type %T", driverConn)
+		}
+		return runBackup(ctx, destConn, srcConn)
+	})
+
+	conn.Close()
+	destConn.Close()
+
+	if err != nil {
+		os.Remove(tempname)
+		return err
+	}
+
+	return os.Rename(tempname, filename)
+}
+
+// runBackup copies every page from the source to the destination database. The pages
+// are copied a few at a time with a pause between steps, since the source is locked
+// during each step and the event logger must be able to write in between.
+func runBackup(ctx context.Context, destConn *sqlite3.SQLiteConn, srcConn *sqlite3.SQLiteConn) error {
+	backup, err := destConn.Backup("main", srcConn, "main")
+	if err != nil {
+		return err
+	}
+
+	pages := backupStepPages
+	remaining := -1
+	restarts := 0
+
+	for {
+		done, err := backup.Step(pages)
+		if err != nil {
+			backup.Close()
+			return err
+		}
+		if done {
+			break
+		}
+
+		// a write from another connection between steps restarts the backup from the
+		// beginning, so the step size is doubled after each restart to make sure a
+		// backup of a busy database still finishes
+		if remaining >= 0 && backup.Remaining() > remaining && pages > 0 {
+			restarts++
+			pages *= 2
+			if pages >= backup.PageCount() {
+				pages = -1
+			}
+		}
+		remaining = backup.Remaining()
+
+		// the step also returns not done when the database is busy or locked
+		select {
+		case <-ctx.Done():
+			backup.Close()
+			return ctx.Err()
+		case <-time.After(backupStepDelay):
+		}
+	}
+
+	if restarts > 0 {
+		logger.Info("Reports snapshot was restarted %d times by database writes\n", restarts)
+	}
+	return backup.Close()
+}
+
+// CreateSnapshot writes a new snapshot to the backup path and removes the
+// oldest snapshots beyond the number to retain. Returns the snapshot filename.
+func CreateSnapshot(ctx context.Context, config BackupSettings) (string, error) {
+	filename, err := writeBackupSnapshot(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	return filename, removeOldSnapshots(config)
+}
+
+// OpenSnapshot writes a new snapshot to the backup path for download and returns it
+// open for reading. The file is opened before old snapshots are removed so it can be
+// streamed from the backup path without making a copy. The caller must close the file.
+func OpenSnapshot(ctx context.Context) (*os.File, error) {
+	config := GetBackupSettings()
+
+	filename, err := writeBackupSnapshot(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = removeOldSnapshots(config); err != nil {
+		logger.Warn("Unable to remove old reports snapshots: %v\n", err)
+	}
+	return file, nil
+}
+
+// writeBackupSnapshot writes a new snapshot to the backup path and returns the filename
+func writeBackupSnapshot(ctx context.Context, config BackupSettings) (string, error) {
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(config.Path, snapshotPrefix+time.Now().Format(snapshotTimeFormat)+snapshotSuffix)
+	start := time.Now()
+
+	if err := WriteSnapshot(ctx, filename); err != nil {
+		overseer.IncCounter("reports_backup_failed")
+		return "", err
+	}
+
+	overseer.IncCounter("reports_backup_success")
+	overseer.ObserveDuration("reports_backup_seconds", nil, time.Since(start))
+	logger.Info("Created reports snapshot %s in %v\n", filename, time.Since(start).Round(time.Millisecond))
+	return filename, nil
+}
+
+// removeOldSnapshots removes the oldest snapshots beyond the number to retain
+func removeOldSnapshots(config BackupSettings) error {
+	snapshots, err := listSnapshots(config.Path)
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > config.Retain {
+		logger.Info("Removing old reports snapshot %s\n", snapshots[0])
+		os.Remove(snapshots[0])
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// listSnapshots returns the snapshot files in the argumented path sorted from oldest to newest
+func listSnapshots(path string) ([]string, error) {
+	snapshots, err := filepath.Glob(filepath.Join(path, snapshotPrefix+"*"+snapshotSuffix))
+	if err != nil {
+		return nil, err
+	}
+	// the timestamp format sorts in chronological order
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+// restoreSnapshot copies the newest valid snapshot in the backup path to the
+// argumented database file. It is called at startup before the database is
+// opened and only if the database file does not already exist.
+func restoreSnapshot(config BackupSettings, dbFilename string) error {
+	if _, err := os.Stat(dbFilename); err == nil {
+		logger.Info("Reports database %s exists, skipping restore\n", dbFilename)
+		return nil
+	}
+
+	snapshots, err := listSnapshots(config.Path)
+	if err != nil {
+		return err
+	}
+
+	// try the newest snapshot first and fall back to older ones
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if err = copySnapshot(snapshots[i], dbFilename); err != nil {
+			logger.Warn("Unable to restore reports snapshot %s: %v\n", snapshots[i], err)
+			continue
+		}
+		logger.Info("Restored reports database from %s\n", snapshots[i])
+		return nil
+	}
+
+	logger.Info("No reports snapshot found in %s\n", config.Path)
+	return nil
+}
+
+// copySnapshot verifies the argumented snapshot is a SQLite database and copies it to the target
+func copySnapshot(snapshot string, target string) error {
+	src, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err = io.ReadFull(src, header); err != nil || string(header) != sqliteHeader {
+		return errors.New("not a SQLite database")
+	}
+	if _, err = src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dst, err := ioutil.TempFile(filepath.Dir(target), filepath.Base(target)+".restore")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+
+	return os.Rename(dst.Name(), target)
+}
+
+// backupTask periodically writes a snapshot of the database when backups are
+// enabled. The settings are read on every pass so changes take effect without
+// a restart.
+func backupTask() {
+	for {
+		config := GetBackupSettings()
+		time.Sleep(time.Duration(config.IntervalMinutes) * time.Minute)
+
+		config = GetBackupSettings()
+		if !config.Enabled {
+			continue
+		}
+
+		if _, err := CreateSnapshot(context.Background(), config); err != nil {
+			logger.Warn("Failed to create reports snapshot: %v\n", err)
+		}
+	}
+}
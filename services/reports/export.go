@@ -0,0 +1,133 @@
+package reports
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// exportFlushInterval is the number of rows written between flushes of the output
+const exportFlushInterval = 500
+
+// ExportFormats maps the supported export formats to their content type
+var ExportFormats = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+// ExportQuery runs the query for the argumented ReportEntry and streams every
+// row to the writer in the requested format. Rows are written as they are read
+// from the database so memory use does not depend on the size of the result.
+// The writer is flushed periodically if it implements http.Flusher. The export
+// is cancelled if the argumented context is done or the export deadline passes.
+func ExportQuery(ctx context.Context, reportEntryStr string, format string, writer io.Writer) error {
+	format = strings.ToLower(format)
+	if _, ok := ExportFormats[format]; !ok {
+		return errors.New("Unsupported export format: " + format)
+	}
+
+	// exports count against the open query limit the same as paged queries
+	if !acquireQuerySlot() {
+		return ErrTooManyQueries
+	}
+	defer releaseQuerySlot()
+
+	ctx, cancel := context.WithTimeout(ctx, exportDeadline)
+	defer cancel()
+
+	rows, err := runReportQuery(ctx, reportEntryStr)
+	if err != nil {
+		return err
+	}
+
+	// rows is valid so make sure it gets closed
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	var rowWriter func([]interface{}) error
+	var csvWriter *csv.Writer
+
+	switch format {
+	case "csv":
+		csvWriter = csv.NewWriter(writer)
+		if err = csvWriter.Write(columns); err != nil {
+			return err
+		}
+		record := make([]string, len(columns))
+		rowWriter = func(values []interface{}) error {
+			for i, val := range values {
+				record[i] = csvValue(val)
+			}
+			return csvWriter.Write(record)
+		}
+	case "ndjson":
+		encoder := json.NewEncoder(writer)
+		entry := make(map[string]interface{}, len(columns))
+		rowWriter = func(values []interface{}) error {
+			for i, col := range columns {
+				entry[col] = values[i]
+			}
+			return encoder.Encode(entry)
+		}
+	}
+
+	flush := func() error {
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	var count int
+
+	for rows.Next() {
+		if err = scanRow(rows, values, valuePtrs); err != nil {
+			logger.Warn("Failed to scan export row: %v\n", err)
+			return err
+		}
+		if err = rowWriter(values); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushInterval == 0 {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Warn("Export query failed after %d rows: %v\n", count, err)
+		return err
+	}
+
+	logger.Debug("Exported %d rows as %s\n", count, format)
+	return flush()
+}
+
+// csvValue returns the string representation of a database value for CSV output
+func csvValue(val interface{}) string {
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", val)
+}
@@ -0,0 +1,130 @@
+package reports
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// reportLibraryPath is the directory holding the built-in report definitions.
+// Each .json file may contain a single ReportEntry or an array of them.
+const reportLibraryPath = "/usr/share/packetd/reports"
+
+// reportLibrary holds the validated report definitions indexed by UniqueID
+var reportLibrary = make(map[string]*ReportEntry)
+var reportLibraryLock sync.RWMutex
+
+// LoadReportLibrary loads and validates all of the report definitions in the
+// library directory. Definitions that fail validation are logged and skipped.
+// The previous library is replaced only after all files have been processed.
+func LoadReportLibrary() error {
+	files, err := filepath.Glob(filepath.Join(reportLibraryPath, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	library := make(map[string]*ReportEntry)
+	var rejected int
+
+	for _, filename := range files {
+		entries, err := readReportLibraryFile(filename)
+		if err != nil {
+			logger.Warn("Unable to load report library file %s: %v\n", filename, err)
+			rejected++
+			continue
+		}
+
+		for i, entry := range entries {
+			if entry.UniqueID == "" {
+				logger.Warn("Report library %s entry %d: uniqueId: is required\n", filename, i)
+				rejected++
+				continue
+			}
+			if _, found := library[entry.UniqueID]; found {
+				logger.Warn("Report library %s entry %d: uniqueId: duplicate id %q\n", filename, i, entry.UniqueID)
+				rejected++
+				continue
+			}
+			if err = ValidateReportEntry(entry); err != nil {
+				logger.Warn("Report library %s entry %q: %v\n", filename, entry.UniqueID, err)
+				rejected++
+				continue
+			}
+			// library reports can not be modified by the user
+			entry.ReadOnly = true
+			library[entry.UniqueID] = entry
+		}
+	}
+
+	reportLibraryLock.Lock()
+	reportLibrary = library
+	reportLibraryLock.Unlock()
+
+	logger.Info("Loaded %d report definitions from %s (%d rejected)\n", len(library), reportLibraryPath, rejected)
+	return nil
+}
+
+// readReportLibraryFile reads the report entries from a library file
+func readReportLibraryFile(filename string) ([]*ReportEntry, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("file is empty")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if raw[0] == '[' {
+		var entries []*ReportEntry
+		if err = decoder.Decode(&entries); err != nil {
+			return nil, err
+		}
+		return entries, nil
+	}
+
+	entry := new(ReportEntry)
+	if err = decoder.Decode(entry); err != nil {
+		return nil, err
+	}
+	return []*ReportEntry{entry}, nil
+}
+
+// GetReportLibrary returns the report definitions in the library sorted by
+// category, display order and name
+func GetReportLibrary() []*ReportEntry {
+	reportLibraryLock.RLock()
+	list := make([]*ReportEntry, 0, len(reportLibrary))
+	for _, entry := range reportLibrary {
+		list = append(list, entry)
+	}
+	reportLibraryLock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Category != list[j].Category {
+			return list[i].Category < list[j].Category
+		}
+		if list[i].DisplayOrder != list[j].DisplayOrder {
+			return list[i].DisplayOrder < list[j].DisplayOrder
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// GetReportLibraryEntry returns the library report definition with the argumented id or nil if not found
+func GetReportLibraryEntry(uniqueID string) *ReportEntry {
+	reportLibraryLock.RLock()
+	defer reportLibraryLock.RUnlock()
+	return reportLibrary[uniqueID]
+}
@@ -2,6 +2,7 @@ package reports
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"encoding/json"
@@ -10,6 +11,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +28,50 @@ import (
 
 const eventLoggerInterval = 10 * time.Second
 
+// queryDeadline is the maximum lifetime of a query created with CreateQuery
+const queryDeadline = 5 * time.Minute
+
+// queryIdleTimeout is how long a query can go without a GetData call before
+// we assume the client has abandoned it and release the database connection
+const queryIdleTimeout = 60 * time.Second
+
+// exportDeadline is the maximum time allowed to stream the results of an export
+const exportDeadline = 30 * time.Minute
+
+// queryReaperInterval is how often we look for expired and abandoned queries
+const queryReaperInterval = 10 * time.Second
+
+// queryPageSize is the maximum number of rows returned by each call to GetData
+const queryPageSize = 1000
+
+// maxOpenQueries limits the number of queries that can hold a database connection
+// at the same time. It must be less than the SetMaxOpenConns value so there is
+// always a connection available for the event and stats loggers.
+const maxOpenQueries = 2
+
+// querySlotWait is how long a new query will wait for an open query slot
+const querySlotWait = 5 * time.Second
+
+// shutdownBackupTimeout is how long Shutdown will wait for the final snapshot
+const shutdownBackupTimeout = 30 * time.Second
+
+// ErrTooManyQueries is returned when a query is rejected because maxOpenQueries are already open
+var ErrTooManyQueries = errors.New("Too many open report queries, please try again later")
+
+// ErrQueryNotFound is returned when a query ID does not exist or has already been closed
+var ErrQueryNotFound = errors.New("Query ID not found")
+
+// QueryError is returned when the ReportEntry can not be parsed or turned into SQL,
+// so the request is bad rather than the database failing
+type QueryError struct {
+	Err error
+}
+
+// Error returns the error as a string
+func (e *QueryError) Error() string {
+	return e.Err.Error()
+}
+
 // Event stores an arbitrary event
 type Event struct {
 	// Name - A human readable name for this event. (ie "session_new" is a new session event)
@@ -43,8 +89,14 @@ type Event struct {
 
 // Query holds the results of a database query operation
 type Query struct {
-	ID   uint64
-	Rows *sql.Rows
+	ID         uint64
+	Rows       *sql.Rows
+	Created    time.Time
+	Owner      string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	lastAccess int64
+	access     sync.Mutex
 }
 
 // QueryCategoriesOptions stores the query options for CATEGORY type reports
@@ -68,6 +120,16 @@ type QuerySeriesOptions struct {
 	TimeIntervalSeconds int      `json:"timeIntervalSeconds"`
 }
 
+// QueryDistributionOptions stores the query options for PERCENTILES and DISTRIBUTION type reports
+type QueryDistributionOptions struct {
+	Column              string    `json:"column"`
+	GroupColumn         string    `json:"groupColumn"`
+	Percentiles         []float64 `json:"percentiles"`
+	Buckets             []float64 `json:"buckets"`
+	TimeIntervalSeconds int       `json:"timeIntervalSeconds"`
+	Limit               int       `json:"limit"`
+}
+
 // QueryEventsOptions stores the query options for EVENTS type reports
 type QueryEventsOptions struct {
 	OrderByColumn string `json:"orderByColumn"`
@@ -105,6 +167,7 @@ type ReportEntry struct {
 	QueryText            QueryTextOptions             `json:"queryText"`
 	QuerySeries          QuerySeriesOptions           `json:"querySeries"`
 	QueryEvents          QueryEventsOptions           `json:"queryEvents"`
+	QueryDistribution    QueryDistributionOptions     `json:"queryDistribution"`
 }
 
 // the main database connection
@@ -117,6 +180,9 @@ var queriesMap = make(map[uint64]*Query)
 var queriesLock sync.RWMutex
 var queryID uint64
 
+// querySlots is used as a semaphore to limit the number of open queries
+var querySlots = make(chan bool, maxOpenQueries)
+
 // queue and prepared statement for writing to the interface_stats database table
 var interfaceStatsQueue = make(chan []interface{}, 1000)
 var interfaceStatsStatement *sql.Stmt
@@ -127,6 +193,9 @@ var sessionStatsStatement *sql.Stmt
 
 var eventQueue = make(chan Event, 10000)
 var cloudQueue = make(chan Event, 1000)
+
+// queueDepthBuckets are the histogram buckets used to record the reports queue depths
+var queueDepthBuckets = []float64{0, 10, 100, 250, 500, 1000, 2500, 5000, 10000}
 var preparedStatements = map[string]*sql.Stmt{}
 var preparedStatementsMutex = sync.RWMutex{}
 
@@ -165,12 +234,25 @@ func Startup() {
 	// set the event log processing batch size
 	eventBatchSize = 1000
 
+	// the queue depth and batch size histograms are counts rather than latencies
+	overseer.RegisterHistogram("reports_queue_depth", queueDepthBuckets)
+	overseer.RegisterHistogram("reports_batch_size", []float64{1, 10, 50, 100, 250, 500, float64(eventBatchSize)})
+	overseer.RegisterHistogram("reports_backup_seconds", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300})
+
 	// register a custom driver with a connect hook where we can set our pragma's for
 	// all connections that get created. This is needed because pragma's are applied
 	// per connection. Since the sql package does connection pooling and management,
 	// the hook lets us set the right pragma's for each and every connection.
 	sql.Register("sqlite3_custom", &sqlite3.SQLiteDriver{ConnectHook: customHook})
 
+	// restore the most recent snapshot if the database did not survive a reboot
+	backupConfig := GetBackupSettings()
+	if backupConfig.RestoreOnBoot {
+		if err = restoreSnapshot(backupConfig, filepath.Join(dbFILEPATH, dbFILENAME)); err != nil {
+			logger.Warn("Failed to restore reports snapshot: %s\n", err.Error())
+		}
+	}
+
 	dbVersion, _, _ := sqlite3.Version()
 	dsn = fmt.Sprintf("file:%s/%s?mode=rwc", dbFILEPATH, dbFILENAME)
 	dbMain, err = sql.Open("sqlite3_custom", dsn)
@@ -191,6 +273,14 @@ func Startup() {
 
 	createTables()
 
+	// load the table schemas used to validate reports and then the report library
+	if err = loadTableSchemas(); err != nil {
+		logger.Err("Failed to load table schemas: %s\n", err.Error())
+	}
+	if err = LoadReportLibrary(); err != nil {
+		logger.Err("Failed to load report library: %s\n", err.Error())
+	}
+
 	// prepare the SQL used for interface_stats INSERT
 	interfaceStatsStatement, err = dbMain.Prepare(GetInterfaceStatsInsertQuery())
 	if err != nil {
@@ -206,6 +296,8 @@ func Startup() {
 	go eventLogger(eventBatchSize)
 	go statsLogger()
 	go dbCleaner()
+	go queryReaper()
+	go backupTask()
 
 	if !kernel.FlagNoCloud {
 		go cloudSender()
@@ -214,6 +306,16 @@ func Startup() {
 
 // Shutdown stops the reports service
 func Shutdown() {
+	// take a final snapshot so a clean restart does not lose any data
+	backupConfig := GetBackupSettings()
+	if backupConfig.Enabled {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownBackupTimeout)
+		if _, err := CreateSnapshot(ctx, backupConfig); err != nil {
+			logger.Warn("Failed to create reports snapshot: %s\n", err.Error())
+		}
+		cancel()
+	}
+
 	dbMain.Close()
 }
 
@@ -236,6 +338,11 @@ func customHook(conn *sqlite3.SQLiteConn) error {
 		logger.Warn("Error setting busy_timeout: %v\n", err)
 	}
 
+	// register the aggregate functions used by the percentile and distribution reports
+	if err := registerAggregates(conn); err != nil {
+		logger.Warn("Error registering aggregate functions: %v\n", err)
+	}
+
 	return nil
 }
 
@@ -250,8 +357,80 @@ func unmarshall(reportEntryStr string, reportEntry *ReportEntry) error {
 	return nil
 }
 
-// CreateQuery submits a database query and returns the results
-func CreateQuery(reportEntryStr string) (*Query, error) {
+// CreateQuery submits a database query for the argumented owner and returns the results
+func CreateQuery(reportEntryStr string, owner string) (*Query, error) {
+	if !acquireQuerySlot() {
+		return nil, ErrTooManyQueries
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryDeadline)
+	rows, err := runReportQuery(ctx, reportEntryStr)
+	if err != nil {
+		cancel()
+		releaseQuerySlot()
+		return nil, err
+	}
+
+	q := new(Query)
+	q.ID = atomic.AddUint64(&queryID, 1)
+	q.Rows = rows
+	q.Created = time.Now()
+	q.Owner = owner
+	q.ctx = ctx
+	q.cancel = cancel
+	q.touch()
+
+	queriesLock.Lock()
+	queriesMap[q.ID] = q
+	queriesLock.Unlock()
+
+	return q, nil
+}
+
+// closeRows closes the rows and releases the open query slot held by the
+// query. It must be called with the access lock held.
+func (q *Query) closeRows() {
+	if q.Rows == nil {
+		return
+	}
+	q.Rows.Close()
+	q.Rows = nil
+	releaseQuerySlot()
+}
+
+// touch updates the last access time of the query
+func (q *Query) touch() {
+	atomic.StoreInt64(&q.lastAccess, time.Now().UnixNano())
+}
+
+// idleTime returns the time since the query was last accessed
+func (q *Query) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&q.lastAccess)))
+}
+
+// acquireQuerySlot reserves one of the open query slots, waiting up to
+// querySlotWait for one to become available before returning false
+func acquireQuerySlot() bool {
+	select {
+	case querySlots <- true:
+		return true
+	case <-time.After(querySlotWait):
+		overseer.IncCounter("reports_query_rejected")
+		logger.Warn("Rejecting report query. Open query limit[%d] reached\n", maxOpenQueries)
+		return false
+	}
+}
+
+// releaseQuerySlot releases a slot reserved by acquireQuerySlot
+func releaseQuerySlot() {
+	<-querySlots
+}
+
+// runReportQuery parses the argumented ReportEntry, applies the user and default
+// time_stamp conditions, and runs the resulting query. The query is bound to the
+// argumented context so it can be cancelled or expired. The caller is responsible
+// for closing the returned rows.
+func runReportQuery(ctx context.Context, reportEntryStr string) (*sql.Rows, error) {
 	var clean bool
 	var err error
 	reportEntry := &ReportEntry{}
@@ -259,15 +438,21 @@ func CreateQuery(reportEntryStr string) (*Query, error) {
 	err = unmarshall(reportEntryStr, reportEntry)
 	if err != nil {
 		logger.Err("json.Unmarshal error: %s\n", err)
-		return nil, err
+		return nil, &QueryError{Err: err}
 	}
 	logger.Debug("ReportEntry: %v\n", reportEntry)
 
+	err = ValidateReportEntry(reportEntry)
+	if err != nil {
+		logger.Warn("%s\n", err.Error())
+		return nil, err
+	}
+
 	mergeConditions(reportEntry)
 	err = addOrUpdateTimestampConditions(reportEntry)
 	if err != nil {
 		logger.Err("Timestamp condition error: %s\n", err)
-		return nil, err
+		return nil, &QueryError{Err: err}
 	}
 
 	var rows *sql.Rows
@@ -282,7 +467,7 @@ func CreateQuery(reportEntryStr string) (*Query, error) {
 
 	logger.Debug("SQL Values: %v \n", values)
 
-	rows, err = sqlStmt.Query(values...)
+	rows, err = sqlStmt.QueryContext(ctx, values...)
 
 	// If the prepared statment was not cached the clean flag will be true which
 	// means we have to close the statement so the memory can be released.
@@ -298,20 +483,7 @@ func CreateQuery(reportEntryStr string) (*Query, error) {
 		return nil, err
 	}
 
-	q := new(Query)
-	q.ID = atomic.AddUint64(&queryID, 1)
-	q.Rows = rows
-
-	queriesLock.Lock()
-	queriesMap[q.ID] = q
-	queriesLock.Unlock()
-
-	// I believe this is here to cleanup stray queries that may be locking the database?
-	go func() {
-		time.Sleep(60 * time.Second)
-		cleanupQuery(q)
-	}()
-	return q, nil
+	return rows, nil
 }
 
 // getPreparedStatement retrieves the prepared statements from the prepared statements map
@@ -327,7 +499,7 @@ func getPreparedStatement(reportEntry *ReportEntry) (*sql.Stmt, bool, error) {
 	query, err := makeSQLString(reportEntry)
 	if err != nil {
 		logger.Warn("Failed to make SQL: %v\n", err)
-		return nil, false, err
+		return nil, false, &QueryError{Err: err}
 	}
 
 	preparedStatementsMutex.RLock()
@@ -355,7 +527,7 @@ func getPreparedStatement(reportEntry *ReportEntry) (*sql.Stmt, bool, error) {
 
 	// Complex UI series queries have embedded timestamps and such that make them unique so
 	// we return without adding to our cache and tell the caller to do statement cleanup.
-	if reportEntry.Type == "SERIES" || reportEntry.Type == "CATEGORIES_SERIES" {
+	if reportEntry.Type == "SERIES" || reportEntry.Type == "CATEGORIES_SERIES" || reportEntry.QueryDistribution.TimeIntervalSeconds != 0 {
 		return stmt, true, nil
 	}
 
@@ -364,6 +536,17 @@ func getPreparedStatement(reportEntry *ReportEntry) (*sql.Stmt, bool, error) {
 	return stmt, false, nil
 }
 
+// GetQueryOwner returns the owner of the provided QueryID
+func GetQueryOwner(queryID uint64) (string, error) {
+	queriesLock.RLock()
+	q := queriesMap[queryID]
+	queriesLock.RUnlock()
+	if q == nil {
+		return "", ErrQueryNotFound
+	}
+	return q.Owner, nil
+}
+
 // GetData returns the data for the provided QueryID
 func GetData(queryID uint64) (string, error) {
 	queriesLock.RLock()
@@ -371,10 +554,31 @@ func GetData(queryID uint64) (string, error) {
 	queriesLock.RUnlock()
 	if q == nil {
 		logger.Warn("Query not found: %d\n", queryID)
-		return "", errors.New("Query ID not found")
+		return "", ErrQueryNotFound
+	}
+
+	q.touch()
+	q.access.Lock()
+	// the rows are released once they have all been read so the
+	// connection is available to other queries before CloseQuery
+	if q.Rows == nil {
+		q.access.Unlock()
+		return "[]", nil
+	}
+	result, err := getRows(q.Rows, queryPageSize)
+	if err == nil {
+		err = q.Rows.Err()
+	}
+	if err != nil || len(result) < queryPageSize {
+		q.closeRows()
 	}
-	result, err := getRows(q.Rows, 1000)
+	q.access.Unlock()
+	q.touch()
+
 	if err != nil {
+		if q.ctx.Err() == context.DeadlineExceeded {
+			err = errors.New("Query deadline exceeded")
+		}
 		return "", err
 	}
 	jsonData, err := json.Marshal(result)
@@ -392,12 +596,48 @@ func CloseQuery(queryID uint64) (string, error) {
 	queriesLock.RUnlock()
 	if q == nil {
 		logger.Warn("Query not found: %d\n", queryID)
-		return "", errors.New("Query ID not found")
+		return "", ErrQueryNotFound
 	}
 	cleanupQuery(q)
 	return "Success", nil
 }
 
+// CancelQuery interrupts the query if it is still running and then closes it
+func CancelQuery(queryID uint64) (string, error) {
+	queriesLock.RLock()
+	q := queriesMap[queryID]
+	queriesLock.RUnlock()
+	if q == nil {
+		logger.Warn("Query not found: %d\n", queryID)
+		return "", ErrQueryNotFound
+	}
+	logger.Info("Cancelling query %d\n", queryID)
+	overseer.IncCounter("reports_query_cancelled")
+	cleanupQuery(q)
+	return "Cancelled", nil
+}
+
+// GetOpenQueryCount returns the number of queries currently holding a database connection
+func GetOpenQueryCount() int {
+	return len(querySlots)
+}
+
+// QueueStats holds the current length and capacity of a reports queue
+type QueueStats struct {
+	Length   int
+	Capacity int
+}
+
+// GetQueueStats returns the length and capacity of each of the reports queues
+func GetQueueStats() map[string]QueueStats {
+	return map[string]QueueStats{
+		"events":          {len(eventQueue), cap(eventQueue)},
+		"cloud":           {len(cloudQueue), cap(cloudQueue)},
+		"interface_stats": {len(interfaceStatsQueue), cap(interfaceStatsQueue)},
+		"session_stats":   {len(sessionStatsQueue), cap(sessionStatsQueue)},
+	}
+}
+
 // CreateEvent creates an Event
 func CreateEvent(name string, table string, sqlOp int, columns map[string]interface{}, modifiedColumns map[string]interface{}) Event {
 	event := Event{Name: name, Table: table, SQLOp: sqlOp, Columns: columns, ModifiedColumns: modifiedColumns}
@@ -455,7 +695,8 @@ func eventLogger(eventBatchSize int) {
 // param batchCount (int) - numbers of events being commited to DB
 // return ([]Event, time.Time) - return a nil eventBatch and the current time
 func batchTransaction(eventBatch []Event, batchCount int) ([]Event, time.Time) {
-	logger.Debug("%v Items ready for batch, starting transaction at %v...\n", batchCount, time.Now())
+	start := time.Now()
+	overseer.ObserveHistogram("reports_queue_depth", overseer.Labels{"queue": "events"}, float64(len(eventQueue)))
 
 	tx, err := dbMain.Begin()
 
@@ -478,7 +719,8 @@ func batchTransaction(eventBatch []Event, batchCount int) ([]Event, time.Time) {
 		return eventBatch, time.Now()
 	}
 
-	logger.Debug("Transaction completed, %v items processed at %v .\n", batchCount, time.Now())
+	overseer.ObserveHistogram("reports_batch_size", nil, float64(batchCount))
+	overseer.ObserveDuration("reports_batch_seconds", nil, time.Since(start))
 
 	return nil, time.Now()
 }
@@ -564,6 +806,8 @@ func cloudSender() {
 
 	for {
 		event := <-cloudQueue
+		overseer.ObserveHistogram("reports_queue_depth", overseer.Labels{"queue": "cloud"}, float64(len(cloudQueue)))
+
 		message, err := json.Marshal(event)
 		if err != nil {
 			logger.Warn("Error calling json.Marshal: %s\n", err.Error())
@@ -578,7 +822,9 @@ func cloudSender() {
 
 		request.Header.Set("AuthRequest", "93BE7735-E9F2-487A-9DD4-9D05B95640F5")
 
+		start := time.Now()
 		response, err := client.Do(request)
+		overseer.ObserveDuration("reports_cloud_seconds", nil, time.Since(start))
 		if err != nil {
 			logger.Warn("Error calling client.Do: %s\n", err.Error())
 			continue
@@ -632,21 +878,13 @@ func getRows(rows *sql.Rows, limit int) ([]map[string]interface{}, error) {
 	valuePtrs := make([]interface{}, columnCount)
 
 	for i := 0; i < limit && rows.Next(); i++ {
-		for i := 0; i < columnCount; i++ {
-			valuePtrs[i] = &values[i]
+		if err = scanRow(rows, values, valuePtrs); err != nil {
+			logger.Warn("Failed to scan row: %v\n", err)
+			return nil, err
 		}
-		rows.Scan(valuePtrs...)
 		entry := make(map[string]interface{})
 		for i, col := range columns {
-			var v interface{}
-			val := values[i]
-			b, ok := val.([]byte)
-			if ok {
-				v = string(b)
-			} else {
-				v = val
-			}
-			entry[col] = v
+			entry[col] = values[i]
 		}
 		tableData = append(tableData, entry)
 	}
@@ -654,18 +892,72 @@ func getRows(rows *sql.Rows, limit int) ([]map[string]interface{}, error) {
 	return tableData, nil
 }
 
+// scanRow scans the current row into the values slice using the valuePtrs
+// slice as scratch space. Any []byte values are converted to strings.
+func scanRow(rows *sql.Rows, values []interface{}, valuePtrs []interface{}) error {
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	err := rows.Scan(valuePtrs...)
+	for i, val := range values {
+		b, ok := val.([]byte)
+		if ok {
+			values[i] = string(b)
+		}
+	}
+	return err
+}
+
+// cleanupQuery removes the query from the queries map, interrupts it if it is
+// still running, closes the rows, and releases the open query slot if the
+// rows were not already fully read
 func cleanupQuery(query *Query) {
 	logger.Debug("cleanupQuery(%d)\n", query.ID)
 	queriesLock.Lock()
-	defer queriesLock.Unlock()
+	_, found := queriesMap[query.ID]
 	delete(queriesMap, query.ID)
-	if query.Rows != nil {
-		query.Rows.Close()
-		query.Rows = nil
+	queriesLock.Unlock()
+
+	// if another caller already cleaned up the query we are finished
+	if !found {
+		return
 	}
+
+	// cancel the context first so any GetData call that is blocked
+	// in the database will return and release the access lock
+	query.cancel()
+
+	query.access.Lock()
+	query.closeRows()
+	query.access.Unlock()
+
 	logger.Debug("cleanupQuery(%d) finished\n", query.ID)
 }
 
+// queryReaper periodically cleans up queries that have passed their deadline
+// or have not been accessed recently. This keeps browsers that navigate away
+// without calling CloseQuery from holding database connections.
+func queryReaper() {
+	for {
+		time.Sleep(queryReaperInterval)
+
+		var expired []*Query
+		queriesLock.RLock()
+		for _, q := range queriesMap {
+			if q.ctx.Err() != nil || q.idleTime() > queryIdleTimeout {
+				expired = append(expired, q)
+			}
+		}
+		queriesLock.RUnlock()
+
+		for _, q := range expired {
+			logger.Info("Cleaning up abandoned query %d (age:%v idle:%v)\n", q.ID, time.Since(q.Created).Round(time.Second), q.idleTime().Round(time.Second))
+			overseer.IncCounter("reports_query_expired")
+			cleanupQuery(q)
+		}
+	}
+}
+
 // createTables builds the reports.db tables and indexes
 func createTables() {
 	var err error
@@ -888,6 +1180,68 @@ func createTables() {
 	if err != nil {
 		logger.Err("Failed to create index: %s\n", err.Error())
 	}
+
+	_, err = dbMain.Exec(
+		`CREATE TABLE IF NOT EXISTS session_actions (
+			time_stamp bigint NOT NULL,
+			session_id int8,
+			conntrack_id int8,
+			action text,
+			reset boolean,
+			username text,
+			ip_protocol int,
+			client_address text,
+			server_address text,
+			client_port int2,
+			server_port int2)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	_, err = dbMain.Exec(`CREATE INDEX IF NOT EXISTS idx_session_actions_time_stamp ON session_actions (time_stamp DESC)`)
+	if err != nil {
+		logger.Err("Failed to create index: %s\n", err.Error())
+	}
+
+	_, err = dbMain.Exec(
+		`CREATE TABLE IF NOT EXISTS admin_audit (
+			time_stamp bigint NOT NULL,
+			action text,
+			username text,
+			role text,
+			method text,
+			path text,
+			client_address text)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	_, err = dbMain.Exec(`CREATE INDEX IF NOT EXISTS idx_admin_audit_time_stamp ON admin_audit (time_stamp DESC)`)
+	if err != nil {
+		logger.Err("Failed to create index: %s\n", err.Error())
+	}
+
+	_, err = dbMain.Exec(
+		`CREATE TABLE IF NOT EXISTS audit (
+			time_stamp bigint NOT NULL,
+			username text,
+			client_address text,
+			action text,
+			path text,
+			status text,
+			diff text,
+			error text)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	_, err = dbMain.Exec(`CREATE INDEX IF NOT EXISTS idx_audit_time_stamp ON audit (time_stamp DESC)`)
+	if err != nil {
+		logger.Err("Failed to create index: %s\n", err.Error())
+	}
 }
 
 // addDefaultTimestampConditions adds time_stamp > X and time_stamp < Y
@@ -1013,6 +1367,9 @@ func dbCleaner() {
 		trimPercent("sessions", .10, tx)
 		trimPercent("session_stats", .10, tx)
 		trimPercent("interface_stats", .10, tx)
+		trimPercent("session_actions", .10, tx)
+		trimPercent("admin_audit", .10, tx)
+		trimPercent("audit", .10, tx)
 
 		logger.Info("Committing database trim...\n")
 
@@ -1178,13 +1535,19 @@ func statsLogger() {
 			if logger.IsTraceEnabled() {
 				logger.Trace("INTERFACE_STATS: %v\n", interfaceStats)
 			}
+			overseer.ObserveHistogram("reports_queue_depth", overseer.Labels{"queue": "interface_stats"}, float64(len(interfaceStatsQueue)))
+			start := time.Now()
 			interfaceStatsStatement.Exec(interfaceStats...)
+			overseer.ObserveDuration("reports_insert_seconds", overseer.Labels{"table": "interface_stats"}, time.Since(start))
 
 		case sessionStats := <-sessionStatsQueue:
 			if logger.IsTraceEnabled() {
 				logger.Trace("SESSION_STATS: %v\n", sessionStats)
 			}
+			overseer.ObserveHistogram("reports_queue_depth", overseer.Labels{"queue": "session_stats"}, float64(len(sessionStatsQueue)))
+			start := time.Now()
 			sessionStatsStatement.Exec(sessionStats...)
+			overseer.ObserveDuration("reports_insert_seconds", overseer.Labels{"table": "session_stats"}, time.Since(start))
 		}
 	}
 }
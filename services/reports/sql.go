@@ -4,11 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/untangle/packetd/services/logger"
 )
 
+// defaultPercentiles are used for PERCENTILES reports that do not specify any
+var defaultPercentiles = []float64{50, 90, 99}
+
 // makeSQLString makes a SQL string from a ReportEntry
 func makeSQLString(reportEntry *ReportEntry) (string, error) {
 	if reportEntry.Table == "" {
@@ -26,6 +30,10 @@ func makeSQLString(reportEntry *ReportEntry) (string, error) {
 		return makeSeriesSQLString(reportEntry)
 	case "CATEGORIES_SERIES":
 		return makeCategoriesSeriesSQLString(reportEntry)
+	case "PERCENTILES":
+		return makePercentilesSQLString(reportEntry)
+	case "DISTRIBUTION":
+		return makeHistogramSQLString(reportEntry)
 	}
 
 	return "", errors.New("Unsupported reportEntry type")
@@ -269,6 +277,134 @@ func makeCategoriesSeriesSQLString(reportEntry *ReportEntry) (string, error) {
 	return sqlStr, err
 }
 
+// makePercentilesSQLString makes a SQL string from a PERCENTILES type ReportEntry
+func makePercentilesSQLString(reportEntry *ReportEntry) (string, error) {
+	options := reportEntry.QueryDistribution
+	if options.Column == "" {
+		return "", errors.New("Missing required attribute Column")
+	}
+
+	percentiles := options.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = defaultPercentiles
+	}
+
+	var columns []string
+	column := getColumnName(reportEntry, options.Column)
+	for _, percentile := range percentiles {
+		columns = append(columns, fmt.Sprintf("percentile(%s, %s) AS %s", column, formatFloat(percentile), percentileColumnName(percentile)))
+	}
+
+	sqlStr, err := makeDistributionSQLString(reportEntry, columns, percentileColumnName(percentiles[0]))
+	if sqlStr != "" {
+		logger.Debug("Percentiles SQL: %v\n", sqlStr)
+	}
+	return sqlStr, err
+}
+
+// makeHistogramSQLString makes a SQL string from a DISTRIBUTION type ReportEntry.
+// The buckets are the boundaries between the histogram columns, so N buckets
+// result in N+1 columns with the count of values below, between and above them.
+func makeHistogramSQLString(reportEntry *ReportEntry) (string, error) {
+	options := reportEntry.QueryDistribution
+	if options.Column == "" {
+		return "", errors.New("Missing required attribute Column")
+	}
+	if len(options.Buckets) == 0 {
+		return "", errors.New("Missing required attribute Buckets")
+	}
+
+	var columns []string
+	column := getColumnName(reportEntry, options.Column)
+	buckets := options.Buckets
+	for i := 0; i <= len(buckets); i++ {
+		var condition, label string
+		switch {
+		case i == 0:
+			condition = fmt.Sprintf("%s < %s", column, formatFloat(buckets[i]))
+			label = "<" + formatFloat(buckets[i])
+		case i == len(buckets):
+			condition = fmt.Sprintf("%s >= %s", column, formatFloat(buckets[i-1]))
+			label = formatFloat(buckets[i-1]) + "+"
+		default:
+			condition = fmt.Sprintf("%s >= %s AND %s < %s", column, formatFloat(buckets[i-1]), column, formatFloat(buckets[i]))
+			label = formatFloat(buckets[i-1]) + "-" + formatFloat(buckets[i])
+		}
+		columns = append(columns, fmt.Sprintf("count(CASE WHEN %s THEN 1 END) AS '%s'", condition, label))
+	}
+
+	sqlStr, err := makeDistributionSQLString(reportEntry, columns, "count("+column+")")
+	if sqlStr != "" {
+		logger.Debug("Distribution SQL: %v\n", sqlStr)
+	}
+	return sqlStr, err
+}
+
+// makeDistributionSQLString makes the SQL string for the argumented PERCENTILES
+// or DISTRIBUTION columns, optionally grouped by category and time interval.
+// Reports grouped only by time use the SERIES query so every interval is
+// included. Reports grouped only by category are sorted by orderBy and limited.
+func makeDistributionSQLString(reportEntry *ReportEntry, columns []string, orderBy string) (string, error) {
+	options := reportEntry.QueryDistribution
+
+	if options.TimeIntervalSeconds != 0 && options.GroupColumn == "" {
+		reportEntry.QuerySeries.Columns = columns
+		reportEntry.QuerySeries.TimeIntervalSeconds = options.TimeIntervalSeconds
+		return makeSeriesSQLString(reportEntry)
+	}
+
+	var groupBy []string
+	sqlStr := "SELECT"
+	if options.TimeIntervalSeconds != 0 {
+		var timeIntervalMilli = int64(options.TimeIntervalSeconds) * 1000
+		sqlStr += fmt.Sprintf(" (%s/%d*%d) as time_trunc,", getColumnName(reportEntry, "time_stamp"), timeIntervalMilli, timeIntervalMilli)
+		groupBy = append(groupBy, "time_trunc")
+	}
+	if options.GroupColumn != "" {
+		sqlStr += " " + options.GroupColumn + ","
+		groupBy = append(groupBy, options.GroupColumn)
+	}
+	sqlStr += " " + strings.Join(columns, ", ")
+	sqlStr += " FROM " + escape(reportEntry.Table)
+	sqlStr += " WHERE"
+	for i, condition := range reportEntry.Conditions {
+		if i != 0 {
+			sqlStr += " AND"
+		}
+		newStr, err := getConditionSQL(reportEntry, &condition)
+		if err != nil {
+			logger.Warn("Invalid condition: %v %v\n", condition, err)
+			return "", err
+		}
+		sqlStr += newStr
+	}
+
+	if len(groupBy) != 0 {
+		sqlStr += " GROUP BY " + strings.Join(groupBy, ", ")
+	}
+
+	if options.TimeIntervalSeconds != 0 {
+		sqlStr += " ORDER BY time_trunc ASC"
+	} else if options.GroupColumn != "" {
+		sqlStr += " ORDER BY " + orderBy + " DESC"
+		if options.Limit != 0 {
+			sqlStr += fmt.Sprintf(" LIMIT %d", options.Limit)
+		}
+	}
+
+	return sqlStr, nil
+}
+
+// percentileColumnName returns the result column name for a percentile (ie 99.9 = p99_9)
+func percentileColumnName(percentile float64) string {
+	return "p" + strings.Replace(formatFloat(percentile), ".", "_", -1)
+}
+
+// formatFloat returns the shortest decimal representation of a float for use in SQL
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
 //makeTimelineSQLString makes a SQL query string to provide the timeline to left join
 //on time-based series reports to provide all datapoints
 func makeTimelineSQLString(startTime string, endTime string, intervalSec int64) (string, error) {
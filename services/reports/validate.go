@@ -0,0 +1,490 @@
+package reports
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// ValidationError describes a problem with a single field of a ReportEntry
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error returns the error as a string
+func (e ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors is the list of problems found when validating a ReportEntry
+type ValidationErrors []ValidationError
+
+// Error returns all of the errors as a single string
+func (e ValidationErrors) Error() string {
+	var list []string
+	for _, item := range e {
+		list = append(list, item.Error())
+	}
+	return "Invalid report entry: " + strings.Join(list, "; ")
+}
+
+// ReportTypes is the list of supported values for ReportEntry.Type
+var ReportTypes = []string{"TEXT", "EVENTS", "CATEGORIES", "SERIES", "CATEGORIES_SERIES", "PERCENTILES", "DISTRIBUTION"}
+
+// AggregationFunctions is the list of supported values for QueryCategoriesOptions.AggregationFunction
+var AggregationFunctions = []string{"count", "sum", "avg", "min", "max", "total", "median"}
+
+// maxDistributionBuckets is the maximum number of buckets in a DISTRIBUTION report
+const maxDistributionBuckets = 50
+
+// sqlKeywords are the words allowed in column and table expressions that are not column names
+var sqlKeywords = map[string]bool{
+	"as": true, "and": true, "or": true, "not": true, "null": true, "is": true, "in": true,
+	"case": true, "when": true, "then": true, "else": true, "end": true, "distinct": true,
+	"like": true, "between": true, "join": true, "left": true, "inner": true, "outer": true,
+	"cross": true, "natural": true, "using": true, "on": true,
+}
+
+// sqlFunctions are the functions allowed in column expressions
+var sqlFunctions = map[string]bool{
+	"count": true, "sum": true, "avg": true, "min": true, "max": true, "total": true,
+	"round": true, "abs": true, "coalesce": true, "ifnull": true, "nullif": true,
+	"lower": true, "upper": true, "length": true, "substr": true, "cast": true,
+	"strftime": true, "datetime": true, "date": true, "time": true, "printf": true,
+	"percentile": true, "median": true,
+}
+
+// tableSchemas holds the columns of each table in the database. It is loaded
+// from the database at startup and used to validate the column names in reports.
+var tableSchemas map[string]map[string]bool
+var tableSchemasLock sync.RWMutex
+
+// loadTableSchemas reads the column names of every table from the database
+func loadTableSchemas() error {
+	schemas := make(map[string]map[string]bool)
+
+	rows, err := dbMain.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err == nil {
+			tables = append(tables, name)
+		}
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		columns, err := loadTableColumns(table)
+		if err != nil {
+			return err
+		}
+		schemas[table] = columns
+	}
+
+	tableSchemasLock.Lock()
+	tableSchemas = schemas
+	tableSchemasLock.Unlock()
+
+	logger.Info("Loaded schemas for %d report tables\n", len(schemas))
+	return nil
+}
+
+// loadTableColumns returns the set of column names in the argumented table
+func loadTableColumns(table string) (map[string]bool, error) {
+	var rows *sql.Rows
+	var err error
+
+	// PRAGMA does not accept placeholders but the table names come from sqlite_master
+	rows, err = dbMain.Query(fmt.Sprintf("PRAGMA table_info('%s')", escapeSingleTick(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]bool)
+	values := make([]interface{}, len(columnNames))
+	valuePtrs := make([]interface{}, len(columnNames))
+	for rows.Next() {
+		if err = scanRow(rows, values, valuePtrs); err != nil {
+			return nil, err
+		}
+		for i, name := range columnNames {
+			if name == "name" {
+				columns[strings.ToLower(fmt.Sprintf("%v", values[i]))] = true
+			}
+		}
+	}
+	return columns, rows.Err()
+}
+
+// GetTableSchemas returns the sorted column names for each table in the database
+func GetTableSchemas() map[string][]string {
+	tableSchemasLock.RLock()
+	defer tableSchemasLock.RUnlock()
+
+	result := make(map[string][]string)
+	for table, columns := range tableSchemas {
+		list := make([]string, 0, len(columns))
+		for column := range columns {
+			list = append(list, column)
+		}
+		sort.Strings(list)
+		result[table] = list
+	}
+	return result
+}
+
+// ValidateReportEntry checks the report type, table, columns, operators and
+// aggregation function of the argumented ReportEntry. Column names are checked
+// against the table schemas loaded from the database. All problems found are
+// returned as ValidationErrors, or nil if the entry is valid.
+func ValidateReportEntry(reportEntry *ReportEntry) error {
+	var errs ValidationErrors
+
+	addError := func(field string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if !containsString(ReportTypes, reportEntry.Type) {
+		addError("type", "unsupported report type %q, must be one of %s", reportEntry.Type, strings.Join(ReportTypes, ", "))
+	}
+
+	tableSchemasLock.RLock()
+	defer tableSchemasLock.RUnlock()
+
+	columns, err := validateTable(reportEntry.Table)
+	if err != nil {
+		addError("table", "%s", err.Error())
+	}
+
+	// the disambiguated names are also valid column references
+	for i, disambi := range reportEntry.ColumnDisambiguation {
+		field := fmt.Sprintf("columnDisambiguation[%d]", i)
+		if err = validateColumnName(disambi.ColumnName, columns); err != nil {
+			addError(field+".columnName", "%s", err.Error())
+		}
+		if err = validateColumnName(disambi.NewColumnName, columns); err != nil {
+			addError(field+".newColumnName", "%s", err.Error())
+		}
+	}
+
+	validateConditions := func(name string, conditions []ReportCondition) {
+		for i, condition := range conditions {
+			field := fmt.Sprintf("%s[%d]", name, i)
+			if err := validateColumnName(condition.Column, columns); err != nil {
+				addError(field+".column", "%s", err.Error())
+			}
+			if _, err := operatorSQL(condition.Operator); err != nil {
+				addError(field+".operator", "unsupported operator %q", condition.Operator)
+			}
+		}
+	}
+	validateConditions("conditions", reportEntry.Conditions)
+	validateConditions("userConditions", reportEntry.UserConditions)
+
+	switch reportEntry.Type {
+	case "TEXT":
+		if len(reportEntry.QueryText.Columns) == 0 {
+			addError("queryText.columns", "at least one column is required")
+		}
+		for i, column := range reportEntry.QueryText.Columns {
+			if err = validateColumnExpression(column, columns); err != nil {
+				addError(fmt.Sprintf("queryText.columns[%d]", i), "%s", err.Error())
+			}
+		}
+	case "EVENTS":
+		if reportEntry.QueryEvents.OrderByColumn != "" {
+			if err = validateColumnName(reportEntry.QueryEvents.OrderByColumn, columns); err != nil {
+				addError("queryEvents.orderByColumn", "%s", err.Error())
+			}
+		}
+		if reportEntry.QueryEvents.Limit < 0 {
+			addError("queryEvents.limit", "must not be negative")
+		}
+	case "CATEGORIES", "CATEGORIES_SERIES":
+		options := reportEntry.QueryCategories
+		if options.GroupColumn == "" {
+			addError("queryCategories.groupColumn", "is required")
+		} else if err = validateColumnExpression(options.GroupColumn, columns); err != nil {
+			addError("queryCategories.groupColumn", "%s", err.Error())
+		}
+		if !containsString(AggregationFunctions, strings.ToLower(options.AggregationFunction)) {
+			addError("queryCategories.aggregationFunction", "unsupported aggregation function %q, must be one of %s", options.AggregationFunction, strings.Join(AggregationFunctions, ", "))
+		}
+		if options.AggregationValue == "" {
+			addError("queryCategories.aggregationValue", "is required")
+		} else if options.AggregationValue != "*" {
+			if err = validateColumnExpression(options.AggregationValue, columns); err != nil {
+				addError("queryCategories.aggregationValue", "%s", err.Error())
+			}
+		}
+		if options.OrderByColumn < 0 || options.OrderByColumn > 2 {
+			addError("queryCategories.orderByColumn", "must be 0, 1 or 2")
+		}
+		if options.Limit < 0 {
+			addError("queryCategories.limit", "must not be negative")
+		}
+		if reportEntry.Type == "CATEGORIES_SERIES" && options.Limit == 0 {
+			addError("queryCategories.limit", "is required for %s reports", reportEntry.Type)
+		}
+	case "SERIES":
+		if len(reportEntry.QuerySeries.Columns) == 0 {
+			addError("querySeries.columns", "at least one column is required")
+		}
+		for i, column := range reportEntry.QuerySeries.Columns {
+			if err = validateColumnExpression(column, columns); err != nil {
+				addError(fmt.Sprintf("querySeries.columns[%d]", i), "%s", err.Error())
+			}
+		}
+		if reportEntry.QuerySeries.TimeIntervalSeconds < 0 {
+			addError("querySeries.timeIntervalSeconds", "must not be negative")
+		}
+	case "PERCENTILES", "DISTRIBUTION":
+		options := reportEntry.QueryDistribution
+		if options.Column == "" {
+			addError("queryDistribution.column", "is required")
+		} else if err = validateColumnExpression(options.Column, columns); err != nil {
+			addError("queryDistribution.column", "%s", err.Error())
+		}
+		if options.GroupColumn != "" {
+			if err = validateColumnExpression(options.GroupColumn, columns); err != nil {
+				addError("queryDistribution.groupColumn", "%s", err.Error())
+			}
+		}
+		if reportEntry.Type == "PERCENTILES" {
+			for i, percentile := range options.Percentiles {
+				if percentile < 0 || percentile > 100 {
+					addError(fmt.Sprintf("queryDistribution.percentiles[%d]", i), "must be between 0 and 100")
+				}
+			}
+		} else {
+			if len(options.Buckets) == 0 {
+				addError("queryDistribution.buckets", "at least one bucket is required")
+			} else if len(options.Buckets) > maxDistributionBuckets {
+				addError("queryDistribution.buckets", "must not have more than %d buckets", maxDistributionBuckets)
+			}
+			for i := 1; i < len(options.Buckets); i++ {
+				if options.Buckets[i] <= options.Buckets[i-1] {
+					addError(fmt.Sprintf("queryDistribution.buckets[%d]", i), "must be greater than the previous bucket")
+				}
+			}
+		}
+		if options.TimeIntervalSeconds < 0 {
+			addError("queryDistribution.timeIntervalSeconds", "must not be negative")
+		}
+		if options.Limit < 0 {
+			addError("queryDistribution.limit", "must not be negative")
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateTable checks the table expression, which may be a single table or
+// tables joined with USING or ON, and returns the set of columns that may be
+// referenced. Columns are returned both bare and qualified with the table name.
+// If the schemas have not been loaded a nil set is returned which disables the
+// column name checks. Must be called with tableSchemasLock held.
+func validateTable(table string) (map[string]bool, error) {
+	if table == "" {
+		return nil, fmt.Errorf("is required")
+	}
+
+	tokens, err := tokenizeSQL(table)
+	if err != nil {
+		return nil, err
+	}
+
+	if tableSchemas == nil {
+		return nil, nil
+	}
+
+	columns := make(map[string]bool)
+	var tables []string
+	var expectTable = true
+
+	for _, token := range tokens {
+		lower := strings.ToLower(token)
+		switch {
+		case lower == "join":
+			expectTable = true
+		case lower == "using" || lower == "on":
+			expectTable = false
+		case expectTable && isIdentifier(token):
+			schema, found := tableSchemas[lower]
+			if !found {
+				return nil, fmt.Errorf("unknown table %q", token)
+			}
+			tables = append(tables, lower)
+			for column := range schema {
+				columns[column] = true
+				columns[lower+"."+column] = true
+			}
+			expectTable = false
+		}
+	}
+
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no table name found in %q", table)
+	}
+
+	// now that we know all the columns check the join constraints
+	for _, token := range tokens {
+		lower := strings.ToLower(token)
+		if !isIdentifier(token) || sqlKeywords[lower] || containsString(tables, lower) {
+			continue
+		}
+		if !columns[lower] {
+			return nil, fmt.Errorf("unknown column %q in join", token)
+		}
+	}
+
+	return columns, nil
+}
+
+// validateColumnName checks that the argumented name is a single known column
+func validateColumnName(name string, columns map[string]bool) error {
+	if name == "" {
+		return fmt.Errorf("column name is required")
+	}
+	if !isIdentifier(name) {
+		return fmt.Errorf("invalid column name %q", name)
+	}
+	if columns != nil && !columns[strings.ToLower(name)] {
+		return fmt.Errorf("unknown column %q", name)
+	}
+	return nil
+}
+
+// validateColumnExpression checks a column expression such as "count(*) as total"
+// or "sum(client_bytes + server_bytes)". Every identifier must be a known column,
+// an allowed function or keyword, or an alias following AS.
+func validateColumnExpression(expression string, columns map[string]bool) error {
+	tokens, err := tokenizeSQL(expression)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("column expression is required")
+	}
+
+	for i, token := range tokens {
+		if !isIdentifier(token) {
+			continue
+		}
+		lower := strings.ToLower(token)
+		if sqlKeywords[lower] {
+			continue
+		}
+		// the token following AS is an alias or a cast type
+		if i > 0 && strings.ToLower(tokens[i-1]) == "as" {
+			continue
+		}
+		if i+1 < len(tokens) && tokens[i+1] == "(" {
+			if !sqlFunctions[lower] {
+				return fmt.Errorf("unsupported function %q", token)
+			}
+			continue
+		}
+		if columns != nil && !columns[lower] {
+			return fmt.Errorf("unknown column %q", token)
+		}
+	}
+	return nil
+}
+
+// tokenizeSQL splits a SQL expression into identifiers, numbers, quoted
+// strings and single character operators. Statement separators, comments and
+// any other characters that have no place in a report expression are rejected.
+func tokenizeSQL(expression string) ([]string, error) {
+	var tokens []string
+	var i int
+
+	for i < len(expression) {
+		ch := expression[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			i++
+		case isIdentChar(ch):
+			start := i
+			for i < len(expression) && (isIdentChar(expression[i]) || expression[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, expression[start:i])
+		case ch == '\'':
+			start := i
+			i++
+			for {
+				if i >= len(expression) {
+					return nil, fmt.Errorf("unterminated string in %q", expression)
+				}
+				if expression[i] == '\'' {
+					// two single ticks is an escaped single tick
+					if i+1 < len(expression) && expression[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			i++
+			tokens = append(tokens, expression[start:i])
+		case ch == '-' && i+1 < len(expression) && expression[i+1] == '-':
+			return nil, fmt.Errorf("comments are not allowed in %q", expression)
+		case ch == '/' && i+1 < len(expression) && expression[i+1] == '*':
+			return nil, fmt.Errorf("comments are not allowed in %q", expression)
+		case strings.IndexByte("()*,+-/%<>=!|", ch) >= 0:
+			tokens = append(tokens, string(ch))
+			i++
+		default:
+			return nil, fmt.Errorf("invalid character %q in %q", ch, expression)
+		}
+	}
+
+	return tokens, nil
+}
+
+// isIdentChar returns true for characters that can appear in an identifier or number
+func isIdentChar(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+// isIdentifier returns true if the token is a (possibly table qualified) identifier
+func isIdentifier(token string) bool {
+	if token == "" || (token[0] >= '0' && token[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		if !isIdentChar(token[i]) && token[i] != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString returns true if the list contains the value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
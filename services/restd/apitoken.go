@@ -0,0 +1,440 @@
+package restd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// apiTokenPrefix is prepended to every API token so they are easy to recognize in scripts and logs
+const apiTokenPrefix = "pdt_"
+
+// apiTokenContextKey is the gin context key for the API token used to authenticate a request
+const apiTokenContextKey = "apiToken"
+
+// apiToken is an entry in the accounts apiTokens settings. Only the SHA-256 hash of the
+// token is stored. Expires is a unix time in seconds or zero if the token does not expire.
+type apiToken struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Hash      string   `json:"hash"`
+	Scopes    []string `json:"scopes"`
+	Created   int64    `json:"created"`
+	CreatedBy string   `json:"createdBy"`
+	Expires   int64    `json:"expires"`
+}
+
+// apiTokenScope is a method and route pattern allowed by a scope
+type apiTokenScope struct {
+	methods []string
+	pattern string
+}
+
+// apiTokenScopes maps each scope name to the routes it allows. Settings write allows
+// changing any settings except the accounts, so it should only be given to trusted
+// provisioning scripts. The apiTokenExcluded routes are never allowed.
+var apiTokenScopes = map[string][]apiTokenScope{
+	"status": {
+		{[]string{http.MethodGet}, "/api/status/*path"},
+		{[]string{http.MethodGet}, "/api/stream/sessions"},
+		{[]string{http.MethodGet}, "/api/debug/json"},
+	},
+	"reports:read": {
+		{[]string{http.MethodGet}, "/api/reports/get_data/:query_id"},
+		{[]string{http.MethodPost}, "/api/reports/create_query"},
+		{[]string{http.MethodPost}, "/api/reports/close_query/:query_id"},
+		{[]string{http.MethodPost}, "/api/reports/cancel_query/:query_id"},
+		{[]string{http.MethodPost}, "/api/reports/export"},
+		{[]string{http.MethodPost}, "/api/reports/validate"},
+		{[]string{http.MethodGet}, "/api/reports/library"},
+		{[]string{http.MethodGet}, "/api/reports/library/:id"},
+	},
+	"settings:read": {
+		{[]string{http.MethodGet}, "/api/settings"},
+		{[]string{http.MethodGet}, "/api/settings/*path"},
+		{[]string{http.MethodGet}, "/api/defaults"},
+		{[]string{http.MethodGet}, "/api/defaults/*path"},
+	},
+	"settings:write": {
+		{[]string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodPatch}, "/api/settings"},
+		{[]string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodPatch}, "/api/settings/*path"},
+		{[]string{http.MethodGet}, "/api/defaults"},
+		{[]string{http.MethodGet}, "/api/defaults/*path"},
+	},
+}
+
+// apiTokenExcluded lists the routes that no token can use whatever the scopes, since
+// they read or change the credentials and tokens. Writing the whole settings is
+// excluded for the same reason, while reading them returns the settings without
+// the accounts. The reports snapshot is excluded since it copies the whole database
+// including the admin audit events.
+var apiTokenExcluded = []apiTokenScope{
+	{[]string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodPatch}, "/api/settings/accounts/*path"},
+	{[]string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodPatch}, "/api/settings/revisions/*path"},
+	{[]string{http.MethodPost, http.MethodDelete, http.MethodPatch}, "/api/settings"},
+	{[]string{http.MethodGet, http.MethodPost}, "/api/reports/snapshot"},
+}
+
+// apiTokenUsageFile stores the last time each token was used so it is kept across restarts
+const apiTokenUsageFile = "/etc/config/api-token-usage.json"
+
+// apiTokenUsageInterval is how often the last used times are saved if they have changed
+const apiTokenUsageInterval = 5 * time.Minute
+
+// apiTokenLastUsed holds the last time each token ID was used
+var apiTokenLastUsed = make(map[string]time.Time)
+var apiTokenUsageChanged bool
+var apiTokenMutex sync.Mutex
+
+// apiTokenUpdateMutex serializes changes to the list of tokens in the settings
+var apiTokenUpdateMutex sync.Mutex
+
+var apiTokenShutdown = make(chan bool)
+
+// getAPITokens returns the API tokens from the settings
+func getAPITokens() []apiToken {
+	var tokens []apiToken
+
+	value, err := settings.GetSettings([]string{"accounts", "apiTokens"})
+	if err != nil || value == nil {
+		return tokens
+	}
+
+	raw, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(raw, &tokens)
+	}
+	if err != nil {
+		logger.Warn("Invalid API token settings: %v\n", err)
+	}
+	return tokens
+}
+
+// hashAPIToken returns the hex SHA-256 hash of the token that is stored in the settings
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkAPIToken checks for a bearer API token in the Authorization header. A valid token
+// is stored in the context for roleRequired to check the scopes. Invalid tokens abort the
+// request and are throttled by source address separately from password logins.
+// returns bool - true for successful auth, false if we should continue to next auth method
+func checkAPIToken(c *gin.Context) bool {
+	auth := c.Request.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer "+apiTokenPrefix) {
+		return false
+	}
+
+	address := getRemoteAddress(c)
+	hash := hashAPIToken(strings.TrimPrefix(auth, "Bearer "))
+	now := time.Now()
+
+	// a valid token is accepted before the throttling is checked since only
+	// invalid tokens are counted as failures for the source address
+	for _, token := range getAPITokens() {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) != 1 {
+			continue
+		}
+		if token.Expires != 0 && now.Unix() >= token.Expires {
+			logger.Info("Expired API token %s from %s\n", token.Name, address)
+			break
+		}
+
+		apiTokenMutex.Lock()
+		apiTokenLastUsed[token.ID] = now
+		apiTokenUsageChanged = true
+		apiTokenMutex.Unlock()
+
+		c.Set(apiTokenContextKey, token)
+		return true
+	}
+
+	key := loginFailureKey(loginScopeToken, "address", address)
+	if status := getLockoutStatus(key); status.RetryAfterSeconds > 0 {
+		c.Header("Retry-After", strconv.Itoa(status.RetryAfterSeconds))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many invalid API tokens", "lockout": status})
+		return false
+	}
+
+	recordLoginFailure(getLoginPolicy(), key)
+	logAuditEvent(c, "token_failed", "", "")
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid API token"})
+	return false
+}
+
+// getContextAPIToken returns the API token used to authenticate the request if there is one
+func getContextAPIToken(c *gin.Context) (apiToken, bool) {
+	value, found := c.Get(apiTokenContextKey)
+	if !found {
+		return apiToken{}, false
+	}
+	token, ok := value.(apiToken)
+	return token, ok
+}
+
+// tokenAllows returns true if one of the token scopes allows the argumented method and path
+func tokenAllows(token apiToken, method string, path string) bool {
+	for _, rule := range apiTokenExcluded {
+		if !matchRoutePattern(rule.pattern, path) {
+			continue
+		}
+		for _, excluded := range rule.methods {
+			if excluded == method {
+				return false
+			}
+		}
+	}
+
+	for _, scope := range token.Scopes {
+		for _, rule := range apiTokenScopes[scope] {
+			if !matchRoutePattern(rule.pattern, path) {
+				continue
+			}
+			for _, allowed := range rule.methods {
+				if allowed == method {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// apiTokenInfo is an API token as returned by the tokens API, without the hash
+type apiTokenInfo struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	Created   int64    `json:"created"`
+	CreatedBy string   `json:"createdBy"`
+	Expires   int64    `json:"expires"`
+	LastUsed  int64    `json:"last_used"`
+}
+
+// listAPITokens is the RESTD GET /api/tokens handler. It returns the tokens without
+// the hashes along with the last time each token was used.
+func listAPITokens(c *gin.Context) {
+	tokens := getAPITokens()
+	list := make([]apiTokenInfo, 0, len(tokens))
+
+	apiTokenMutex.Lock()
+	for _, token := range tokens {
+		info := apiTokenInfo{ID: token.ID, Name: token.Name, Scopes: token.Scopes, Created: token.Created, CreatedBy: token.CreatedBy, Expires: token.Expires}
+		if last, found := apiTokenLastUsed[token.ID]; found {
+			info.LastUsed = last.Unix()
+		}
+		list = append(list, info)
+	}
+	apiTokenMutex.Unlock()
+
+	c.JSON(http.StatusOK, list)
+}
+
+// createAPIToken is the RESTD POST /api/tokens handler. The body has the token name,
+// the scopes, and an optional expires_in_days. The token is only returned in this response.
+func createAPIToken(c *gin.Context) {
+	var request struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(request.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token name"})
+		return
+	}
+	if len(request.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token scopes"})
+		return
+	}
+	for _, scope := range request.Scopes {
+		if _, found := apiTokenScopes[scope]; !found {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token scope: " + scope})
+			return
+		}
+	}
+	if request.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires_in_days"})
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	value := apiTokenPrefix + secret
+	token := apiToken{
+		ID:        id,
+		Name:      request.Name,
+		Hash:      hashAPIToken(value),
+		Scopes:    request.Scopes,
+		Created:   now.Unix(),
+		CreatedBy: getSessionUsername(c),
+	}
+	if request.ExpiresInDays > 0 {
+		token.Expires = now.AddDate(0, 0, request.ExpiresInDays).Unix()
+	}
+
+	apiTokenUpdateMutex.Lock()
+	err = setAPITokens(append(getAPITokens(), token), settings.RevisionInfo{User: token.CreatedBy, Comment: "Create API token " + token.Name})
+	apiTokenUpdateMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.Info("API token %s created by %s with scopes %v\n", token.Name, token.CreatedBy, token.Scopes)
+	logAuditEvent(c, "token_create", getSessionUsername(c), getSessionRole(c))
+	c.JSON(http.StatusOK, gin.H{"id": token.ID, "name": token.Name, "token": value, "scopes": token.Scopes, "expires": token.Expires})
+}
+
+// revokeAPIToken is the RESTD DELETE /api/tokens/:id handler
+func revokeAPIToken(c *gin.Context) {
+	id := c.Param("id")
+
+	apiTokenUpdateMutex.Lock()
+	defer apiTokenUpdateMutex.Unlock()
+
+	tokens := getAPITokens()
+	for i, token := range tokens {
+		if token.ID != id {
+			continue
+		}
+
+		if err := setAPITokens(append(tokens[:i], tokens[i+1:]...), settings.RevisionInfo{User: getSessionUsername(c), Comment: "Revoke API token " + token.Name}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		apiTokenMutex.Lock()
+		delete(apiTokenLastUsed, id)
+		apiTokenUsageChanged = true
+		apiTokenMutex.Unlock()
+
+		logger.Info("API token %s revoked by %s\n", token.Name, getSessionUsername(c))
+		logAuditEvent(c, "token_revoke", getSessionUsername(c), getSessionRole(c))
+		c.JSON(http.StatusOK, gin.H{"result": "OK"})
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": "Token not found: " + id})
+}
+
+// setAPITokens saves the argumented tokens in the settings
+func setAPITokens(tokens []apiToken, info settings.RevisionInfo) error {
+	raw, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	if err = json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+
+	result, err := settings.SetSettingsAs([]string{"accounts", "apiTokens"}, value, false, info)
+	if err != nil {
+		logger.Warn("Failed to save API tokens: %v\n", result)
+		return errors.New("Failed to save API tokens")
+	}
+	return nil
+}
+
+// loadAPITokenUsage loads the last used times saved by saveAPITokenUsage
+func loadAPITokenUsage() {
+	data, err := ioutil.ReadFile(apiTokenUsageFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Unable to read API token usage: %v\n", err)
+		}
+		return
+	}
+
+	var usage map[string]int64
+	if err = json.Unmarshal(data, &usage); err != nil {
+		logger.Warn("Invalid API token usage file: %v\n", err)
+		return
+	}
+
+	apiTokenMutex.Lock()
+	for id, last := range usage {
+		apiTokenLastUsed[id] = time.Unix(last, 0)
+	}
+	apiTokenMutex.Unlock()
+}
+
+// saveAPITokenUsage saves the last used times if they have changed since the last save
+func saveAPITokenUsage() {
+	apiTokenMutex.Lock()
+	if !apiTokenUsageChanged {
+		apiTokenMutex.Unlock()
+		return
+	}
+	usage := make(map[string]int64, len(apiTokenLastUsed))
+	for id, last := range apiTokenLastUsed {
+		usage[id] = last.Unix()
+	}
+	apiTokenUsageChanged = false
+	apiTokenMutex.Unlock()
+
+	data, err := json.Marshal(usage)
+	if err == nil {
+		err = ioutil.WriteFile(apiTokenUsageFile+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(apiTokenUsageFile+".tmp", apiTokenUsageFile)
+	}
+	if err != nil {
+		logger.Warn("Unable to save API token usage: %v\n", err)
+	}
+}
+
+// apiTokenUsageTask periodically saves the last used times of the API tokens
+func apiTokenUsageTask() {
+	for {
+		select {
+		case <-apiTokenShutdown:
+			saveAPITokenUsage()
+			apiTokenShutdown <- true
+			return
+		case <-time.After(apiTokenUsageInterval):
+			saveAPITokenUsage()
+		}
+	}
+}
+
+// randomHex returns n random bytes as a hex string
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
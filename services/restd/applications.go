@@ -0,0 +1,72 @@
+package restd
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/appclassmanager"
+)
+
+// defaultApplicationLimit is the number of search results returned if the limit is not set
+const defaultApplicationLimit = 25
+
+// maxApplicationLimit is the largest number of search results that can be requested
+const maxApplicationLimit = 1000
+
+// getClassifyApplication is the RESTD GET /api/classify/applications/:guid handler. The
+// application is found by GUID, then by index, then by name. The search API is dispatched
+// from here since the router does not allow a static route next to the :guid parameter.
+func getClassifyApplication(c *gin.Context) {
+	guid := c.Param("guid")
+	if guid == "search" {
+		searchClassifyApplications(c)
+		return
+	}
+
+	info, found := appclassmanager.LookupGUID(guid)
+	if !found {
+		if index, err := strconv.Atoi(guid); err == nil {
+			info, found = appclassmanager.LookupIndex(index)
+		}
+	}
+	if !found {
+		info, found = appclassmanager.LookupName(guid)
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Application not found: " + guid})
+		return
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// searchClassifyApplications is the RESTD GET /api/classify/applications/search handler.
+// The query parameters are q for the search text, category for a comma separated list of
+// categories, min_productivity, max_productivity, min_risk, max_risk, and limit.
+func searchClassifyApplications(c *gin.Context) {
+	var err error
+	query := appclassmanager.SearchQuery{
+		Text:       c.Query("q"),
+		Categories: splitQueryList(c.Query("category")),
+	}
+
+	if query.MinProductivity, err = parseQueryInt(c, "min_productivity", 0, 255); err == nil {
+		if query.MaxProductivity, err = parseQueryInt(c, "max_productivity", 0, 255); err == nil {
+			if query.MinRisk, err = parseQueryInt(c, "min_risk", 0, 255); err == nil {
+				if query.MaxRisk, err = parseQueryInt(c, "max_risk", 0, 255); err == nil {
+					query.Limit, err = parseQueryInt(c, "limit", 1, maxApplicationLimit)
+				}
+			}
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if query.Limit < 0 {
+		query.Limit = defaultApplicationLimit
+	}
+
+	c.JSON(http.StatusOK, appclassmanager.SearchApplications(query))
+}
@@ -0,0 +1,241 @@
+package restd
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// maxAuditRecords is the largest number of records returned by the audit API
+const maxAuditRecords = 1000
+
+// settingsChange is one entry of the diff between the old and new settings
+type settingsChange struct {
+	Op   string      `json:"op"`
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// getSettingsForAudit returns the current value at the argumented settings path or nil if it does not exist
+func getSettingsForAudit(segments []string) interface{} {
+	value, err := settings.GetSettings(segments)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// auditSettingsChange records a settings change in the audit table. The status is
+// failed if err is not nil, which includes sync-settings failures, and the error
+// and sync-settings output are recorded instead of applying the change.
+func auditSettingsChange(c *gin.Context, action string, segments []string, oldValue interface{}, newValue interface{}, result interface{}, err error) {
+	record := reports.AuditRecord{
+		Username:      getSessionUsername(c),
+		ClientAddress: getRemoteAddress(c),
+		Action:        action,
+		Path:          "/" + strings.Join(segments, "/"),
+		Status:        "success",
+	}
+
+	changes := redactSettingsChanges(diffSettings(strings.TrimSuffix(record.Path, "/"), oldValue, newValue))
+	diff, jerr := json.Marshal(changes)
+	if jerr != nil {
+		logger.Warn("Failed to serialize settings diff: %v\n", jerr)
+	}
+	record.Diff = string(diff)
+
+	if err != nil {
+		record.Status = "failed"
+		record.Error = err.Error()
+		if output, ok := result.(map[string]interface{}); ok {
+			if text, ok := output["output"].(string); ok && strings.TrimSpace(text) != "" {
+				record.Error += ": " + strings.TrimSpace(text)
+			}
+		}
+	}
+
+	logger.Info("Settings %s %s by %s from %s: %s (%d changes)\n", action, record.Path, record.Username, record.ClientAddress, record.Status, len(changes))
+	reports.LogAuditRecord(record)
+}
+
+// diffSettings returns the changes between the old and new settings values. Objects
+// are compared by key and arrays by index so only the changed leaves are included.
+func diffSettings(path string, oldValue interface{}, newValue interface{}) []settingsChange {
+	changes := []settingsChange{}
+
+	oldMap, oldIsMap := oldValue.(map[string]interface{})
+	newMap, newIsMap := newValue.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := make([]string, 0, len(oldMap)+len(newMap))
+		for key := range oldMap {
+			keys = append(keys, key)
+		}
+		for key := range newMap {
+			if _, found := oldMap[key]; !found {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			oldChild, oldFound := oldMap[key]
+			newChild, newFound := newMap[key]
+			childPath := path + "/" + key
+			switch {
+			case !oldFound:
+				changes = append(changes, settingsChange{Op: "add", Path: childPath, New: redactSettingsValue(key, newChild)})
+			case !newFound:
+				changes = append(changes, settingsChange{Op: "remove", Path: childPath, Old: redactSettingsValue(key, oldChild)})
+			default:
+				changes = append(changes, diffSettingsChild(key, childPath, oldChild, newChild)...)
+			}
+		}
+		return changes
+	}
+
+	oldList, oldIsList := oldValue.([]interface{})
+	newList, newIsList := newValue.([]interface{})
+	if oldIsList && newIsList {
+		for i := 0; i < len(oldList) || i < len(newList); i++ {
+			childPath := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(oldList):
+				changes = append(changes, settingsChange{Op: "add", Path: childPath, New: redactSettingsValue("", newList[i])})
+			case i >= len(newList):
+				changes = append(changes, settingsChange{Op: "remove", Path: childPath, Old: redactSettingsValue("", oldList[i])})
+			default:
+				changes = append(changes, diffSettings(childPath, oldList[i], newList[i])...)
+			}
+		}
+		return changes
+	}
+
+	return diffSettingsChild("", path, oldValue, newValue)
+}
+
+// diffSettingsChild returns the changes for a value that exists in both the old and new settings
+func diffSettingsChild(key string, path string, oldValue interface{}, newValue interface{}) []settingsChange {
+	if reflect.DeepEqual(oldValue, newValue) {
+		return nil
+	}
+
+	_, oldIsMap := oldValue.(map[string]interface{})
+	_, newIsMap := newValue.(map[string]interface{})
+	_, oldIsList := oldValue.([]interface{})
+	_, newIsList := newValue.([]interface{})
+	if (oldIsMap && newIsMap) || (oldIsList && newIsList) {
+		return diffSettings(path, oldValue, newValue)
+	}
+
+	switch {
+	case oldValue == nil:
+		return []settingsChange{{Op: "add", Path: path, New: redactSettingsValue(key, newValue)}}
+	case newValue == nil:
+		return []settingsChange{{Op: "remove", Path: path, Old: redactSettingsValue(key, oldValue)}}
+	}
+	return []settingsChange{{Op: "replace", Path: path, Old: redactSettingsValue(key, oldValue), New: redactSettingsValue(key, newValue)}}
+}
+
+// redactSettingsValue hides password hashes and other secrets so they are not stored in the audit table
+func redactSettingsValue(key string, value interface{}) interface{} {
+	if isSecretSettingsKey(key) {
+		return "********"
+	}
+
+	switch item := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(item))
+		for k, v := range item {
+			redacted[k] = redactSettingsValue(k, v)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(item))
+		for i, v := range item {
+			redacted[i] = redactSettingsValue("", v)
+		}
+		return redacted
+	}
+	return value
+}
+
+// redactSettingsChanges hides the old and new values of the changes with a path that
+// goes through a secret, such as a change made by posting a password hash directly
+// to its own path where the diff has no key to check
+func redactSettingsChanges(changes []settingsChange) []settingsChange {
+	for i := range changes {
+		if !isSecretSettingsPath(changes[i].Path) {
+			continue
+		}
+		if changes[i].Old != nil {
+			changes[i].Old = "********"
+		}
+		if changes[i].New != nil {
+			changes[i].New = "********"
+		}
+	}
+	return changes
+}
+
+// isSecretSettingsPath returns true if any key in the settings path holds a secret
+func isSecretSettingsPath(path string) bool {
+	for _, key := range strings.Split(path, "/") {
+		if isSecretSettingsKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSecretSettingsKey returns true for settings keys that hold passwords, hashes, or keys
+func isSecretSettingsKey(key string) bool {
+	lower := strings.ToLower(key)
+	return strings.HasPrefix(lower, "password") || lower == "hash" || lower == "privatekey" || lower == "presharedkey" || lower == "secret" || lower == "token"
+}
+
+// getAudit is the RESTD /api/audit handler. It returns the settings change records
+// newest first. The optional start and end query parameters are unix times in
+// milliseconds, and user, path, and limit filter the records.
+func getAudit(c *gin.Context) {
+	end := time.Now()
+	start := end.Add(-7 * 24 * time.Hour)
+	limit := 100
+
+	for name, target := range map[string]*time.Time{"start": &start, "end": &end} {
+		if value := c.Query(name); value != "" {
+			millis, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + ": " + value})
+				return
+			}
+			*target = time.Unix(0, millis*int64(time.Millisecond))
+		}
+	}
+
+	if value := c.Query("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditRecords {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit: " + value})
+			return
+		}
+	}
+
+	records, err := reports.GetAuditRecords(start, end, c.Query("user"), c.Query("path"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, records)
+}
@@ -15,8 +15,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/GehirnInc/crypt"
-	_ "github.com/GehirnInc/crypt/md5_crypt" // MD5 used to verify password
 	"github.com/gbrlsnchs/jwt/v3"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -28,12 +26,22 @@ import (
 type CustomJWTPayload struct {
 	jwt.Payload
 	//IsLoggedIn  bool   `json:"isLoggedIn"`
+	Role string `json:"role,omitempty"`
 }
 
 // authRequired is a middleware handler function within go that should be used for any authenticated endpoints within restD
 // it returns a context that is either successfully authenticated, contains an authorization error, or a server error for failed session creation
 func authRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// API tokens are checked first so requests with a token are always limited to its scopes
+		if checkAPIToken(c) {
+			c.Next()
+			return
+		}
+		if c.IsAborted() {
+			return
+		}
+
 		// If alread logged in, continue
 		session := sessions.Default(c)
 		user := session.Get("username")
@@ -44,7 +52,7 @@ func authRequired() gin.HandlerFunc {
 
 		// If the connection is from the local host, check if its authorized
 		if checkAuthLocal(c) {
-			if !setAuthSession(c, "root", "") {
+			if !setInternalSession(c, "root") {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Authorization failed: Failed to create 'root' session"})
 				c.Abort()
 				return
@@ -56,6 +64,9 @@ func authRequired() gin.HandlerFunc {
 
 		// Check if the connection has valid basic http auth credentials
 		httpAuth, username, password := checkHTTPAuth(c)
+		if c.IsAborted() {
+			return
+		}
 		if httpAuth {
 			if !setAuthSession(c, username, password) {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Authorization failed: Failed to create HTTP auth session"})
@@ -70,7 +81,9 @@ func authRequired() gin.HandlerFunc {
 
 		//Check UN/PW form data
 		formAuth, username, password := checkFormAuth(c)
-
+		if c.IsAborted() {
+			return
+		}
 		if formAuth {
 			if !setAuthSession(c, username, password) {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Authorization failed: Failed to create form auth session"})
@@ -84,7 +97,7 @@ func authRequired() gin.HandlerFunc {
 
 		//Check the token from cmd/command center
 		if checkCommandCenterToken(c) {
-			if !setAuthSession(c, "command-center", "") {
+			if !setInternalSession(c, "command-center") {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Authorization failed: Failed to create 'command-center' session"})
 				c.Abort()
 				return
@@ -104,7 +117,7 @@ func authRequired() gin.HandlerFunc {
 
 		// if the setup wizard is not completed, auth is not required
 		if !isSetupWizardCompleted() {
-			if !setAuthSession(c, "setup", "") {
+			if !setInternalSession(c, "setup") {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Authorization failed: Failed to create 'setup' session"})
 				c.Abort()
 				return
@@ -178,7 +191,13 @@ func checkJWTToken(c *gin.Context) (bool, string) {
 	}
 
 	if setAuthSession(c, payload.Payload.Subject, "") {
-		logger.Info("JWT accepted: %s\n", payload.Payload.Subject)
+		// the role claim limits the session to that role even if the account has more access
+		if payload.Role != "" {
+			session := sessions.Default(c)
+			session.Set("role", payload.Role)
+			session.Save()
+		}
+		logger.Info("JWT accepted: %s role %s\n", payload.Payload.Subject, payload.Role)
 		return true, payload.Payload.Subject
 	}
 
@@ -199,19 +218,22 @@ func findJWTToken(c *gin.Context) []byte {
 	return nil
 }
 
-// createJWTToken creates a valid JWT token - used for testing
+// createJWTToken creates a valid JWT token with the role of the user - used for testing
 func createJWTToken(username string) ([]byte, error) {
 	now := time.Now()
 	hs256 := jwt.NewHMAC(jwt.SHA256, []byte("secret"))
 	h := jwt.Header{KeyID: "kid"}
-	p := jwt.Payload{
-		Issuer:         "MFW",
-		Subject:        "username",
-		Audience:       nil,
-		ExpirationTime: now.Add(24 * 30 * 12 * time.Hour).Unix(),
-		NotBefore:      now.Add(30 * time.Minute).Unix(),
-		IssuedAt:       now.Unix(),
-		JWTID:          "MFW",
+	p := CustomJWTPayload{
+		Payload: jwt.Payload{
+			Issuer:         "MFW",
+			Subject:        username,
+			Audience:       nil,
+			ExpirationTime: now.Add(24 * 30 * 12 * time.Hour).Unix(),
+			NotBefore:      now.Add(30 * time.Minute).Unix(),
+			IssuedAt:       now.Unix(),
+			JWTID:          "MFW",
+		},
+		Role: getUserRole(username),
 	}
 	token, err := jwt.Sign(h, p, hs256)
 	if err != nil {
@@ -253,11 +275,14 @@ func checkHTTPAuth(c *gin.Context) (bool, string, string) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid Authorization Header Format"})
 		return false, "", ""
 	}
-	if !validate(pair[0], pair[1]) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Authorization Failed"})
+	if !validateLogin(c, "", pair[0], pair[1]) {
+		if !c.IsAborted() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Authorization Failed"})
+		}
 		return false, "", ""
 	}
 
+	startPasswordUpgrade(pair[0], pair[1])
 	return true, pair[0], pair[1]
 }
 
@@ -295,7 +320,8 @@ func checkFormAuth(c *gin.Context) (bool, string, string) {
 	}
 
 	// This is a POST, with a username/password. Try to login, set an expiration token for 86400 seconds (24 hours)
-	if validate(username, password) {
+	if validateLogin(c, "", username, password) {
+		startPasswordUpgrade(username, password)
 		return true, username, password
 	}
 
@@ -318,6 +344,18 @@ func authLogout(c *gin.Context) {
 	return
 }
 
+// getSessionUsername returns the username of the authenticated session, the name of
+// the API token used to authenticate the request, or an empty string
+func getSessionUsername(c *gin.Context) string {
+	if token, ok := getContextAPIToken(c); ok {
+		return "token:" + token.Name
+	}
+	if user, ok := sessions.Default(c).Get("username").(string); ok {
+		return user
+	}
+	return ""
+}
+
 // authStatus returns (via a json http reply) the auth status of the current session
 func authStatus(c *gin.Context) {
 	// if the setup wizard is not completed, auth is not required - return fake user
@@ -348,7 +386,12 @@ func authStatus(c *gin.Context) {
 	session := sessions.Default(c)
 	user := session.Get("username")
 	if user == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Not logged in"})
+		// include the throttling status so the login page can tell the user when to try again
+		keys := []string{loginFailureKey("", "address", getRemoteAddress(c))}
+		if username := c.Query("username"); username != "" {
+			keys = append(keys, loginFailureKey("", "user", username))
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not logged in", "lockout": getLockoutStatus(keys...)})
 	} else {
 		username := user.(string)
 		credentialsJSON := getCredentials(username)
@@ -392,7 +435,8 @@ func getCredentials(username string) map[string]interface{} {
 }
 
 // validate validates the provided username/password against the authorization credentials
-// stored in the settings
+// stored in the settings. Passwords stored with a weaker hash than the password policy
+// algorithm are upgraded after a successful login.
 // returns true if the username/password is valid, false otherwise
 func validate(username string, password string) bool {
 	credentialsJSON := getCredentials(username)
@@ -400,29 +444,19 @@ func validate(username string, password string) bool {
 		logger.Warn("Failed to find credentials for user %v\n", username)
 		return false
 	}
-	if credentialsJSON["passwordHashMD5"] == nil {
-		logger.Warn("Credentials for %v missing passwordHashMD5\n", username)
-		return false
-	}
 	if credentialsJSON["username"] != username {
 		logger.Warn("Assertion failed: getCredentials returned wrong credentials\n")
 		return false
 	}
 
-	crypt := crypt.MD5.New()
-	hash, ok := credentialsJSON["passwordHashMD5"].(string)
-	if !ok {
-		logger.Warn("Invalid passwordHashMD5 type\n")
-	}
-	err := crypt.Verify(hash, []byte(password))
-
-	if err == nil {
-		logger.Info("Successful authentication: %v\n", username)
-		return true
+	algorithm, err := verifyPassword(credentialsJSON, password, getPasswordPolicy())
+	if err != nil {
+		logger.Info("Failed authentication: %v (%s) %v\n", username, algorithm, err)
+		return false
 	}
 
-	logger.Info("Failed authentication: %v\n", username)
-	return false
+	logger.Info("Successful authentication: %v\n", username)
+	return true
 }
 
 // isLocalProcessRoot returns true if the process connecting from the specified ip/port is
@@ -563,6 +597,8 @@ func checkCommandCenterToken(c *gin.Context) bool {
 func setAuthSession(c *gin.Context, username string, password string) bool {
 	session := sessions.Default(c)
 	session.Set("username", username)
+	session.Delete("role")
+	session.Delete("internal")
 
 	if strings.Trim(password, " ") != "" {
 		session.Set("password", password)
@@ -577,3 +613,18 @@ func setAuthSession(c *gin.Context, username string, password string) bool {
 
 	return false
 }
+
+// setInternalSession creates the session for the local root, command center, and setup
+// wizard connections. These sessions are marked internal so they are always admin
+// without giving admin to a credentials entry that uses the same username.
+func setInternalSession(c *gin.Context, username string) bool {
+	session := sessions.Default(c)
+	session.Set("username", username)
+	session.Set("internal", true)
+	session.Delete("role")
+	session.Delete("password")
+
+	session.Options(sessions.Options{Path: "/", MaxAge: 86400})
+
+	return session.Save() == nil
+}
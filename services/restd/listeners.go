@@ -0,0 +1,413 @@
+package restd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/certmanager"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// listenerSettings is an address and port the admin interface listens on. If Interface
+// is set the socket is bound to that network device so it only accepts connections
+// received on it. An empty Address listens on all addresses.
+type listenerSettings struct {
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	TLS       bool   `json:"tls"`
+	Interface string `json:"interface"`
+}
+
+// webAdminSettings is the system webAdmin settings. If RedirectHTTP is true the plain HTTP
+// listeners redirect to the first TLS listener, except for local connections.
+type webAdminSettings struct {
+	Listeners    []listenerSettings `json:"listeners"`
+	RedirectHTTP bool               `json:"redirectHTTP"`
+}
+
+// defaultListeners are used if the listeners are not configured or are not valid
+var defaultListeners = []listenerSettings{{Port: 80}, {Port: 443, TLS: true}}
+
+// runningListener is a listener that is currently serving
+type runningListener struct {
+	config   listenerSettings
+	redirect int
+	server   *http.Server
+}
+
+var listenerTable = make(map[string]*runningListener)
+var listenerMutex sync.Mutex
+var listenerSubscription int
+
+// startListeners starts the configured listeners and restarts them when the settings change
+func startListeners() {
+	applyListenerSettings()
+	listenerSubscription = settings.Subscribe("system/webAdmin", func(oldValue interface{}, newValue interface{}) {
+		logger.Info("Updating admin listeners after settings change\n")
+		applyListenerSettings()
+	})
+}
+
+// stopListeners stops all of the listeners
+func stopListeners() {
+	settings.Unsubscribe(listenerSubscription)
+
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+
+	for key, item := range listenerTable {
+		stopListener(key, item)
+	}
+}
+
+// getWebAdminSettings returns the webAdmin settings with the default listeners if they are not valid
+func getWebAdminSettings() webAdminSettings {
+	config := webAdminSettings{}
+
+	value, err := settings.GetSettings([]string{"system", "webAdmin"})
+	if err == nil && value != nil {
+		raw, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(raw, &config)
+		}
+		if err != nil {
+			logger.Warn("Invalid webAdmin settings: %v\n", err)
+		}
+	}
+
+	if len(config.Listeners) == 0 {
+		config.Listeners = defaultListeners
+	}
+	for _, item := range config.Listeners {
+		if err := validateListener(item); err != nil {
+			logger.Warn("Invalid webAdmin listener, using defaults: %v\n", err)
+			config.Listeners = defaultListeners
+			break
+		}
+	}
+	return config
+}
+
+// validateListener checks the address, port, and interface of a listener
+func validateListener(item listenerSettings) error {
+	if item.Port < 1 || item.Port > 65535 {
+		return fmt.Errorf("invalid port %d", item.Port)
+	}
+	if item.Address != "" && net.ParseIP(item.Address) == nil {
+		return fmt.Errorf("invalid address %s", item.Address)
+	}
+	if item.Interface != "" {
+		if _, err := net.InterfaceByName(item.Interface); err != nil {
+			return fmt.Errorf("invalid interface %s: %v", item.Interface, err)
+		}
+	}
+	return nil
+}
+
+// applyListenerSettings starts the listeners in the settings and stops any others.
+// Listeners that have not changed keep running. The new listeners are started before
+// the old ones are stopped, and the old ones keep running if none of the new ones
+// start, so a bad interface or a port that is in use does not lock out the admin.
+func applyListenerSettings() {
+	config := getWebAdminSettings()
+
+	redirect := 0
+	if config.RedirectHTTP {
+		for _, item := range config.Listeners {
+			if item.TLS {
+				redirect = item.Port
+				break
+			}
+		}
+	}
+
+	wanted := make(map[string]*runningListener)
+	for _, item := range config.Listeners {
+		listener := &runningListener{config: item}
+		if !item.TLS {
+			listener.redirect = redirect
+		}
+		wanted[listenerKey(listener)] = listener
+	}
+
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+
+	// a new listener on the port of a listener that is being replaced can only be
+	// started after the old listener stops so those are started last
+	var deferred []string
+	running := 0
+	for key, item := range wanted {
+		if _, found := listenerTable[key]; found {
+			running++
+			continue
+		}
+		if isReplacedPort(item.config.Port, wanted) {
+			deferred = append(deferred, key)
+			continue
+		}
+		if err := startListener(item); err != nil {
+			logger.Err("Failed to start listener %s: %v\n", key, err)
+			continue
+		}
+		listenerTable[key] = item
+		running++
+	}
+
+	if running == 0 && len(deferred) == 0 && len(listenerTable) != 0 {
+		logger.Err("None of the new listeners could be started, keeping the current listeners\n")
+		return
+	}
+
+	for key, item := range listenerTable {
+		if _, found := wanted[key]; !found {
+			stopListener(key, item)
+		}
+	}
+
+	for _, key := range deferred {
+		item := wanted[key]
+		if err := startListener(item); err != nil {
+			logger.Err("Failed to start listener %s: %v\n", key, err)
+			continue
+		}
+		listenerTable[key] = item
+	}
+
+	if len(listenerTable) == 0 {
+		startDefaultListeners()
+	}
+}
+
+// isReplacedPort returns true if a running listener that is not in the wanted
+// listeners uses the argumented port. The caller must hold the listenerMutex.
+func isReplacedPort(port int, wanted map[string]*runningListener) bool {
+	for key, item := range listenerTable {
+		if _, found := wanted[key]; !found && item.config.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// startDefaultListeners starts the default listeners when none of the configured
+// listeners are running. The caller must hold the listenerMutex.
+func startDefaultListeners() {
+	logger.Err("No listeners are running, starting the default listeners\n")
+
+	for _, config := range defaultListeners {
+		item := &runningListener{config: config}
+		key := listenerKey(item)
+		if _, found := listenerTable[key]; found {
+			continue
+		}
+		if err := startListener(item); err != nil {
+			logger.Err("Failed to start listener %s: %v\n", key, err)
+			continue
+		}
+		listenerTable[key] = item
+	}
+}
+
+// listenerKey returns a string that identifies the listener configuration
+func listenerKey(item *runningListener) string {
+	key := net.JoinHostPort(item.config.Address, strconv.Itoa(item.config.Port))
+	if item.config.Interface != "" {
+		key += "%" + item.config.Interface
+	}
+	if item.config.TLS {
+		key += "/https"
+	} else {
+		key += "/http"
+	}
+	if item.redirect != 0 {
+		key += fmt.Sprintf("->%d", item.redirect)
+	}
+	return key
+}
+
+// startListener opens the listener socket and starts serving on it. The certificate
+// for TLS listeners is loaded for each handshake so a new certificate is used without
+// restarting the listener.
+func startListener(item *runningListener) error {
+	var config net.ListenConfig
+	if item.config.Interface != "" {
+		device := item.config.Interface
+		config.Control = func(network string, address string, conn syscall.RawConn) error {
+			var err error
+			cerr := conn.Control(func(fd uintptr) {
+				err = syscall.BindToDevice(int(fd), device)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+
+	socket, err := config.Listen(context.Background(), "tcp", net.JoinHostPort(item.config.Address, strconv.Itoa(item.config.Port)))
+	if err != nil {
+		return err
+	}
+
+	var handler http.Handler = engine
+	if item.redirect != 0 {
+		handler = redirectHandler(item.redirect)
+	}
+
+	item.server = &http.Server{Handler: handler}
+	key := listenerKey(item)
+
+	if item.config.TLS {
+		item.server.TLSConfig = &tls.Config{GetCertificate: certmanager.GetCertificate}
+		go serveListener(key, func() error { return item.server.ServeTLS(socket, "", "") })
+	} else {
+		go serveListener(key, func() error { return item.server.Serve(socket) })
+	}
+
+	logger.Info("Listening on %s\n", key)
+	return nil
+}
+
+// serveListener runs the serve function and logs the error if the listener stops unexpectedly
+func serveListener(key string, serve func() error) {
+	if err := serve(); err != nil && err != http.ErrServerClosed {
+		logger.Err("Listener %s stopped: %v\n", key, err)
+	}
+}
+
+// stopListener stops the listener and removes it from the table. The caller must hold the listenerMutex.
+func stopListener(key string, item *runningListener) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := item.server.Shutdown(ctx); err != nil {
+		logger.Warn("Failed to stop listener %s: %v\n", key, err)
+		item.server.Close()
+	}
+	delete(listenerTable, key)
+	logger.Info("Stopped listening on %s\n", key)
+}
+
+// redirectHandler redirects requests to HTTPS on the argumented port. Requests from the
+// local host are passed to the engine so local tools can keep using plain HTTP.
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+				engine.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		host := r.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		host = strings.Trim(host, "[]")
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// getCertificate is the RESTD GET /api/certificate handler
+func getCertificate(c *gin.Context) {
+	info, err := certmanager.GetCertificateInfo()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// importCertificate is the RESTD POST /api/certificate handler. The body has the PEM
+// certificate chain with the leaf certificate first, and the PEM private key. The key
+// can be left out to import a certificate signed from POST /api/certificate/csr.
+func importCertificate(c *gin.Context) {
+	var request struct {
+		Certificate string `json:"certificate"`
+		Key         string `json:"key"`
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	info, err := certmanager.ImportCertificate([]byte(request.Certificate), []byte(request.Key))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAuditEvent(c, "certificate_import", getSessionUsername(c), getSessionRole(c))
+	c.JSON(http.StatusOK, info)
+}
+
+// removeCertificate is the RESTD DELETE /api/certificate handler. The certificate issued by the local CA is used after it is removed.
+func removeCertificate(c *gin.Context) {
+	if err := certmanager.RemoveCertificate(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAuditEvent(c, "certificate_remove", getSessionUsername(c), getSessionRole(c))
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+}
+
+// getCACertificate is the RESTD GET /api/certificate/ca handler. It downloads the local CA
+// certificate so clients can trust the certificates it issues.
+func getCACertificate(c *gin.Context) {
+	caPEM, err := certmanager.GetCACertificate()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\"ca.crt\"")
+	c.Data(http.StatusOK, "application/x-x509-ca-cert", caPEM)
+}
+
+// createCertificateRequest is the RESTD POST /api/certificate/csr handler. It returns a PEM
+// certificate signing request for a new key that is kept until the signed certificate is imported.
+func createCertificateRequest(c *gin.Context) {
+	var request certmanager.CSRRequest
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	csrPEM, err := certmanager.CreateCSR(request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAuditEvent(c, "certificate_csr", getSessionUsername(c), getSessionRole(c))
+	c.JSON(http.StatusOK, gin.H{"csr": string(csrPEM)})
+}
@@ -0,0 +1,291 @@
+package restd
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// loginPolicy is the accounts loginPolicy settings. After each failed login the next
+// attempt for the username and source address is delayed by DelayMilliseconds doubled
+// for each failure up to MaxDelaySeconds. After MaxFailures the username or address is
+// locked for LockoutSeconds. Failures are forgotten ResetSeconds after the last failure.
+type loginPolicy struct {
+	MaxFailures       int `json:"maxFailures"`
+	LockoutSeconds    int `json:"lockoutSeconds"`
+	DelayMilliseconds int `json:"delayMilliseconds"`
+	MaxDelaySeconds   int `json:"maxDelaySeconds"`
+	ResetSeconds      int `json:"resetSeconds"`
+}
+
+// loginFailures tracks the failed logins for a username or source address
+type loginFailures struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// LockoutStatus is the login throttling status for a username or source address
+type LockoutStatus struct {
+	Locked            bool `json:"locked"`
+	Failures          int  `json:"failures"`
+	RetryAfterSeconds int  `json:"retry_after_seconds"`
+}
+
+var loginFailureTable = make(map[string]*loginFailures)
+var loginFailureMutex sync.Mutex
+
+// getLoginPolicy returns the login policy settings with defaults applied
+func getLoginPolicy() loginPolicy {
+	policy := loginPolicy{MaxFailures: 5, LockoutSeconds: 900, DelayMilliseconds: 1000, MaxDelaySeconds: 60, ResetSeconds: 3600}
+
+	value, err := settings.GetSettings([]string{"accounts", "loginPolicy"})
+	if err != nil {
+		return policy
+	}
+
+	raw, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(raw, &policy)
+	}
+	if err != nil {
+		logger.Warn("Invalid login policy settings: %v\n", err)
+	}
+	return policy
+}
+
+// loginScopeMetrics is the throttling scope for basic auth logins to the metrics endpoint
+const loginScopeMetrics = "metrics"
+
+// loginScopeToken is the throttling scope for requests with an invalid API token
+const loginScopeToken = "token"
+
+// loginFailureKey returns the key used to track the failed logins for a username or
+// address. The scope keeps the failures of different kinds of clients apart so a
+// scraper with stale credentials can not lock the same username out of the admin UI.
+func loginFailureKey(scope string, kind string, value string) string {
+	if scope == "" {
+		return kind + ":" + value
+	}
+	return scope + "-" + kind + ":" + value
+}
+
+// getRemoteAddress returns the address of the peer connected to the socket. It is used
+// instead of c.ClientIP for throttling and auditing since gin takes the client address
+// from the X-Forwarded-For and X-Real-Ip headers which the client can set to anything.
+func getRemoteAddress(c *gin.Context) string {
+	address, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return address
+}
+
+// validateLogin validates the username and password from the argumented request with
+// throttling by username and source address within the argumented scope, which is empty
+// for logins to the admin UI. If the login is throttled or locked the request is aborted
+// with 429 and false is returned without checking the password. The attempt is counted
+// as a failure before the password is checked so parallel attempts can not all get past
+// the throttling, and the failures are cleared if the password is correct.
+func validateLogin(c *gin.Context, scope string, username string, password string) bool {
+	policy := getLoginPolicy()
+	address := getRemoteAddress(c)
+	keys := []string{loginFailureKey(scope, "user", username), loginFailureKey(scope, "address", address)}
+
+	status, locked := reserveLoginAttempt(policy, keys...)
+	if status.RetryAfterSeconds > 0 {
+		action := "login_throttled"
+		if status.Locked {
+			action = "login_locked"
+		}
+		logger.Warn("Login for %s from %s rejected: %s for %d seconds\n", username, address, action, status.RetryAfterSeconds)
+		logAuditEvent(c, action, username, "")
+		c.Header("Retry-After", strconv.Itoa(status.RetryAfterSeconds))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed logins", "lockout": status})
+		return false
+	}
+
+	if validate(username, password) {
+		clearLoginFailures(keys...)
+		return true
+	}
+
+	if locked {
+		logger.Warn("Login locked for %s from %s for %d seconds\n", username, address, policy.LockoutSeconds)
+		logAuditEvent(c, "login_lockout", username, "")
+	} else {
+		logAuditEvent(c, "login_failed", username, "")
+	}
+	return false
+}
+
+// reserveLoginAttempt checks the throttling status for the argumented keys and if the
+// attempt is allowed records it as a failure in the same step. Returns the status, which
+// has a RetryAfterSeconds if the attempt is not allowed, and true if any of the keys
+// became locked by the attempt.
+func reserveLoginAttempt(policy loginPolicy, keys ...string) (LockoutStatus, bool) {
+	now := time.Now()
+
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	status := lockoutStatus(now, keys...)
+	if status.RetryAfterSeconds > 0 {
+		return status, false
+	}
+	return status, addLoginFailure(policy, now, keys...)
+}
+
+// recordLoginFailure records a failed login for the argumented keys.
+// Returns true if any of the keys became locked.
+func recordLoginFailure(policy loginPolicy, keys ...string) bool {
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	return addLoginFailure(policy, time.Now(), keys...)
+}
+
+// addLoginFailure adds a failed login for the argumented keys. Returns true if any of
+// the keys became locked. The caller must hold the loginFailureMutex.
+func addLoginFailure(policy loginPolicy, now time.Time, keys ...string) bool {
+	locked := false
+
+	pruneLoginFailures(policy, now)
+
+	for _, key := range keys {
+		entry := loginFailureTable[key]
+		if entry == nil {
+			entry = &loginFailures{Key: key}
+			loginFailureTable[key] = entry
+		}
+
+		entry.Failures++
+		entry.LastFailure = now
+
+		delay := time.Duration(policy.DelayMilliseconds) * time.Millisecond
+		for i := 1; i < entry.Failures && delay < time.Duration(policy.MaxDelaySeconds)*time.Second; i++ {
+			delay *= 2
+		}
+		if maxDelay := time.Duration(policy.MaxDelaySeconds) * time.Second; delay > maxDelay {
+			delay = maxDelay
+		}
+		entry.NextAttempt = now.Add(delay)
+
+		if policy.MaxFailures > 0 && entry.Failures >= policy.MaxFailures && entry.LockedUntil.Before(now) {
+			entry.LockedUntil = now.Add(time.Duration(policy.LockoutSeconds) * time.Second)
+			locked = true
+		}
+	}
+
+	return locked
+}
+
+// pruneLoginFailures removes the entries that have not failed within the reset time
+// and are no longer locked. The caller must hold the loginFailureMutex.
+func pruneLoginFailures(policy loginPolicy, now time.Time) {
+	for key, entry := range loginFailureTable {
+		if now.Sub(entry.LastFailure) > time.Duration(policy.ResetSeconds)*time.Second && entry.LockedUntil.Before(now) {
+			delete(loginFailureTable, key)
+		}
+	}
+}
+
+// clearLoginFailures removes the failed login history for the argumented keys
+func clearLoginFailures(keys ...string) {
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	for _, key := range keys {
+		delete(loginFailureTable, key)
+	}
+}
+
+// getLockoutStatus returns the combined throttling status for the argumented keys
+func getLockoutStatus(keys ...string) LockoutStatus {
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	return lockoutStatus(time.Now(), keys...)
+}
+
+// lockoutStatus returns the combined throttling status for the argumented keys.
+// The caller must hold the loginFailureMutex.
+func lockoutStatus(now time.Time, keys ...string) LockoutStatus {
+	var status LockoutStatus
+
+	for _, key := range keys {
+		entry := loginFailureTable[key]
+		if entry == nil {
+			continue
+		}
+
+		if entry.Failures > status.Failures {
+			status.Failures = entry.Failures
+		}
+
+		until := entry.NextAttempt
+		if entry.LockedUntil.After(now) {
+			status.Locked = true
+			if entry.LockedUntil.After(until) {
+				until = entry.LockedUntil
+			}
+		}
+
+		if wait := int(until.Sub(now).Seconds() + 0.999); wait > status.RetryAfterSeconds {
+			status.RetryAfterSeconds = wait
+		}
+	}
+
+	return status
+}
+
+// accountLockouts is the RESTD /api/account/lockouts handler. It returns the
+// usernames and source addresses with failed logins.
+func accountLockouts(c *gin.Context) {
+	loginFailureMutex.Lock()
+	list := make([]loginFailures, 0, len(loginFailureTable))
+	for _, entry := range loginFailureTable {
+		list = append(list, *entry)
+	}
+	loginFailureMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	c.JSON(http.StatusOK, list)
+}
+
+// accountUnlock is the RESTD /api/account/unlock handler. It clears the failed logins
+// for the username and address query parameters, or for everything if neither is passed.
+func accountUnlock(c *gin.Context) {
+	username := c.Query("username")
+	address := c.Query("address")
+
+	var keys []string
+	if username != "" {
+		keys = append(keys, loginFailureKey("", "user", username), loginFailureKey(loginScopeMetrics, "user", username))
+	}
+	if address != "" {
+		keys = append(keys, loginFailureKey("", "address", address), loginFailureKey(loginScopeMetrics, "address", address), loginFailureKey(loginScopeToken, "address", address))
+	}
+
+	if len(keys) == 0 {
+		loginFailureMutex.Lock()
+		loginFailureTable = make(map[string]*loginFailures)
+		loginFailureMutex.Unlock()
+	} else {
+		clearLoginFailures(keys...)
+	}
+
+	logger.Info("Logins unlocked by %s: %v\n", getSessionUsername(c), keys)
+	logAuditEvent(c, "login_unlock", getSessionUsername(c), getSessionRole(c))
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+}
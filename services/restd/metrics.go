@@ -0,0 +1,372 @@
+package restd
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/stats"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// metricsContentType is the content type for the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// startTime is used to calculate the process uptime
+var startTime = time.Now()
+
+// metricsSettings holds the /metrics endpoint configuration from the system/metrics settings
+type metricsSettings struct {
+	Enabled      bool   `json:"enabled"`
+	AuthRequired bool   `json:"authRequired"`
+	Token        string `json:"token"`
+}
+
+// metricsWriter renders metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	buffer bytes.Buffer
+}
+
+// family writes the HELP and TYPE lines that must precede the samples of a metric
+func (m *metricsWriter) family(name string, kind string, help string) {
+	m.buffer.WriteString("# HELP " + name + " " + help + "\n")
+	m.buffer.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// sample writes a single sample. The labels are passed as name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.buffer.WriteString(name)
+	if len(labels) > 1 {
+		m.buffer.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i != 0 {
+				m.buffer.WriteString(",")
+			}
+			m.buffer.WriteString(labels[i] + "=\"" + escapeLabelValue(labels[i+1]) + "\"")
+		}
+		m.buffer.WriteString("}")
+	}
+	m.buffer.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+// metric writes the HELP and TYPE lines followed by a single unlabeled sample
+func (m *metricsWriter) metric(name string, kind string, help string, value float64) {
+	m.family(name, kind, help)
+	m.sample(name, value)
+}
+
+// escapeLabelValue escapes the backslash, quote and newline characters in a label value
+func escapeLabelValue(value string) string {
+	if !strings.ContainsAny(value, "\\\"\n") {
+		return value
+	}
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+// formatMetricValue formats a sample value including the special float values
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// getMetricsSettings returns the metrics settings with defaults applied
+func getMetricsSettings() metricsSettings {
+	config := metricsSettings{Enabled: true, AuthRequired: true}
+
+	value, err := settings.GetSettings([]string{"system", "metrics"})
+	if err != nil {
+		return config
+	}
+
+	raw, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(raw, &config)
+	}
+	if err != nil {
+		logger.Warn("Invalid metrics settings: %v\n", err)
+	}
+	return config
+}
+
+// metricsAuthRequired is the middleware for the metrics endpoint. A scraper can
+// authenticate with the bearer token from the metrics settings or with basic
+// auth credentials. Authentication can also be disabled for trusted networks.
+func metricsAuthRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := getMetricsSettings()
+		if !config.Enabled {
+			c.JSON(http.StatusNotFound, gin.H{"error": "metrics are disabled"})
+			c.Abort()
+			return
+		}
+
+		if config.Token != "" {
+			auth := c.Request.Header.Get("Authorization")
+			if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(config.Token)) == 1 {
+				c.Next()
+				return
+			}
+		}
+
+		if !config.AuthRequired {
+			c.Next()
+			return
+		}
+
+		if sessions.Default(c).Get("username") != nil || checkAuthLocal(c) {
+			c.Next()
+			return
+		}
+
+		if username, password, ok := c.Request.BasicAuth(); ok && validateLogin(c, loginScopeMetrics, username, password) {
+			c.Next()
+			return
+		}
+		if c.IsAborted() {
+			return
+		}
+
+		c.Header("WWW-Authenticate", "Basic realm=\"metrics\"")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization failed"})
+		c.Abort()
+	}
+}
+
+// metricsHandler returns the current metrics in the Prometheus text exposition format
+func metricsHandler(c *gin.Context) {
+	var m metricsWriter
+
+	writeProcessMetrics(&m)
+	writeCounterMetrics(&m)
+	writeDispatchMetrics(&m)
+	writeOverseerMetrics(&m)
+	writeReportsMetrics(&m)
+	writeInterfaceMetrics(&m)
+
+	c.Data(http.StatusOK, metricsContentType, m.buffer.Bytes())
+}
+
+// writeCounterMetrics writes the overseer counters
+func writeCounterMetrics(m *metricsWriter) {
+	counters := overseer.GetCounters()
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// some overseer counters are decremented so they are not exposed as counters
+	m.family("packetd_overseer_counter", "untyped", "The value of the named overseer counter.")
+	for _, name := range names {
+		m.sample("packetd_overseer_counter", float64(counters[name]), "name", name)
+	}
+}
+
+// writeDispatchMetrics writes the session and conntrack table sizes
+func writeDispatchMetrics(m *metricsWriter) {
+	m.metric("packetd_sessions", "gauge", "The number of entries in the session table.", float64(dispatch.GetSessionTableSize()))
+	m.metric("packetd_conntrack_entries", "gauge", "The number of entries in the conntrack table.", float64(dispatch.GetConntrackTableSize()))
+}
+
+// writeOverseerMetrics writes the overseer labeled counters, gauges and histograms.
+// The unlabeled counters are written by writeCounterMetrics.
+func writeOverseerMetrics(m *metricsWriter) {
+	snapshot := overseer.GetSnapshot()
+
+	var names []string
+	counters := make(map[string][]overseer.CounterSample)
+	for _, item := range snapshot.Counters {
+		if len(item.Labels) == 0 {
+			continue
+		}
+		if _, found := counters[item.Name]; !found {
+			names = append(names, item.Name)
+		}
+		counters[item.Name] = append(counters[item.Name], item)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := metricName(name) + "_total"
+		m.family(family, "counter", "The value of the overseer "+name+" counter.")
+		for _, item := range counters[name] {
+			m.sample(family, float64(item.Value), labelPairs(item.Labels)...)
+		}
+	}
+
+	names = nil
+	gauges := make(map[string][]overseer.GaugeSample)
+	for _, item := range snapshot.Gauges {
+		if _, found := gauges[item.Name]; !found {
+			names = append(names, item.Name)
+		}
+		gauges[item.Name] = append(gauges[item.Name], item)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := metricName(name)
+		m.family(family, "gauge", "The value of the overseer "+name+" gauge.")
+		for _, item := range gauges[name] {
+			m.sample(family, item.Value, labelPairs(item.Labels)...)
+		}
+	}
+
+	names = nil
+	histograms := make(map[string][]overseer.HistogramSample)
+	for _, item := range snapshot.Histograms {
+		if _, found := histograms[item.Name]; !found {
+			names = append(names, item.Name)
+		}
+		histograms[item.Name] = append(histograms[item.Name], item)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := metricName(name)
+		m.family(family, "histogram", "The distribution of the overseer "+name+" histogram.")
+		for _, item := range histograms[name] {
+			labels := labelPairs(item.Labels)
+			for i, bound := range item.Bounds {
+				m.sample(family+"_bucket", float64(item.Counts[i]), append(labels, "le", formatMetricValue(bound))...)
+			}
+			m.sample(family+"_bucket", float64(item.Count), append(labels, "le", "+Inf")...)
+			m.sample(family+"_sum", item.Sum, labels...)
+			m.sample(family+"_count", float64(item.Count), labels...)
+		}
+	}
+}
+
+// labelPairs converts overseer labels to the sorted name, value pairs used by sample
+func labelPairs(labels overseer.Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// leave room for the histogram le label so appending it does not reallocate
+	pairs := make([]string, 0, 2*len(names)+2)
+	for _, name := range names {
+		pairs = append(pairs, name, labels[name])
+	}
+	return pairs
+}
+
+// metricName returns the Prometheus metric name for an overseer metric name
+func metricName(name string) string {
+	return "packetd_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// writeReportsMetrics writes the reports queue depths and the number of open queries
+func writeReportsMetrics(m *metricsWriter) {
+	queues := reports.GetQueueStats()
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m.family("packetd_reports_queue_length", "gauge", "The number of items waiting in the reports queue.")
+	for _, name := range names {
+		m.sample("packetd_reports_queue_length", float64(queues[name].Length), "queue", name)
+	}
+	m.family("packetd_reports_queue_capacity", "gauge", "The capacity of the reports queue.")
+	for _, name := range names {
+		m.sample("packetd_reports_queue_capacity", float64(queues[name].Capacity), "queue", name)
+	}
+
+	m.metric("packetd_reports_open_queries", "gauge", "The number of open report queries.", float64(reports.GetOpenQueryCount()))
+}
+
+// writeInterfaceMetrics writes the latency and jitter averages for each interface
+func writeInterfaceMetrics(m *metricsWriter) {
+	list := stats.GetInterfaceLatencyStats()
+	sort.Slice(list, func(i, j int) bool { return list[i].InterfaceID < list[j].InterfaceID })
+
+	labels := func(item stats.InterfaceLatencyStats, extra ...string) []string {
+		return append([]string{
+			"interface_id", strconv.Itoa(item.InterfaceID),
+			"interface", item.InterfaceName,
+			"device", item.DeviceName,
+			"wan", strconv.FormatBool(item.Wan),
+		}, extra...)
+	}
+
+	m.family("packetd_interface_latency_milliseconds", "gauge", "The exponential average latency of the interface.")
+	for _, item := range list {
+		for _, source := range []struct {
+			name      string
+			collector stats.Collector
+		}{{"combined", item.Combined}, {"passive", item.Passive}, {"active", item.Active}} {
+			m.sample("packetd_interface_latency_milliseconds", source.collector.Latency1Min.Value, labels(item, "source", source.name, "window", "1m")...)
+			m.sample("packetd_interface_latency_milliseconds", source.collector.Latency5Min.Value, labels(item, "source", source.name, "window", "5m")...)
+			m.sample("packetd_interface_latency_milliseconds", source.collector.Latency15Min.Value, labels(item, "source", source.name, "window", "15m")...)
+		}
+	}
+
+	m.family("packetd_interface_latency_stddev_milliseconds", "gauge", "The standard deviation of the interface latency.")
+	for _, item := range list {
+		m.sample("packetd_interface_latency_stddev_milliseconds", item.Combined.LatencyVariance.StdDeviation, labels(item, "source", "combined")...)
+		m.sample("packetd_interface_latency_stddev_milliseconds", item.Passive.LatencyVariance.StdDeviation, labels(item, "source", "passive")...)
+		m.sample("packetd_interface_latency_stddev_milliseconds", item.Active.LatencyVariance.StdDeviation, labels(item, "source", "active")...)
+	}
+
+	m.family("packetd_interface_jitter_milliseconds", "gauge", "The exponential average jitter of the interface.")
+	for _, item := range list {
+		m.sample("packetd_interface_jitter_milliseconds", item.Jitter.Latency1Min.Value, labels(item, "window", "1m")...)
+		m.sample("packetd_interface_jitter_milliseconds", item.Jitter.Latency5Min.Value, labels(item, "window", "5m")...)
+		m.sample("packetd_interface_jitter_milliseconds", item.Jitter.Latency15Min.Value, labels(item, "window", "15m")...)
+	}
+
+	m.family("packetd_interface_ping_timeouts_total", "counter", "The number of active latency pings that timed out.")
+	for _, item := range list {
+		m.sample("packetd_interface_ping_timeouts_total", float64(item.PingTimeouts), labels(item)...)
+	}
+}
+
+// writeProcessMetrics writes the Go runtime and process statistics
+func writeProcessMetrics(m *metricsWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	m.metric("packetd_uptime_seconds", "gauge", "The number of seconds since packetd started.", time.Since(startTime).Seconds())
+	m.metric("go_goroutines", "gauge", "The number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	m.metric("go_memstats_alloc_bytes", "gauge", "The number of bytes allocated and still in use.", float64(mem.Alloc))
+	m.metric("go_memstats_alloc_bytes_total", "counter", "The total number of bytes allocated, even if freed.", float64(mem.TotalAlloc))
+	m.metric("go_memstats_sys_bytes", "gauge", "The number of bytes obtained from the system.", float64(mem.Sys))
+	m.metric("go_memstats_heap_alloc_bytes", "gauge", "The number of heap bytes allocated and still in use.", float64(mem.HeapAlloc))
+	m.metric("go_memstats_heap_sys_bytes", "gauge", "The number of heap bytes obtained from the system.", float64(mem.HeapSys))
+	m.metric("go_memstats_heap_inuse_bytes", "gauge", "The number of heap bytes that are in use.", float64(mem.HeapInuse))
+	m.metric("go_memstats_heap_objects", "gauge", "The number of allocated objects.", float64(mem.HeapObjects))
+	m.metric("go_memstats_mallocs_total", "counter", "The total number of mallocs.", float64(mem.Mallocs))
+	m.metric("go_memstats_frees_total", "counter", "The total number of frees.", float64(mem.Frees))
+	m.metric("go_memstats_next_gc_bytes", "gauge", "The number of heap bytes when the next garbage collection will take place.", float64(mem.NextGC))
+	m.metric("go_memstats_gc_cycles_total", "counter", "The number of completed garbage collection cycles.", float64(mem.NumGC))
+	m.metric("go_memstats_gc_pause_seconds_total", "counter", "The total time spent in garbage collection pauses.", float64(mem.PauseTotalNs)/1e9)
+	m.metric("go_memstats_last_gc_time_seconds", "gauge", "The number of seconds since 1970 of the last garbage collection.", float64(mem.LastGC)/1e9)
+}
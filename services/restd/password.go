@@ -0,0 +1,293 @@
+package restd
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/md5_crypt"    // MD5 used to verify legacy passwords
+	_ "github.com/GehirnInc/crypt/sha512_crypt" // SHA-512 used to hash and verify passwords
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordAlgorithmSHA512 hashes passwords with SHA-512-crypt in passwordHashSHA512
+const PasswordAlgorithmSHA512 = "sha512"
+
+// PasswordAlgorithmBcrypt hashes passwords with bcrypt in passwordHashBcrypt
+const PasswordAlgorithmBcrypt = "bcrypt"
+
+// passwordAlgorithmMD5 is the legacy MD5-crypt hash in passwordHashMD5 that is only verified
+const passwordAlgorithmMD5 = "md5"
+
+// passwordHashFields maps each algorithm to the credentials field that stores the hash
+var passwordHashFields = map[string]string{
+	PasswordAlgorithmBcrypt: "passwordHashBcrypt",
+	PasswordAlgorithmSHA512: "passwordHashSHA512",
+	passwordAlgorithmMD5:    "passwordHashMD5",
+}
+
+// passwordVerifyOrder is the order the hashes are checked, strongest first
+var passwordVerifyOrder = []string{PasswordAlgorithmBcrypt, PasswordAlgorithmSHA512, passwordAlgorithmMD5}
+
+// passwordPolicy is the accounts passwordPolicy settings. Algorithm is used to hash new
+// passwords and to upgrade weaker hashes on login. If RejectMD5 is true accounts that
+// only have an MD5-crypt hash can not log in until the password is set again.
+type passwordPolicy struct {
+	Algorithm  string `json:"algorithm"`
+	RejectMD5  bool   `json:"rejectMD5"`
+	BcryptCost int    `json:"bcryptCost"`
+}
+
+// getPasswordPolicy returns the password policy settings with defaults applied
+func getPasswordPolicy() passwordPolicy {
+	policy := passwordPolicy{Algorithm: PasswordAlgorithmSHA512, BcryptCost: bcrypt.DefaultCost}
+
+	value, err := settings.GetSettings([]string{"accounts", "passwordPolicy"})
+	if err != nil {
+		return policy
+	}
+
+	raw, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(raw, &policy)
+	}
+	if err != nil {
+		logger.Warn("Invalid password policy settings: %v\n", err)
+	}
+	if policy.Algorithm != PasswordAlgorithmSHA512 && policy.Algorithm != PasswordAlgorithmBcrypt {
+		logger.Warn("Invalid password policy algorithm: %s\n", policy.Algorithm)
+		policy.Algorithm = PasswordAlgorithmSHA512
+	}
+	if policy.BcryptCost < bcrypt.MinCost || policy.BcryptCost > bcrypt.MaxCost {
+		policy.BcryptCost = bcrypt.DefaultCost
+	}
+	return policy
+}
+
+// hashPassword hashes the password with the policy algorithm and returns
+// the credentials field name and the hash
+func hashPassword(password string, policy passwordPolicy) (string, string, error) {
+	return hashPasswordAlgorithm(password, policy.Algorithm, policy)
+}
+
+// hashPasswordAlgorithm hashes the password with the argumented algorithm and returns
+// the credentials field name and the hash. MD5-crypt is only used to keep the legacy
+// hash of an account current when its password is changed.
+func hashPasswordAlgorithm(password string, algorithm string, policy passwordPolicy) (string, string, error) {
+	switch algorithm {
+	case PasswordAlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), policy.BcryptCost)
+		if err != nil {
+			return "", "", err
+		}
+		return passwordHashFields[PasswordAlgorithmBcrypt], string(hash), nil
+	case PasswordAlgorithmSHA512:
+		hash, err := crypt.SHA512.New().Generate([]byte(password), nil)
+		if err != nil {
+			return "", "", err
+		}
+		return passwordHashFields[PasswordAlgorithmSHA512], hash, nil
+	case passwordAlgorithmMD5:
+		hash, err := crypt.MD5.New().Generate([]byte(password), nil)
+		if err != nil {
+			return "", "", err
+		}
+		return passwordHashFields[passwordAlgorithmMD5], hash, nil
+	}
+	return "", "", errors.New("Unknown password algorithm: " + algorithm)
+}
+
+// verifyPassword checks the password against the strongest hash in the credentials.
+// Returns the algorithm of the hash that was checked and any verification error.
+func verifyPassword(credentials map[string]interface{}, password string, policy passwordPolicy) (string, error) {
+	for _, algorithm := range passwordVerifyOrder {
+		value, found := credentials[passwordHashFields[algorithm]]
+		if !found || value == nil {
+			continue
+		}
+
+		hash, ok := value.(string)
+		if !ok || hash == "" {
+			logger.Warn("Invalid %s type\n", passwordHashFields[algorithm])
+			continue
+		}
+
+		switch algorithm {
+		case PasswordAlgorithmBcrypt:
+			return algorithm, bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		case PasswordAlgorithmSHA512:
+			return algorithm, crypt.SHA512.New().Verify(hash, []byte(password))
+		default:
+			if policy.RejectMD5 {
+				return algorithm, errors.New("MD5-crypt passwords are not allowed by the password policy")
+			}
+			return algorithm, crypt.MD5.New().Verify(hash, []byte(password))
+		}
+	}
+
+	return "", errors.New("No password hash")
+}
+
+// passwordUpgrades records the users and algorithms of the password hash upgrades that
+// have been started, so each upgrade is only tried once even if it fails
+var passwordUpgrades = make(map[string]bool)
+var passwordUpgradesMutex sync.Mutex
+
+// startPasswordUpgrade upgrades the password hash for the argumented user in the
+// background if the credentials do not have a hash using the policy algorithm. It is
+// called after a form or basic auth login since that is the only time the cleartext
+// password is available, and never delays or fails the login.
+func startPasswordUpgrade(username string, password string) {
+	policy := getPasswordPolicy()
+
+	credentialsJSON := getCredentials(username)
+	if credentialsJSON == nil || credentialsJSON[passwordHashFields[policy.Algorithm]] != nil {
+		return
+	}
+
+	key := username + ":" + policy.Algorithm
+	passwordUpgradesMutex.Lock()
+	started := passwordUpgrades[key]
+	passwordUpgrades[key] = true
+	passwordUpgradesMutex.Unlock()
+	if started {
+		return
+	}
+
+	go func() {
+		if err := upgradePasswordHash(username, password, policy); err != nil {
+			logger.Warn("Failed to upgrade password hash to %s for %v: %v\n", policy.Algorithm, username, err)
+		} else {
+			logger.Info("Upgraded password hash to %s for %v\n", policy.Algorithm, username)
+		}
+	}()
+}
+
+// upgradePasswordHash adds a hash of the password using the policy algorithm to the
+// credentials for the argumented user. The other hashes are kept as described for
+// setPasswordHashes since the password has not changed.
+func upgradePasswordHash(username string, password string, policy passwordPolicy) error {
+	field, hash, err := hashPassword(password, policy)
+	if err != nil {
+		return err
+	}
+
+	credentialsJSON, err := settings.GetCurrentSettings([]string{"accounts", "credentials"})
+	if err != nil {
+		return err
+	}
+	credentialsSlice, ok := credentialsJSON.([]interface{})
+	if !ok {
+		return errors.New("Invalid type of accounts settings: " + reflect.TypeOf(credentialsJSON).String())
+	}
+
+	for _, item := range credentialsSlice {
+		cred, ok := item.(map[string]interface{})
+		if !ok || cred["username"] != username {
+			continue
+		}
+
+		// the password may have been changed since the login
+		if _, err = verifyPassword(cred, password, policy); err != nil {
+			return errors.New("Password changed before the hash upgrade")
+		}
+		if policy.RejectMD5 {
+			delete(cred, passwordHashFields[passwordAlgorithmMD5])
+		}
+		cred[field] = hash
+
+		_, err = settings.SetSettingsAs([]string{"accounts", "credentials"}, credentialsSlice, false, settings.RevisionInfo{User: username, Comment: "Upgrade password hash"})
+		return err
+	}
+
+	return errors.New("Credentials not found for user " + username)
+}
+
+// hashCleartextPasswords replaces the passwordCleartext field in any accounts credentials
+// within the settings being saved with hashes from setPasswordHashes so cleartext
+// passwords are never written to the settings file. The passwordCleartext field can
+// only be hashed when the whole credentials entry is written, so writing it anywhere
+// else, including directly by its own path, is rejected.
+func hashCleartextPasswords(segments []string, value interface{}) error {
+	policy := getPasswordPolicy()
+
+	if len(segments) > 0 && segments[len(segments)-1] == "passwordCleartext" {
+		return errors.New("passwordCleartext can only be set in an accounts credentials entry")
+	}
+
+	var walk func(path []string, node interface{}) error
+	walk = func(path []string, node interface{}) error {
+		switch item := node.(type) {
+		case map[string]interface{}:
+			password, found := item["passwordCleartext"]
+			if found && !isCredentialsPath(path) {
+				return errors.New("passwordCleartext can only be set in an accounts credentials entry")
+			}
+			if found {
+				text, ok := password.(string)
+				if !ok || text == "" {
+					return errors.New("Invalid passwordCleartext")
+				}
+				if err := setPasswordHashes(item, text, policy); err != nil {
+					return err
+				}
+				delete(item, "passwordCleartext")
+			}
+			for key, child := range item {
+				if err := walk(append(path, key), child); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, child := range item {
+				if err := walk(append(path, "*"), child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return walk(append([]string{}, segments...), value)
+}
+
+// setPasswordHashes sets the hashes of a new password in the argumented credentials.
+// Every hash field the credentials already have is kept, since other consumers of the
+// credentials may use them, but is replaced with a hash of the new password so the old
+// password stops working. A hash using the policy algorithm is always added, and the
+// MD5-crypt hash is removed if the policy rejects it.
+func setPasswordHashes(credentials map[string]interface{}, password string, policy passwordPolicy) error {
+	hashes := make(map[string]string)
+
+	for _, algorithm := range passwordVerifyOrder {
+		field := passwordHashFields[algorithm]
+		if algorithm != policy.Algorithm && credentials[field] == nil {
+			continue
+		}
+		if algorithm == passwordAlgorithmMD5 && policy.RejectMD5 {
+			continue
+		}
+		_, hash, err := hashPasswordAlgorithm(password, algorithm, policy)
+		if err != nil {
+			return err
+		}
+		hashes[field] = hash
+	}
+
+	for _, field := range passwordHashFields {
+		delete(credentials, field)
+	}
+	for field, hash := range hashes {
+		credentials[field] = hash
+	}
+	return nil
+}
+
+// isCredentialsPath returns true if the settings path is an entry in accounts/credentials
+func isCredentialsPath(path []string) bool {
+	return len(path) == 3 && path[0] == "accounts" && path[1] == "credentials"
+}
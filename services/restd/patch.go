@@ -0,0 +1,110 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// patchSettings is the RESTD PATCH /api/settings/*path handler. The body is a RFC 6902
+// JSON Patch with pointers relative to the path. All operations are applied with a
+// single sync-settings run, and none are applied if any of them fail.
+func patchSettings(c *gin.Context) {
+	var segments []string
+	path := c.Param("path")
+
+	if path == "" {
+		segments = nil
+	} else {
+		segments = RemoveEmptyStrings(strings.Split(path, "/"))
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var patch []settings.PatchOperation
+	if err = json.Unmarshal(body, &patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Patch: " + err.Error()})
+		return
+	}
+
+	// never save cleartext passwords in the settings
+	for _, operation := range patch {
+		if operation.Op == "remove" || operation.Op == "test" {
+			continue
+		}
+		tokens, err := settings.SplitJSONPointer(operation.Path)
+		if err == nil {
+			err = hashCleartextPasswords(append(append([]string{}, segments...), tokens...), operation.Value)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	forceSync, _ := strconv.ParseBool(c.Query("force"))
+
+	oldValue := getSettingsForAudit(segments)
+	jsonResult, err := settings.PatchSettings(segments, patch, forceSync, getRevisionInfo(c))
+	newValue := oldValue
+	if err == nil {
+		newValue = getSettingsForAudit(segments)
+	}
+	auditSettingsChange(c, "patch", segments, oldValue, newValue, jsonResult, err)
+	writeSettingsResult(c, jsonResult, err)
+}
+
+// getIfMatch returns the settings ETag from the If-Match header or an empty string if
+// there is no header or it is "*". Only a single strong entity tag is supported.
+func getIfMatch(c *gin.Context) string {
+	value := strings.TrimSpace(c.GetHeader("If-Match"))
+	if value == "*" {
+		return ""
+	}
+	return strings.Trim(value, "\"")
+}
+
+// setETagHeader sets the ETag response header to the argumented settings ETag
+func setETagHeader(c *gin.Context, etag string) {
+	if etag != "" {
+		c.Header("ETag", "\""+etag+"\"")
+	}
+}
+
+// writeSettingsResult writes the response of a settings change. Changes based on an old
+// ETag get 412 Precondition Failed, invalid patches and settings that fail validation get
+// 400 Bad Request, and successful changes return the new ETag.
+func writeSettingsResult(c *gin.Context, jsonResult interface{}, err error) {
+	if err == settings.ErrSettingsModified {
+		c.JSON(http.StatusPreconditionFailed, jsonResult)
+		return
+	}
+	if _, ok := err.(*settings.PatchError); ok {
+		c.JSON(http.StatusBadRequest, jsonResult)
+		return
+	}
+	if _, ok := err.(settings.ValidationErrors); ok {
+		c.JSON(http.StatusBadRequest, jsonResult)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, jsonResult)
+		return
+	}
+
+	if result, ok := jsonResult.(map[string]interface{}); ok {
+		if etag, ok := result["etag"].(string); ok {
+			setETagHeader(c, etag)
+		}
+	}
+	c.JSON(http.StatusOK, jsonResult)
+}
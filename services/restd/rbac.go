@@ -0,0 +1,251 @@
+package restd
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// RoleReadOnly can view settings, status, and reports
+const RoleReadOnly = "readonly"
+
+// RoleOperator can also perform operational actions like killing sessions and renewing DHCP
+const RoleOperator = "operator"
+
+// RoleAdmin has full access including settings changes, upgrades, and reboots
+const RoleAdmin = "admin"
+
+// roleRanks orders the roles so a role has all permissions of the roles below it
+var roleRanks = map[string]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// routePermission is the minimum role required for a method and gin route pattern
+type routePermission struct {
+	method  string
+	pattern string
+	role    string
+}
+
+// routePermissions lists the minimum role required for each method and route pattern.
+// The first matching entry is used so more specific patterns must come first. Routes
+// that are not in the list require RoleReadOnly for GET and RoleAdmin for everything
+// else so new routes are safe until they are added here.
+var routePermissions = []routePermission{
+	{"GET", "/api/settings/accounts/*path", RoleAdmin},
+	{"GET", "/api/settings/revisions/*path", RoleAdmin},
+
+	{"POST", "/api/settings", RoleAdmin},
+	{"POST", "/api/settings/*path", RoleAdmin},
+	{"DELETE", "/api/settings", RoleAdmin},
+	{"DELETE", "/api/settings/*path", RoleAdmin},
+	{"PATCH", "/api/settings", RoleAdmin},
+	{"PATCH", "/api/settings/*path", RoleAdmin},
+	{"GET", "/api/logging/:logtype", RoleOperator},
+
+	{"GET", "/api/account/lockouts", RoleAdmin},
+	{"POST", "/api/account/unlock", RoleAdmin},
+	{"GET", "/api/audit", RoleAdmin},
+	{"GET", "/api/tokens", RoleAdmin},
+	{"POST", "/api/tokens", RoleAdmin},
+	{"DELETE", "/api/tokens/:id", RoleAdmin},
+
+	{"GET", "/api/reports/snapshot", RoleAdmin},
+	{"POST", "/api/reports/create_query", RoleReadOnly},
+	{"POST", "/api/reports/close_query/:query_id", RoleReadOnly},
+	{"POST", "/api/reports/cancel_query/:query_id", RoleReadOnly},
+	{"POST", "/api/reports/export", RoleReadOnly},
+	{"POST", "/api/reports/validate", RoleReadOnly},
+
+	{"POST", "/api/warehouse/capture", RoleAdmin},
+	{"POST", "/api/warehouse/close", RoleAdmin},
+	{"POST", "/api/warehouse/playback", RoleAdmin},
+	{"POST", "/api/warehouse/cleanup", RoleAdmin},
+	{"POST", "/api/control/traffic", RoleAdmin},
+
+	{"POST", "/api/netspace/request", RoleOperator},
+	{"POST", "/api/netspace/check", RoleReadOnly},
+
+	{"POST", "/api/sessions/:ctid/kill", RoleOperator},
+	{"POST", "/api/sessions/:ctid/block", RoleOperator},
+
+	{"GET", "/api/wireguard/keypair", RoleAdmin},
+	{"POST", "/api/wireguard/publickey", RoleReadOnly},
+
+	{"GET", "/api/logger/:source", RoleAdmin},
+	{"GET", "/api/debug", RoleOperator},
+	{"GET", "/api/debug/json", RoleOperator},
+	{"POST", "/api/gc", RoleAdmin},
+
+	{"POST", "/api/fetch-licenses", RoleOperator},
+	{"POST", "/api/factory-reset", RoleAdmin},
+	{"POST", "/api/sysupgrade", RoleAdmin},
+	{"POST", "/api/upgrade", RoleAdmin},
+	{"POST", "/api/reboot", RoleAdmin},
+	{"POST", "/api/shutdown", RoleAdmin},
+
+	{"POST", "/api/releasedhcp/:device", RoleOperator},
+	{"POST", "/api/renewdhcp/:device", RoleOperator},
+
+	{"GET", "/pprof/*name", RoleAdmin},
+	{"POST", "/pprof/*name", RoleAdmin},
+}
+
+// roleRequired is a middleware handler function that must follow authRequired. It checks the
+// role of the authenticated user against the routePermissions, or the scopes of the API
+// token, and returns 403 if the request does not have permission for the route.
+func roleRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := getSessionUsername(c)
+
+		// API tokens are limited to the routes in their scopes instead of a role
+		if token, ok := getContextAPIToken(c); ok {
+			if tokenAllows(token, c.Request.Method, c.Request.URL.Path) {
+				c.Next()
+				return
+			}
+			logger.Warn("Access denied: token %s scopes %v for %s %s\n", token.Name, token.Scopes, c.Request.Method, c.Request.URL.Path)
+			logAuditEvent(c, "access_denied", username, "")
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied", "scopes": token.Scopes})
+			c.Abort()
+			return
+		}
+
+		role := getSessionRole(c)
+		required := getRoutePermission(c.Request.Method, c.Request.URL.Path)
+
+		if roleRanks[role] >= roleRanks[required] {
+			c.Next()
+			return
+		}
+
+		logger.Warn("Access denied: user %s role %s requires %s for %s %s\n", username, role, required, c.Request.Method, c.Request.URL.Path)
+		logAuditEvent(c, "access_denied", username, role)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied", "role": role, "required": required})
+		c.Abort()
+	}
+}
+
+// getSessionRole returns the role of the authenticated session. Internal sessions are
+// always admin. Otherwise the role comes from the account credentials so changes take
+// effect immediately, limited by the role claim of the JWT used to create the session
+// if there is one.
+func getSessionRole(c *gin.Context) string {
+	if internal, ok := sessions.Default(c).Get("internal").(bool); ok && internal {
+		return RoleAdmin
+	}
+
+	role := getUserRole(getSessionUsername(c))
+	if claim, ok := sessions.Default(c).Get("role").(string); ok && roleRanks[claim] < roleRanks[role] {
+		role = claim
+	}
+	return role
+}
+
+// getUserRole returns the role for the argumented username from the account credentials.
+// Accounts without a role are admin so existing credentials keep working, and accounts
+// with an unknown role get no permissions.
+func getUserRole(username string) string {
+	if username == "" {
+		return ""
+	}
+
+	credentialsJSON := getCredentials(username)
+	if credentialsJSON == nil {
+		return ""
+	}
+
+	value, found := credentialsJSON["role"]
+	if !found || value == nil || value == "" {
+		return RoleAdmin
+	}
+
+	role, ok := value.(string)
+	if !ok || roleRanks[role] == 0 {
+		logger.Warn("Invalid role for user %s: %v\n", username, value)
+		return ""
+	}
+
+	return role
+}
+
+// canReadSecrets returns true if the request can read the accounts and the other secrets
+// in the settings. Only admin sessions can read them, and API tokens never can.
+func canReadSecrets(c *gin.Context) bool {
+	if _, ok := getContextAPIToken(c); ok {
+		return false
+	}
+	return roleRanks[getSessionRole(c)] >= roleRanks[RoleAdmin]
+}
+
+// redactSettings returns a copy of the settings at the argumented path with the
+// accounts removed and the other secrets hidden, for requests that cannot read them
+func redactSettings(segments []string, value interface{}) interface{} {
+	key := ""
+	if len(segments) > 0 {
+		key = segments[len(segments)-1]
+	}
+
+	redacted := redactSettingsValue(key, value)
+	if root, ok := redacted.(map[string]interface{}); ok && len(segments) == 0 {
+		delete(root, "accounts")
+	}
+	return redacted
+}
+
+// getRoutePermission returns the minimum role required for the argumented method and path
+func getRoutePermission(method string, path string) string {
+	for _, route := range routePermissions {
+		if route.method == method && matchRoutePattern(route.pattern, path) {
+			return route.role
+		}
+	}
+
+	if method == http.MethodGet || method == http.MethodHead {
+		return RoleReadOnly
+	}
+	return RoleAdmin
+}
+
+// matchRoutePattern returns true if the path matches the gin route pattern. A :name
+// segment matches any single segment and a *name segment matches the rest of the path.
+// Empty path segments are ignored since the settings handlers ignore them.
+func matchRoutePattern(pattern string, path string) bool {
+	patternParts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	pathParts := RemoveEmptyStrings(strings.Split(path, "/"))
+
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "*") {
+			return true
+		}
+		if i >= len(pathParts) {
+			return false
+		}
+		if !strings.HasPrefix(part, ":") && part != pathParts[i] {
+			return false
+		}
+	}
+
+	return len(patternParts) == len(pathParts)
+}
+
+// logAuditEvent logs an admin_audit event for the argumented action and request
+func logAuditEvent(c *gin.Context, action string, username string, role string) {
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"action":         action,
+		"username":       username,
+		"role":           role,
+		"method":         c.Request.Method,
+		"path":           c.Request.URL.Path,
+		"client_address": getRemoteAddress(c),
+	}
+	reports.LogEvent(reports.CreateEvent(action, "admin_audit", 1, columns, nil))
+}
@@ -13,16 +13,17 @@ import (
 	"net/http/pprof"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/untangle/packetd/services/appclassmanager"
-	"github.com/untangle/packetd/services/certmanager"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
@@ -67,6 +68,8 @@ func Startup() {
 
 	engine.GET("/ping", pingHandler)
 
+	engine.GET("/metrics", metricsAuthRequired(), metricsHandler)
+
 	engine.POST("/account/login", authRequired())
 	engine.POST("/account/logout", authLogout)
 	engine.GET("/account/logout", authLogout)
@@ -74,6 +77,7 @@ func Startup() {
 
 	api := engine.Group("/api")
 	api.Use(authRequired())
+	api.Use(roleRequired())
 
 	api.GET("/settings", getSettings)
 	api.GET("/settings/*path", getSettings)
@@ -81,6 +85,8 @@ func Startup() {
 	api.POST("/settings/*path", setSettings)
 	api.DELETE("/settings", trimSettings)
 	api.DELETE("/settings/*path", trimSettings)
+	api.PATCH("/settings", patchSettings)
+	api.PATCH("/settings/*path", patchSettings)
 
 	api.GET("/logging/:logtype", getLogOutput)
 
@@ -90,6 +96,12 @@ func Startup() {
 	api.POST("/reports/create_query", reportsCreateQuery)
 	api.GET("/reports/get_data/:query_id", reportsGetData)
 	api.POST("/reports/close_query/:query_id", reportsCloseQuery)
+	api.POST("/reports/cancel_query/:query_id", reportsCancelQuery)
+	api.POST("/reports/export", reportsExport)
+	api.POST("/reports/validate", reportsValidate)
+	api.GET("/reports/library", reportsLibrary)
+	api.GET("/reports/library/:id", reportsLibraryEntry)
+	api.GET("/reports/snapshot", reportsSnapshot)
 
 	api.POST("/warehouse/capture", warehouseCapture)
 	api.POST("/warehouse/close", warehouseClose)
@@ -101,7 +113,22 @@ func Startup() {
 	api.POST("/netspace/request", netspaceRequest)
 	api.POST("/netspace/check", netspaceCheck)
 
+	api.GET("/account/lockouts", accountLockouts)
+	api.POST("/account/unlock", accountUnlock)
+	api.GET("/audit", getAudit)
+	api.GET("/tokens", listAPITokens)
+	api.POST("/tokens", createAPIToken)
+	api.DELETE("/tokens/:id", revokeAPIToken)
+	api.GET("/certificate", getCertificate)
+	api.POST("/certificate", importCertificate)
+	api.DELETE("/certificate", removeCertificate)
+	api.GET("/certificate/ca", getCACertificate)
+	api.POST("/certificate/csr", createCertificateRequest)
+
 	api.GET("/status/sessions", statusSessions)
+	api.GET("/stream/sessions", streamSessions)
+	api.POST("/sessions/:ctid/kill", sessionKill)
+	api.POST("/sessions/:ctid/block", sessionBlock)
 	api.GET("/status/system", statusSystem)
 	api.GET("/status/hardware", statusHardware)
 	api.GET("/status/upgrade", statusUpgradeAvailable)
@@ -128,10 +155,12 @@ func Startup() {
 	api.POST("/wireguard/publickey", wireguardPublicKey)
 
 	api.GET("/classify/applications", getClassifyAppTable)
+	api.GET("/classify/applications/:guid", getClassifyApplication)
 	api.GET("/classify/categories", getClassifyCatTable)
 
 	api.GET("/logger/:source", loggerHandler)
 	api.GET("/debug", debugHandler)
+	api.GET("/debug/json", debugJSONHandler)
 	api.POST("/gc", gcHandler)
 
 	api.POST("/fetch-licenses", fetchLicensesHandler)
@@ -155,6 +184,7 @@ func Startup() {
 
 	prof := engine.Group("/pprof")
 	prof.Use(authRequired())
+	prof.Use(roleRequired())
 
 	prof.GET("/", pprofHandler(pprof.Index))
 	prof.GET("/cmdline", pprofHandler(pprof.Cmdline))
@@ -168,18 +198,26 @@ func Startup() {
 	prof.GET("/mutex", pprofHandler(pprof.Handler("mutex").ServeHTTP))
 	prof.GET("/threadcreate", pprofHandler(pprof.Handler("threadcreate").ServeHTTP))
 
-	// listen and serve on 0.0.0.0:80
-	go engine.Run(":80")
+	loadAPITokenUsage()
+	go apiTokenUsageTask()
 
-	cert, key := certmanager.GetConfiguredCert()
-	go engine.RunTLS(":443", cert, key)
+	// listen and serve on the configured addresses, 0.0.0.0:80 and 0.0.0.0:443 by default
+	startListeners()
 
 	logger.Info("The RestD engine has been started\n")
 }
 
 // Shutdown restd
 func Shutdown() {
-	return
+	stopListeners()
+
+	// Send shutdown signal to apiTokenUsageTask and wait for it to save and return
+	apiTokenShutdown <- true
+	select {
+	case <-apiTokenShutdown:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown apiTokenUsageTask\n")
+	}
 }
 
 // GenerateRandomString generates a random string of the specified length
@@ -285,6 +323,39 @@ func debugHandler(c *gin.Context) {
 	c.Data(http.StatusOK, "text/html; chareset=utf-8", buffer.Bytes())
 }
 
+// maxDebugInterval is the longest interval that can be requested for a metrics delta
+const maxDebugInterval = 60
+
+// debugJSONHandler returns a snapshot of the overseer metrics as JSON. If the interval
+// parameter is passed, a second snapshot is taken after that many seconds and the
+// change between them is returned with the counter rates.
+func debugJSONHandler(c *gin.Context) {
+	intervalStr := c.Query("interval")
+	if intervalStr == "" {
+		var buffer *bytes.Buffer = new(bytes.Buffer)
+		if err := overseer.GenerateJSONReport(buffer); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", buffer.Bytes())
+		return
+	}
+
+	interval, err := strconv.Atoi(intervalStr)
+	if err != nil || interval < 1 || interval > maxDebugInterval {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("interval must be between 1 and %d seconds", maxDebugInterval)})
+		return
+	}
+
+	first := overseer.GetSnapshot()
+	select {
+	case <-time.After(time.Duration(interval) * time.Second):
+	case <-c.Request.Context().Done():
+		return
+	}
+	c.JSON(http.StatusOK, overseer.GetSnapshot().Delta(first))
+}
+
 func gcHandler(c *gin.Context) {
 	logger.Info("Calling FreeOSMemory()...\n")
 	debug.FreeOSMemory()
@@ -309,6 +380,10 @@ func reportsGetData(c *gin.Context) {
 		return
 	}
 
+	if !checkQueryOwner(c, queryID) {
+		return
+	}
+
 	str, err := reports.GetData(queryID)
 	if err != nil {
 		//c.JSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -323,6 +398,33 @@ func reportsGetData(c *gin.Context) {
 	return
 }
 
+// getQueryOwner returns the owner recorded for the queries created by the request.
+// Queries created with an API token belong to the token instead of the token name.
+func getQueryOwner(c *gin.Context) string {
+	if token, ok := getContextAPIToken(c); ok {
+		return "token:" + token.ID
+	}
+	return getSessionUsername(c)
+}
+
+// checkQueryOwner returns true if the request can use the argumented query. Admin sessions
+// can use any query while other users and API tokens can only use their own. Unknown
+// queries are allowed so the handler returns the usual error. Otherwise it responds
+// with 403 and returns false.
+func checkQueryOwner(c *gin.Context, queryID uint64) bool {
+	owner, err := reports.GetQueryOwner(queryID)
+	if err != nil || owner == getQueryOwner(c) {
+		return true
+	}
+	if _, ok := getContextAPIToken(c); !ok && getSessionRole(c) == RoleAdmin {
+		return true
+	}
+
+	logger.Warn("Access denied: %s for query %d owned by %s\n", getSessionUsername(c), queryID, owner)
+	c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+	return false
+}
+
 func reportsCreateQuery(c *gin.Context) {
 	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
@@ -330,7 +432,19 @@ func reportsCreateQuery(c *gin.Context) {
 		return
 	}
 
-	q, err := reports.CreateQuery(string(body))
+	q, err := reports.CreateQuery(string(body), getQueryOwner(c))
+	if err == reports.ErrTooManyQueries {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if verr, ok := err.(reports.ValidationErrors); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": verr.Error(), "errors": verr})
+		return
+	}
+	if _, ok := err.(*reports.QueryError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -352,6 +466,10 @@ func reportsCloseQuery(c *gin.Context) {
 		return
 	}
 
+	if !checkQueryOwner(c, queryID) {
+		return
+	}
+
 	str, err := reports.CloseQuery(queryID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -362,6 +480,163 @@ func reportsCloseQuery(c *gin.Context) {
 	return
 }
 
+// reportsValidate checks the posted ReportEntry without running it
+func reportsValidate(c *gin.Context) {
+	var reportEntry reports.ReportEntry
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &reportEntry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = reports.ValidateReportEntry(&reportEntry)
+	if verr, ok := err.(reports.ValidationErrors); ok {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "errors": verr})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true})
+}
+
+// reportsLibrary returns the validated report definitions from the report library
+func reportsLibrary(c *gin.Context) {
+	c.JSON(http.StatusOK, reports.GetReportLibrary())
+}
+
+// reportsLibraryEntry returns a single report definition from the report library
+func reportsLibraryEntry(c *gin.Context) {
+	entry := reports.GetReportLibraryEntry(c.Param("id"))
+	if entry == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// reportsCancelQuery interrupts a running query and releases its resources
+func reportsCancelQuery(c *gin.Context) {
+	queryStr := c.Param("query_id")
+	if queryStr == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query_id not found"})
+		return
+	}
+	queryID, err := strconv.ParseUint(queryStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkQueryOwner(c, queryID) {
+		return
+	}
+
+	str, err := reports.CancelQuery(queryID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.String(http.StatusOK, str)
+}
+
+// reportsExport streams all rows of the posted ReportEntry in the format specified
+// by the format argument (csv or ndjson) instead of returning them in pages
+func reportsExport(c *gin.Context) {
+	format := strings.ToLower(c.DefaultQuery("format", "csv"))
+	contentType, found := reports.ExportFormats[format]
+	if !found {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported export format"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"report.%s\"", format))
+	c.Status(http.StatusOK)
+
+	err = reports.ExportQuery(c.Request.Context(), string(body), format, c.Writer)
+	if err == reports.ErrTooManyQueries {
+		c.Header("Content-Disposition", "")
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		return
+	}
+
+	logger.Warn("Failed to export report: %s\n", err.Error())
+
+	// the status can only be changed if nothing has been streamed yet
+	if !c.Writer.Written() {
+		status := http.StatusInternalServerError
+		errorJSON := gin.H{"error": err.Error()}
+		if verr, ok := err.(reports.ValidationErrors); ok {
+			status = http.StatusBadRequest
+			errorJSON["errors"] = verr
+		} else if _, ok := err.(*reports.QueryError); ok {
+			status = http.StatusBadRequest
+		}
+		c.Header("Content-Disposition", "")
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(status, errorJSON)
+		return
+	}
+
+	// NDJSON exports end with an error record so the client knows the export is incomplete.
+	// CSV has no place for one so the connection is closed without ending the response.
+	if format == "ndjson" {
+		json.NewEncoder(c.Writer).Encode(gin.H{"error": err.Error()})
+		c.Writer.Flush()
+		return
+	}
+	abortResponse(c)
+}
+
+// abortResponse closes the connection of a response that has already been started so
+// the client sees an incomplete response instead of one that looks complete
+func abortResponse(c *gin.Context) {
+	socket, _, err := c.Writer.Hijack()
+	if err != nil {
+		logger.Warn("Unable to abort response: %v\n", err)
+		return
+	}
+	socket.Close()
+}
+
+// reportsSnapshot downloads a consistent copy of the reports database. The snapshot is
+// written to the backup path and streamed from there so it is not copied to /tmp.
+func reportsSnapshot(c *gin.Context) {
+	file, err := reports.OpenSnapshot(c.Request.Context())
+	if err != nil {
+		logger.Warn("Failed to create reports snapshot: %s\n", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	headers := map[string]string{"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(file.Name()))}
+	c.DataFromReader(http.StatusOK, stat.Size(), "application/vnd.sqlite3", file, headers)
+}
+
 func warehousePlayback(c *gin.Context) {
 	var data map[string]string
 	var body []byte
@@ -524,10 +799,19 @@ func getSettings(c *gin.Context) {
 		segments = RemoveEmptyStrings(strings.Split(path, "/"))
 	}
 
-	jsonResult, err := settings.GetSettings(segments)
+	if isRevisionsRequest(segments) {
+		getSettingsRevisions(c, segments)
+		return
+	}
+
+	jsonResult, etag, err := settings.GetSettingsWithETag(segments)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, jsonResult)
 	} else {
+		if !canReadSecrets(c) {
+			jsonResult = redactSettings(segments, jsonResult)
+		}
+		setETagHeader(c, etag)
 		c.JSON(http.StatusOK, jsonResult)
 	}
 	return
@@ -548,6 +832,9 @@ func getDefaultSettings(c *gin.Context) {
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, jsonResult)
 	} else {
+		if !canReadSecrets(c) {
+			jsonResult = redactSettings(segments, jsonResult)
+		}
 		c.JSON(http.StatusOK, jsonResult)
 	}
 	return
@@ -619,6 +906,15 @@ func setSettings(c *gin.Context) {
 		segments = RemoveEmptyStrings(strings.Split(path, "/"))
 	}
 
+	if isRevisionsRequest(segments) {
+		postSettingsRevisions(c, segments)
+		return
+	}
+	if isValidateRequest(segments) {
+		validateSettings(c, segments)
+		return
+	}
+
 	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -631,6 +927,13 @@ func setSettings(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
 	}
 
+	// never save cleartext passwords in the settings
+	err = hashCleartextPasswords(segments, bodyJSONObject)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	if force != "" {
 		var parseErr error
 		forceSync, parseErr = strconv.ParseBool(force)
@@ -639,12 +942,10 @@ func setSettings(c *gin.Context) {
 			forceSync = false
 		}
 	}
-	jsonResult, err := settings.SetSettings(segments, bodyJSONObject, forceSync)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, jsonResult)
-	} else {
-		c.JSON(http.StatusOK, jsonResult)
-	}
+	oldValue := getSettingsForAudit(segments)
+	jsonResult, err := settings.SetSettingsAs(segments, bodyJSONObject, forceSync, getRevisionInfo(c))
+	auditSettingsChange(c, "set", segments, oldValue, bodyJSONObject, jsonResult, err)
+	writeSettingsResult(c, jsonResult, err)
 	return
 }
 
@@ -658,12 +959,10 @@ func trimSettings(c *gin.Context) {
 		segments = RemoveEmptyStrings(strings.Split(path, "/"))
 	}
 
-	jsonResult, err := settings.TrimSettings(segments)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, jsonResult)
-	} else {
-		c.JSON(http.StatusOK, jsonResult)
-	}
+	oldValue := getSettingsForAudit(segments)
+	jsonResult, err := settings.TrimSettingsAs(segments, getRevisionInfo(c))
+	auditSettingsChange(c, "trim", segments, oldValue, nil, jsonResult, err)
+	writeSettingsResult(c, jsonResult, err)
 	return
 }
 
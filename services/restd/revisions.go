@@ -0,0 +1,131 @@
+package restd
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// settingsRevisionsPath is the first settings path segment used for the revisions API.
+// gin does not allow routes next to the /settings/*path wildcard so the settings
+// handlers pass these requests to the revisions handlers.
+const settingsRevisionsPath = "revisions"
+
+// isRevisionsRequest returns true if the settings path segments are for the revisions API
+func isRevisionsRequest(segments []string) bool {
+	return len(segments) > 0 && segments[0] == settingsRevisionsPath
+}
+
+// getRevisionInfo returns the user, the optional comment query parameter, and the
+// If-Match ETag for a settings change
+func getRevisionInfo(c *gin.Context) settings.RevisionInfo {
+	return settings.RevisionInfo{User: getSessionUsername(c), Comment: c.Query("comment"), ETag: getIfMatch(c)}
+}
+
+// getSettingsRevisions handles GET /api/settings/revisions requests. The base path returns
+// the list of revisions, /N returns the settings of revision N, and /N/diff returns the
+// changes from revision N to the current settings or to the revision in the to query parameter.
+func getSettingsRevisions(c *gin.Context, segments []string) {
+	if len(segments) == 1 {
+		revisions, err := settings.GetRevisions()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, revisions)
+		return
+	}
+
+	revision, ok := getRevisionNumber(c, segments[1])
+	if !ok {
+		return
+	}
+
+	oldSettings, err := settings.GetRevision(revision)
+	if !checkRevisionError(c, err) {
+		return
+	}
+
+	switch {
+	case len(segments) == 2:
+		c.JSON(http.StatusOK, oldSettings)
+	case len(segments) == 3 && segments[2] == "diff":
+		var newSettings interface{}
+		if value := c.Query("to"); value != "" {
+			to, ok := getRevisionNumber(c, value)
+			if !ok {
+				return
+			}
+			newSettings, err = settings.GetRevision(to)
+		} else {
+			newSettings, err = settings.GetSettings(nil)
+		}
+		if !checkRevisionError(c, err) {
+			return
+		}
+		c.JSON(http.StatusOK, redactSettingsChanges(diffSettings("", oldSettings, newSettings)))
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid revisions request"})
+	}
+}
+
+// postSettingsRevisions handles POST /api/settings/revisions/N/rollback requests. It runs
+// sync-settings on revision N and saves it as the settings if sync-settings succeeds.
+// The current accounts are kept unless the accounts query parameter is true, which is
+// audited as a separate rollback_accounts action.
+func postSettingsRevisions(c *gin.Context, segments []string) {
+	if len(segments) != 3 || segments[2] != "rollback" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid revisions request"})
+		return
+	}
+
+	revision, ok := getRevisionNumber(c, segments[1])
+	if !ok {
+		return
+	}
+
+	newSettings, err := settings.GetRevision(revision)
+	if !checkRevisionError(c, err) {
+		return
+	}
+
+	restoreAccounts, _ := strconv.ParseBool(c.Query("accounts"))
+	action := "rollback"
+	if restoreAccounts {
+		action = "rollback_accounts"
+	}
+
+	oldSettings := getSettingsForAudit(nil)
+	if current, ok := oldSettings.(map[string]interface{}); ok && !restoreAccounts {
+		settings.KeepAccounts(newSettings, current)
+	}
+
+	jsonResult, err := settings.RollbackRevision(revision, restoreAccounts, getRevisionInfo(c))
+	auditSettingsChange(c, action, nil, oldSettings, newSettings, jsonResult, err)
+	writeSettingsResult(c, jsonResult, err)
+}
+
+// getRevisionNumber parses a revision number and writes an error response if it is not valid
+func getRevisionNumber(c *gin.Context, value string) (int, bool) {
+	revision, err := strconv.Atoi(value)
+	if err != nil || revision < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision: " + value})
+		return 0, false
+	}
+	return revision, true
+}
+
+// checkRevisionError writes an error response if reading a revision failed
+func checkRevisionError(c *gin.Context, err error) bool {
+	if err == settings.ErrRevisionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
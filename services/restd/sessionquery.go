@@ -0,0 +1,380 @@
+package restd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSessionLimit is the largest page size that can be requested from the sessions API
+const maxSessionLimit = 10000
+
+// sessionDictLookupLimit is the number of sessions below which the dict values are read
+// for each session rather than reading the entire dict sessions table
+const sessionDictLookupLimit = 50
+
+// sessionProtocols maps the protocol names that can be used in the protocol filter to the IP protocol number
+var sessionProtocols = map[string]int{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"gre":    47,
+	"esp":    50,
+	"icmpv6": 58,
+	"sctp":   132,
+}
+
+// sessionSortKey is a field used to sort the sessions
+type sessionSortKey struct {
+	field      string
+	descending bool
+}
+
+// sessionQuery holds the filter, sort, paging, and projection options for the sessions API
+type sessionQuery struct {
+	networks    []*net.IPNet
+	port        int
+	protocol    int
+	iface       int
+	minByteRate float64
+	application string
+	sortKeys    []sessionSortKey
+	limit       int
+	offset      int
+	after       int64
+	fields      []string
+}
+
+// parseSessionQuery parses the query parameters for the sessions API. The filters are:
+// address (IP or CIDR), port, protocol (name or number), interface, application, and
+// min_byte_rate. The sessions are sorted by the comma separated fields in sort, prefixed
+// with a minus for descending order. Paging uses limit and offset, or limit and the after
+// cursor which is the session_id of the last session on the previous page. Fields is a
+// comma separated list of the fields to return.
+func parseSessionQuery(c *gin.Context) (*sessionQuery, error) {
+	var err error
+	query := &sessionQuery{port: -1, protocol: -1, iface: -1, after: -1}
+
+	for _, value := range splitQueryList(c.Query("address")) {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address: %s", value)
+			}
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address: %s", value)
+		}
+		query.networks = append(query.networks, network)
+	}
+
+	if query.port, err = parseQueryInt(c, "port", 0, 65535); err != nil {
+		return nil, err
+	}
+	if query.iface, err = parseQueryInt(c, "interface", 0, 255); err != nil {
+		return nil, err
+	}
+
+	if value := strings.ToLower(c.Query("protocol")); value != "" {
+		if number, found := sessionProtocols[value]; found {
+			query.protocol = number
+		} else if query.protocol, err = parseQueryInt(c, "protocol", 0, 255); err != nil {
+			return nil, err
+		}
+	}
+
+	if value := c.Query("min_byte_rate"); value != "" {
+		if query.minByteRate, err = strconv.ParseFloat(value, 64); err != nil || query.minByteRate < 0 {
+			return nil, fmt.Errorf("Invalid min_byte_rate: %s", value)
+		}
+	}
+
+	query.application = strings.ToLower(c.Query("application"))
+
+	for _, value := range splitQueryList(c.Query("sort")) {
+		key := sessionSortKey{field: value}
+		if strings.HasPrefix(value, "-") {
+			key.field = value[1:]
+			key.descending = true
+		}
+		query.sortKeys = append(query.sortKeys, key)
+	}
+
+	if query.limit, err = parseQueryInt(c, "limit", 1, maxSessionLimit); err != nil {
+		return nil, err
+	}
+	if query.offset, err = parseQueryInt(c, "offset", 0, -1); err != nil {
+		return nil, err
+	}
+	if query.offset < 0 {
+		query.offset = 0
+	}
+
+	if value := c.Query("after"); value != "" {
+		if query.after, err = strconv.ParseInt(value, 10, 64); err != nil || query.after < 0 {
+			return nil, fmt.Errorf("Invalid after: %s", value)
+		}
+		// the cursor is a session_id so it only works with the default order
+		if len(query.sortKeys) != 0 || query.offset != 0 {
+			return nil, fmt.Errorf("The after cursor can not be used with sort or offset")
+		}
+	}
+
+	// always return pages in a stable order
+	if len(query.sortKeys) == 0 && (query.limit >= 0 || query.offset != 0 || query.after >= 0) {
+		query.sortKeys = []sessionSortKey{{field: "session_id"}}
+	}
+
+	query.fields = splitQueryList(c.Query("fields"))
+	return query, nil
+}
+
+// splitQueryList splits a comma separated query parameter ignoring empty values
+func splitQueryList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseQueryInt parses an integer query parameter and checks the range. A max
+// less than zero means there is no upper limit. Returns -1 if the parameter is missing.
+func parseQueryInt(c *gin.Context, name string, min int, max int) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return -1, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min || (max >= 0 && number > max) {
+		return -1, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+	return number, nil
+}
+
+// matchesConntrack returns true if a session parsed from the conntrack table passes
+// the filters that do not require the dict values
+func (q *sessionQuery) matchesConntrack(session map[string]interface{}, byteRate float32) bool {
+	if q.minByteRate > 0 && float64(byteRate) < q.minByteRate {
+		return false
+	}
+
+	if q.protocol >= 0 && fmt.Sprintf("%v", session["ip_protocol"]) != strconv.Itoa(q.protocol) {
+		return false
+	}
+
+	if q.after >= 0 {
+		if sessionID, ok := session["session_id"].(int64); !ok || sessionID <= q.after {
+			return false
+		}
+	}
+
+	if q.iface >= 0 && !matchesInterface(session, q.iface) {
+		return false
+	}
+
+	if q.port >= 0 && !matchesAny(session, strconv.Itoa(q.port), "client_port", "server_port", "client_port_new", "server_port_new") {
+		return false
+	}
+
+	if len(q.networks) != 0 && !q.matchesNetwork(session) {
+		return false
+	}
+
+	return true
+}
+
+// matchesNetwork returns true if any of the session addresses are in one of the filter networks
+func (q *sessionQuery) matchesNetwork(session map[string]interface{}) bool {
+	for _, name := range []string{"client_address", "server_address", "client_address_new", "server_address_new"} {
+		ip, ok := session[name].(net.IP)
+		if !ok || ip == nil {
+			continue
+		}
+		for _, network := range q.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesDict returns true if a session merged with the dict values passes the remaining filters
+func (q *sessionQuery) matchesDict(session map[string]interface{}) bool {
+	if q.application != "" && !matchesValue(session, q.application, false, "application_name", "application_id") {
+		return false
+	}
+	return true
+}
+
+// needsDict returns true if the filters or sort keys use values that are only available
+// after the dict merge. When false the sessions can be sorted and paged before the merge.
+func (q *sessionQuery) needsDict(sample map[string]interface{}) bool {
+	if q.application != "" {
+		return true
+	}
+	for _, key := range q.sortKeys {
+		if _, found := sample[key.field]; !found {
+			return true
+		}
+	}
+	return false
+}
+
+// sortSessions sorts the sessions using the sort keys
+func (q *sessionQuery) sortSessions(sessions []map[string]interface{}) {
+	if len(q.sortKeys) == 0 {
+		return
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		for _, key := range q.sortKeys {
+			result := compareSessionValues(sessions[i][key.field], sessions[j][key.field])
+			if result == 0 {
+				continue
+			}
+			if key.descending {
+				return result > 0
+			}
+			return result < 0
+		}
+		return false
+	})
+}
+
+// page returns the requested page of the sessions
+func (q *sessionQuery) page(sessions []map[string]interface{}) []map[string]interface{} {
+	if q.offset >= len(sessions) {
+		return []map[string]interface{}{}
+	}
+	sessions = sessions[q.offset:]
+	if q.limit >= 0 && q.limit < len(sessions) {
+		sessions = sessions[:q.limit]
+	}
+	return sessions
+}
+
+// nextCursor returns the after cursor for the page following the argumented page of
+// sessions or -1 if there are no more sessions. The cursor is only available when
+// paging with limit in the default session_id order.
+func (q *sessionQuery) nextCursor(sessions []map[string]interface{}, total int) int64 {
+	if q.limit < 0 || len(sessions) == 0 || q.offset+len(sessions) >= total {
+		return -1
+	}
+	if len(q.sortKeys) != 1 || q.sortKeys[0].field != "session_id" || q.sortKeys[0].descending {
+		return -1
+	}
+	if sessionID, ok := sessions[len(sessions)-1]["session_id"].(int64); ok {
+		return sessionID
+	}
+	return -1
+}
+
+// project returns the sessions with only the requested fields
+func (q *sessionQuery) project(sessions []map[string]interface{}) []map[string]interface{} {
+	if len(q.fields) == 0 {
+		return sessions
+	}
+
+	for i, session := range sessions {
+		result := make(map[string]interface{}, len(q.fields))
+		for _, field := range q.fields {
+			if value, found := session[field]; found {
+				result[field] = value
+			}
+		}
+		sessions[i] = result
+	}
+	return sessions
+}
+
+// compareSessionValues compares two session values for sorting. Numbers are compared
+// numerically, addresses by their bytes, and everything else as strings. Missing
+// values sort after all other values.
+func compareSessionValues(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		default:
+			return -1
+		}
+	}
+
+	if na, ok := sessionNumber(a); ok {
+		if nb, ok := sessionNumber(b); ok {
+			switch {
+			case na < nb:
+				return -1
+			case na > nb:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	if ia, ok := a.(net.IP); ok {
+		if ib, ok := b.(net.IP); ok {
+			return bytes.Compare(ia.To16(), ib.To16())
+		}
+	}
+
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+// sessionNumber returns the value as a float64 if it is a number
+func sessionNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int8:
+		return float64(number), true
+	case int16:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case uint:
+		return float64(number), true
+	case uint8:
+		return float64(number), true
+	case uint16:
+		return float64(number), true
+	case uint32:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	case float32:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
+
+// matchesAny returns true if any of the named session values formats as the argumented value
+func matchesAny(session map[string]interface{}, value string, names ...string) bool {
+	for _, name := range names {
+		if item, found := session[name]; found && item != nil && fmt.Sprintf("%v", item) == value {
+			return true
+		}
+	}
+	return false
+}
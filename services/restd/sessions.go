@@ -2,32 +2,128 @@ package restd
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
 )
 
-// statusSessions is the RESTD /api/status/sessions handler
+// statusSessions is the RESTD /api/status/sessions handler. The query parameters
+// described in parseSessionQuery filter, sort, page, and limit the fields of the sessions.
+// The total number of matching sessions is returned in the X-Total-Count header and
+// when paging with limit the cursor for the next page is returned in X-Next-Cursor.
 func statusSessions(c *gin.Context) {
 	logger.Debug("statusSession()\n")
 
-	sessions, err := getSessions()
+	query, err := parseSessionQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessions, total, cursor, err := getSessions(query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
 
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if cursor >= 0 {
+		c.Header("X-Next-Cursor", strconv.FormatInt(cursor, 10))
+	}
+
 	c.JSON(http.StatusOK, sessions)
 }
 
-// getSessions returns the fully merged list of sessions
-// as a list of map[string]interface{}
-// It reads the session list from /proc/net/nf_conntrack
-// and merges in the values for each session in dict
-func getSessions() ([]map[string]interface{}, error) {
+// sessionKill is the RESTD /api/sessions/:ctid/kill handler. It destroys the conntrack
+// entry for the session and sends TCP resets to both endpoints if reset=true is passed.
+func sessionKill(c *gin.Context) {
+	ctid, ok := getSessionActionID(c)
+	if !ok {
+		return
+	}
+
+	reset, _ := strconv.ParseBool(c.Query("reset"))
+	sessionID, tuple, err := dispatch.KillSession(ctid, reset)
+	if !checkSessionAction(c, err) {
+		return
+	}
+
+	logSessionAction(c, "kill", ctid, sessionID, tuple, reset)
+	c.JSON(http.StatusOK, gin.H{"result": "OK", "session_id": sessionID, "reset": reset})
+}
+
+// sessionBlock is the RESTD /api/sessions/:ctid/block handler. It drops all future packets for the session.
+func sessionBlock(c *gin.Context) {
+	ctid, ok := getSessionActionID(c)
+	if !ok {
+		return
+	}
+
+	sessionID, tuple, err := dispatch.BlockSession(ctid)
+	if !checkSessionAction(c, err) {
+		return
+	}
+
+	logSessionAction(c, "block", ctid, sessionID, tuple, false)
+	c.JSON(http.StatusOK, gin.H{"result": "OK", "session_id": sessionID})
+}
+
+// getSessionActionID parses the ctid parameter and writes an error response if it is not valid
+func getSessionActionID(c *gin.Context) (uint32, bool) {
+	ctid, err := strconv.ParseUint(c.Param("ctid"), 10, 32)
+	if err != nil || ctid == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conntrack id: " + c.Param("ctid")})
+		return 0, false
+	}
+	return uint32(ctid), true
+}
+
+// checkSessionAction writes an error response if a session action failed
+func checkSessionAction(c *gin.Context, err error) bool {
+	if err == dispatch.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// logSessionAction logs a session_actions event with the user that killed or blocked a session
+func logSessionAction(c *gin.Context, action string, ctid uint32, sessionID int64, tuple dispatch.Tuple, reset bool) {
+	username := getSessionUsername(c)
+	logger.Info("Session %d %s by user %s\n", ctid, action, username)
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     sessionID,
+		"conntrack_id":   ctid,
+		"action":         action,
+		"reset":          reset,
+		"username":       username,
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress,
+		"server_address": tuple.ServerAddress,
+		"client_port":    tuple.ClientPort,
+		"server_port":    tuple.ServerPort,
+	}
+	reports.LogEvent(reports.CreateEvent("session_"+action, "session_actions", 1, columns, nil))
+}
+
+// getSessions returns the list of sessions that pass the query filters merged with the
+// values for each session in dict as a list of map[string]interface{}, along with the total
+// number of matching sessions before paging and the cursor for the next page or -1 if
+// there are no more pages. The conntrack filters are applied before the
+// dict merge and when possible the sessions are also sorted and paged before the merge
+// so only the returned sessions are read from dict.
+func getSessions(query *sessionQuery) ([]map[string]interface{}, int, int64, error) {
 	var sessions []map[string]interface{}
 
 	conntrackTable := dispatch.GetConntrackTable()
@@ -35,60 +131,92 @@ func getSessions() ([]map[string]interface{}, error) {
 	for _, v := range conntrackTable {
 		v.Guardian.RLock()
 		m := parseConntrack(v)
+		byteRate := v.TotalByteRate
 		v.Guardian.RUnlock()
-		if m != nil {
-			sessions = append(sessions, m)
+		if m == nil {
+			continue
 		}
-	}
 
-	// build a tuple map to store the sessions
-	tupleMap := make(map[uint32]map[string]interface{})
-	for _, s := range sessions {
-		var ctidx interface{} = s["conntrack_id"]
-		ctid, ok := ctidx.(uint32)
+		ctid, ok := m["conntrack_id"].(uint32)
 		if !ok {
-			logger.Warn("Invalid conntrack_id type: %T\n", ctidx)
+			logger.Warn("Invalid conntrack_id type: %T\n", m["conntrack_id"])
 			continue
 		}
 		if ctid == 0 {
 			logger.Warn("Invalid conntrack_id: %d\n", ctid)
 			continue
 		}
-		tupleMap[ctid] = s
+
+		if query.matchesConntrack(m, byteRate) {
+			sessions = append(sessions, m)
+		}
 	}
 
-	// read the data from dict "sessions" table
-	sessionTable, err := dict.GetSessions()
-	if err != nil {
-		logger.Warn("Unable to get sessions: %v\n", err)
+	if len(sessions) == 0 {
+		return []map[string]interface{}{}, 0, -1, nil
 	}
 
-	// for all the data in the dict "sessions" table, merge it into the matching tupleMap entries
-	for ctid, session := range sessionTable {
-		_, ok := tupleMap[ctid]
-		if !ok {
-			// matching session not found, continue
-			continue
+	total := len(sessions)
+	paged := !query.needsDict(sessions[0])
+	if paged {
+		query.sortSessions(sessions)
+		sessions = query.page(sessions)
+	}
+
+	mergeDictSessions(sessions)
+
+	if !paged {
+		filtered := sessions[:0]
+		for _, s := range sessions {
+			if query.matchesDict(s) {
+				filtered = append(filtered, s)
+			}
+		}
+		sessions = filtered
+		total = len(sessions)
+		query.sortSessions(sessions)
+		sessions = query.page(sessions)
+	}
+
+	cursor := query.nextCursor(sessions, total)
+	return query.project(sessions), total, cursor, nil
+}
+
+// mergeDictSessions merges the values from the dict "sessions" table into the argumented sessions.
+// Values from conntrack take precedence over the dict values with the same name.
+func mergeDictSessions(sessions []map[string]interface{}) {
+	merge := func(s map[string]interface{}, values map[string]interface{}) {
+		for key, value := range values {
+			if _, alreadyFound := s[key]; !alreadyFound {
+				s[key] = value
+			}
 		}
+	}
 
-		// matching session found, merge the (new) values into the map
-		for key, value := range session {
-			_, alreadyFound := tupleMap[ctid][key]
-			if alreadyFound {
+	// for a few sessions it is cheaper to read each session than the whole table
+	if len(sessions) <= sessionDictLookupLimit {
+		for _, s := range sessions {
+			values, err := dict.GetSession(s["conntrack_id"].(uint32))
+			if err != nil {
+				logger.Warn("Unable to get session: %v\n", err)
 				continue
-			} else {
-				tupleMap[ctid][key] = value
 			}
+			merge(s, values)
 		}
+		return
 	}
 
-	// return all the merged values from the tupleMap
-	var sessionList []map[string]interface{}
-	for _, v := range tupleMap {
-		sessionList = append(sessionList, v)
+	sessionTable, err := dict.GetSessions()
+	if err != nil {
+		logger.Warn("Unable to get sessions: %v\n", err)
+		return
 	}
 
-	return sessionList, nil
+	for _, s := range sessions {
+		if values, ok := sessionTable[s["conntrack_id"].(uint32)]; ok {
+			merge(s, values)
+		}
+	}
 }
 
 // parse a line of /proc/net/nf_conntrack and return the info in a map
@@ -0,0 +1,130 @@
+package restd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// maxSessionStreams is the maximum number of concurrent session event streams
+const maxSessionStreams = 16
+
+// sessionStreamBuffer is the number of events buffered for each stream
+const sessionStreamBuffer = 256
+
+// streamKeepaliveInterval is how often a comment is sent on the stream so
+// proxies and clients do not close the connection
+const streamKeepaliveInterval = 15 * time.Second
+
+// sessionStreamFilter holds the filters for a session event stream
+type sessionStreamFilter struct {
+	host        string
+	application string
+	iface       int
+}
+
+// streamSessions is the RESTD /api/stream/sessions handler. It sends session new, update
+// and end events as they happen using Server-Sent Events. The optional host, application,
+// and interface query parameters limit the stream to the matching sessions.
+func streamSessions(c *gin.Context) {
+	filter := sessionStreamFilter{
+		host:        strings.ToLower(c.Query("host")),
+		application: strings.ToLower(c.Query("application")),
+		iface:       -1,
+	}
+
+	if value := c.Query("interface"); value != "" {
+		iface, err := strconv.Atoi(value)
+		if err != nil || iface < 0 || iface > 255 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interface: " + value})
+			return
+		}
+		filter.iface = iface
+	}
+
+	channel := dispatch.SubscribeSessionEvents(sessionStreamBuffer, maxSessionStreams)
+	if channel == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many session streams"})
+		return
+	}
+	defer dispatch.UnsubscribeSessionEvents(channel)
+
+	logger.Debug("Session stream started for %s filter:%+v\n", c.ClientIP(), filter)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	// tell the client the stream is ready and which filters are active before waiting for the first event
+	c.SSEvent("ready", gin.H{"host": c.Query("host"), "application": c.Query("application"), "interface": c.Query("interface")})
+
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-channel:
+			if filter.matches(event.Session) {
+				c.SSEvent(event.Type, event)
+			}
+			return true
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+
+	logger.Debug("Session stream finished for %s\n", c.ClientIP())
+}
+
+// matches returns true if the argumented session details pass all of the filters
+func (f sessionStreamFilter) matches(session map[string]interface{}) bool {
+	if f.iface >= 0 && !matchesInterface(session, f.iface) {
+		return false
+	}
+
+	if f.application != "" && !matchesValue(session, f.application, false, "application_name", "application_id") {
+		return false
+	}
+
+	if f.host != "" && !matchesValue(session, f.host, true, "client_address", "server_address", "client_address_new", "server_address_new", "ssl_sni", "client_hostname", "server_hostname") {
+		return false
+	}
+
+	return true
+}
+
+// matchesInterface returns true if the session client or server interface is the argumented interface
+func matchesInterface(session map[string]interface{}, iface int) bool {
+	for _, name := range []string{"client_interface_id", "server_interface_id"} {
+		if value, found := session[name]; found && fmt.Sprintf("%v", value) == strconv.Itoa(iface) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesValue returns true if any of the named session values matches the argumented value.
+// Values are compared without case and partial matches are allowed when substring is true.
+func matchesValue(session map[string]interface{}, value string, substring bool, names ...string) bool {
+	for _, name := range names {
+		item, found := session[name]
+		if !found || item == nil {
+			continue
+		}
+		text := strings.ToLower(fmt.Sprintf("%v", item))
+		if text == value || (substring && strings.Contains(text, value)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// settingsValidatePath is the first settings path segment used for the settings validation
+// API. Like the revisions API these requests are passed on by the settings handlers.
+const settingsValidatePath = "validate"
+
+// isValidateRequest returns true if the settings path segments are for the validation API
+func isValidateRequest(segments []string) bool {
+	return len(segments) > 0 && segments[0] == settingsValidatePath
+}
+
+// validateSettings handles POST /api/settings/validate/*path requests. The body is checked
+// against the settings schema as if it was saved at the path, but nothing is saved.
+func validateSettings(c *gin.Context, segments []string) {
+	segments = segments[1:]
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var bodyJSONObject interface{}
+	if err = json.Unmarshal(body, &bodyJSONObject); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// validate the settings as they would be saved
+	if err = hashCleartextPasswords(segments, bodyJSONObject); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jsonResult, err := settings.ValidateSettingsAt(segments, bodyJSONObject)
+	writeSettingsResult(c, jsonResult, err)
+}
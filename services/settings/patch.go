@@ -0,0 +1,293 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PatchOperation is a RFC 6902 JSON Patch operation. Path and From are JSON Pointers
+// relative to the settings path the patch is applied to.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PatchError is returned when a patch operation can not be applied
+type PatchError struct {
+	Index int
+	Op    string
+	Err   error
+}
+
+// Error returns the patch error message including the index of the failed operation
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("Patch operation %d (%s) failed: %s", e.Index, e.Op, e.Err.Error())
+}
+
+// PatchSettings applies the JSON Patch operations to the settings at the specified path.
+// The operations are applied in order and if any operation fails none of them are saved.
+// sync-settings is only run once for the whole patch.
+func PatchSettings(segments []string, patch []PatchOperation, force bool, info RevisionInfo) (interface{}, error) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	jsonSettings, err := readSettingsForUpdate(settingsFile, info)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	var document interface{} = jsonSettings
+	if len(segments) > 0 {
+		document, err = getSettingsFromJSON(jsonSettings, segments)
+		if err != nil {
+			return createJSONErrorObject(err), err
+		}
+	}
+
+	document, err = applyPatch(document, patch)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	newSettings, err := setSettingsInJSON(jsonSettings, segments, document)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	jsonSettings, ok := newSettings.(map[string]interface{})
+	if !ok {
+		err = errors.New("Invalid global settings object")
+		return createJSONErrorObject(err), err
+	}
+
+	return syncAndSaveResult(jsonSettings, settingsFile, force, info)
+}
+
+// SplitJSONPointer returns the unescaped reference tokens of a JSON Pointer
+func SplitJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("Invalid JSON Pointer: " + pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// applyPatch applies the patch operations to the document and returns the new document
+func applyPatch(document interface{}, patch []PatchOperation) (interface{}, error) {
+	for i, operation := range patch {
+		var err error
+		document, err = applyPatchOperation(document, operation)
+		if err != nil {
+			return nil, &PatchError{Index: i, Op: operation.Op, Err: err}
+		}
+	}
+	return document, nil
+}
+
+// applyPatchOperation applies a single patch operation to the document and returns the new document
+func applyPatchOperation(document interface{}, operation PatchOperation) (interface{}, error) {
+	path, err := SplitJSONPointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operation.Op {
+	case "add":
+		return patchAdd(document, path, copyJSONValue(operation.Value))
+	case "remove":
+		return patchRemove(document, path)
+	case "replace":
+		if len(path) == 0 {
+			return copyJSONValue(operation.Value), nil
+		}
+		document, err = patchRemove(document, path)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(document, path, copyJSONValue(operation.Value))
+	case "move", "copy":
+		from, err := SplitJSONPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := patchGet(document, from)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" {
+			if isPointerPrefix(from, path) && len(from) != len(path) {
+				return nil, errors.New("Can not move a value into one of its children")
+			}
+			document, err = patchRemove(document, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = copyJSONValue(value)
+		}
+		return patchAdd(document, path, value)
+	case "test":
+		value, err := patchGet(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, copyJSONValue(operation.Value)) {
+			return nil, errors.New("Value at " + operation.Path + " does not match")
+		}
+		return document, nil
+	}
+
+	return nil, errors.New("Invalid operation: " + operation.Op)
+}
+
+// patchGet returns the value at the path in the document
+func patchGet(document interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := document.(type) {
+		case map[string]interface{}:
+			value, found := node[token]
+			if !found {
+				return nil, errors.New("Missing member: " + token)
+			}
+			document = value
+		case []interface{}:
+			i, err := getPatchIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			document = node[i]
+		default:
+			return nil, errors.New("Can not index value with: " + token)
+		}
+	}
+	return document, nil
+}
+
+// patchAdd adds the value at the path in the document and returns the new document
+func patchAdd(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return patchParent(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			if token == "-" {
+				return append(node, value), nil
+			}
+			i, err := getPatchIndex(node, token, true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, errors.New("Can not add a member to a non-container value")
+	})
+}
+
+// patchRemove removes the value at the path in the document and returns the new document
+func patchRemove(document interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("Can not remove the whole document")
+	}
+
+	return patchParent(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, found := node[token]; !found {
+				return nil, errors.New("Missing member: " + token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := getPatchIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, errors.New("Can not remove a member from a non-container value")
+	})
+}
+
+// patchParent walks down to the parent of the last path token and calls the update function on it.
+// The updated parent is stored back in its own parent since appending to an array creates a new slice.
+func patchParent(document interface{}, path []string, update func(interface{}, string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(document, path[0])
+	}
+
+	child, err := patchGet(document, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = patchParent(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := document.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := getPatchIndex(node, path[0], false)
+		node[i] = child
+	}
+	return document, nil
+}
+
+// getPatchIndex parses an array index token. If end is true the index may be the array length.
+func getPatchIndex(array []interface{}, token string, end bool) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, errors.New("Invalid array index: " + token)
+	}
+	if i > len(array) || (i == len(array) && !end) {
+		return 0, errors.New("Array index out of range: " + token)
+	}
+	return i, nil
+}
+
+// isPointerPrefix returns true if the prefix path is the same as or a parent of the path
+func isPointerPrefix(prefix []string, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyJSONValue returns a deep copy of a JSON value so patched values are never shared
+func copyJSONValue(value interface{}) interface{} {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var result interface{}
+	if err = json.Unmarshal(raw, &result); err != nil {
+		return value
+	}
+	return result
+}
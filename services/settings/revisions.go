@@ -0,0 +1,186 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+const revisionsDir = "/etc/config/settings.revisions"
+const revisionsIndex = revisionsDir + "/revisions.json"
+
+// defaultRevisionRetention is the number of revisions kept if the retention is not set
+const defaultRevisionRetention = 20
+
+// ErrRevisionNotFound is returned when a revision does not exist
+var ErrRevisionNotFound = errors.New("Settings revision not found")
+
+// RevisionInfo describes who made a settings change and why. If ETag is set the change
+// is only made if the settings file still has that ETag, otherwise ErrSettingsModified is returned.
+type RevisionInfo struct {
+	User    string
+	Comment string
+	ETag    string
+}
+
+// Revision is an accepted settings file kept in the revision history
+type Revision struct {
+	Revision  int    `json:"revision"`
+	TimeStamp int64  `json:"time_stamp"`
+	User      string `json:"user"`
+	Comment   string `json:"comment"`
+}
+
+var revisionsMutex sync.Mutex
+
+// GetRevisions returns the settings revisions, oldest first
+func GetRevisions() ([]Revision, error) {
+	revisionsMutex.Lock()
+	defer revisionsMutex.Unlock()
+	return readRevisionIndex()
+}
+
+// GetRevision returns the settings file of the argumented revision
+func GetRevision(revision int) (map[string]interface{}, error) {
+	revisionsMutex.Lock()
+	defer revisionsMutex.Unlock()
+
+	jsonObject, err := readSettingsFileJSON(revisionFilename(revision))
+	if os.IsNotExist(err) {
+		return nil, ErrRevisionNotFound
+	}
+	return jsonObject, err
+}
+
+// RollbackRevision runs sync-settings on the argumented revision and saves it
+// as the settings. The rollback is saved as a new revision so it can be undone.
+// The current accounts are kept unless restoreAccounts is true, so a rollback does
+// not bring back a revoked API token or a password that has been changed.
+func RollbackRevision(revision int, restoreAccounts bool, info RevisionInfo) (interface{}, error) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	current, err := readSettingsForUpdate(settingsFile, info)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	jsonSettings, err := GetRevision(revision)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	if !restoreAccounts {
+		KeepAccounts(jsonSettings, current)
+	}
+
+	if info.Comment == "" {
+		info.Comment = fmt.Sprintf("Rollback to revision %d", revision)
+		if restoreAccounts {
+			info.Comment += " including accounts"
+		}
+	}
+
+	return syncAndSaveResult(jsonSettings, settingsFile, false, info)
+}
+
+// KeepAccounts replaces the accounts in the revision settings with the current accounts
+func KeepAccounts(revision map[string]interface{}, current map[string]interface{}) {
+	if accounts, found := current["accounts"]; found {
+		revision["accounts"] = accounts
+	} else {
+		delete(revision, "accounts")
+	}
+}
+
+// saveRevision saves the argumented settings file contents as a new revision and
+// removes the oldest revisions beyond the retention count from the new settings
+func saveRevision(jsonObject map[string]interface{}, raw []byte, info RevisionInfo) error {
+	revisionsMutex.Lock()
+	defer revisionsMutex.Unlock()
+
+	if err := os.MkdirAll(revisionsDir, 0755); err != nil {
+		return err
+	}
+
+	revisions, err := readRevisionIndex()
+	if err != nil {
+		logger.Warn("Failed to read settings revisions: %v\n", err)
+		revisions = nil
+	}
+
+	entry := Revision{Revision: 1, TimeStamp: time.Now().UnixNano() / 1e6, User: info.User, Comment: info.Comment}
+	if len(revisions) > 0 {
+		entry.Revision = revisions[len(revisions)-1].Revision + 1
+	}
+
+	if err = ioutil.WriteFile(revisionFilename(entry.Revision), raw, 0600); err != nil {
+		return err
+	}
+	revisions = append(revisions, entry)
+
+	retention := getRevisionRetention(jsonObject)
+	for len(revisions) > retention {
+		os.Remove(revisionFilename(revisions[0].Revision))
+		revisions = revisions[1:]
+	}
+
+	return writeRevisionIndex(revisions)
+}
+
+// getRevisionRetention returns the number of revisions to keep from the system settingsRevisions settings
+func getRevisionRetention(jsonObject map[string]interface{}) int {
+	value, err := getSettingsFromJSON(jsonObject, []string{"system", "settingsRevisions", "retention"})
+	if err != nil {
+		return defaultRevisionRetention
+	}
+
+	retention, ok := value.(float64)
+	if !ok || retention < 1 {
+		logger.Warn("Invalid settings revision retention: %v\n", value)
+		return defaultRevisionRetention
+	}
+	return int(retention)
+}
+
+// readRevisionIndex reads the revision index. The caller must hold the revisionsMutex.
+func readRevisionIndex() ([]Revision, error) {
+	revisions := []Revision{}
+
+	raw, err := ioutil.ReadFile(revisionsIndex)
+	if os.IsNotExist(err) {
+		return revisions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(raw, &revisions)
+	return revisions, err
+}
+
+// writeRevisionIndex writes the revision index. The caller must hold the revisionsMutex.
+func writeRevisionIndex(revisions []Revision) error {
+	raw, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpName := revisionsIndex + ".tmp"
+	if err = ioutil.WriteFile(tmpName, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, revisionsIndex)
+}
+
+// revisionFilename returns the filename of the argumented revision
+func revisionFilename(revision int) string {
+	return filepath.Join(revisionsDir, fmt.Sprintf("%d.json", revision))
+}
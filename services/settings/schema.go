@@ -0,0 +1,507 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// schemaFile is the JSON Schema used to validate the settings before running sync-settings
+const schemaFile = "/usr/share/packetd/settings.schema.json"
+
+// maxSchemaDepth limits $ref recursion so a schema that refers to itself can not loop forever
+const maxSchemaDepth = 64
+
+// ValidationError describes a problem with a single value in the settings
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Error returns the error as a string
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors is the list of problems found when validating the settings
+type ValidationErrors []ValidationError
+
+// Error returns all of the errors as a single string
+func (e ValidationErrors) Error() string {
+	var list []string
+	for _, item := range e {
+		list = append(list, item.Error())
+	}
+	return "Invalid settings: " + strings.Join(list, "; ")
+}
+
+// settingsSchema is the loaded schema and the modification time of the schema file
+var settingsSchema interface{}
+var settingsSchemaTime time.Time
+var settingsSchemaMutex sync.Mutex
+
+// schemaPatterns caches the compiled pattern and patternProperties regular expressions
+var schemaPatterns = make(map[string]*regexp.Regexp)
+
+// ValidateSettings validates the settings file object against the settings schema.
+// The problems found are returned as ValidationErrors, or nil if the settings are valid
+// or there is no schema file.
+func ValidateSettings(jsonObject map[string]interface{}) error {
+	settingsSchemaMutex.Lock()
+	defer settingsSchemaMutex.Unlock()
+
+	schema, err := loadSettingsSchema()
+	if err != nil {
+		logger.Warn("Failed to load settings schema: %v\n", err)
+		return nil
+	}
+	if schema == nil {
+		return nil
+	}
+
+	validator := schemaValidator{root: schema}
+	validator.validate(schema, jsonObject, "", 0)
+	if len(validator.errs) > 0 {
+		return validator.errs
+	}
+	return nil
+}
+
+// ValidateSettingsAt checks the result of setting the value at the specified path of the
+// settings without saving it. The result object has the ValidationErrors if there are any.
+func ValidateSettingsAt(segments []string, value interface{}) (interface{}, error) {
+	jsonSettings, err := readSettingsFileJSON(settingsFile)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	newSettings, err := setSettingsInJSON(jsonSettings, segments, value)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	jsonSettings, ok := newSettings.(map[string]interface{})
+	if !ok {
+		err = errors.New("Invalid global settings object")
+		return createJSONErrorObject(err), err
+	}
+
+	err = ValidateSettings(jsonSettings)
+	if verr, ok := err.(ValidationErrors); ok {
+		return map[string]interface{}{"error": verr.Error(), "errors": verr}, err
+	}
+
+	return map[string]interface{}{"result": "OK"}, nil
+}
+
+// loadSettingsSchema returns the settings schema, reloading it if the file has changed.
+// Returns nil if there is no schema file. The caller must hold the settingsSchemaMutex.
+func loadSettingsSchema() (interface{}, error) {
+	info, err := os.Stat(schemaFile)
+	if os.IsNotExist(err) {
+		settingsSchema = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if settingsSchema != nil && info.ModTime().Equal(settingsSchemaTime) {
+		return settingsSchema, nil
+	}
+
+	raw, err := ioutil.ReadFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	var schema interface{}
+	if err = json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Loaded settings schema %s\n", schemaFile)
+	settingsSchema = schema
+	settingsSchemaTime = info.ModTime()
+	schemaPatterns = make(map[string]*regexp.Regexp)
+	return schema, nil
+}
+
+// schemaValidator validates a value against a draft-07 JSON Schema. The supported keywords
+// are $ref to the same schema, type, enum, const, the number, string, array, and object
+// keywords, the ipv4, ipv6, hostname, and email formats, allOf, anyOf, oneOf, not, and
+// if/then/else. Other keywords are ignored.
+type schemaValidator struct {
+	root interface{}
+	errs ValidationErrors
+}
+
+// addError records a problem with the value at the argumented path
+func (v *schemaValidator) addError(path string, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	v.errs = append(v.errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// isValid returns true if the value is valid against the schema without recording any errors
+func (v *schemaValidator) isValid(schema interface{}, value interface{}, path string, depth int) bool {
+	check := schemaValidator{root: v.root}
+	check.validate(schema, value, path, depth)
+	return len(check.errs) == 0
+}
+
+// validate checks the value at the argumented path against the schema
+func (v *schemaValidator) validate(schema interface{}, value interface{}, path string, depth int) {
+	if depth > maxSchemaDepth {
+		v.addError(path, "schema is nested too deeply")
+		return
+	}
+
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			v.addError(path, "no value is allowed")
+		}
+		return
+	case map[string]interface{}:
+		if ref, ok := s["$ref"].(string); ok {
+			target, err := v.resolveRef(ref)
+			if err != nil {
+				v.addError(path, "%s", err.Error())
+				return
+			}
+			v.validate(target, value, path, depth+1)
+			return
+		}
+		v.validateType(s, value, path)
+		v.validateEnum(s, value, path)
+		v.validateNumber(s, value, path)
+		v.validateString(s, value, path)
+		v.validateArray(s, value, path, depth)
+		v.validateObject(s, value, path, depth)
+		v.validateCombinations(s, value, path, depth)
+	}
+}
+
+// resolveRef returns the part of the root schema referred to by a local $ref
+func (v *schemaValidator) resolveRef(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %s", ref)
+	}
+	tokens, err := SplitJSONPointer(ref[1:])
+	if err != nil {
+		return nil, err
+	}
+	target, err := patchGet(v.root, tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $ref %s", ref)
+	}
+	return target, nil
+}
+
+// validateType checks the type keyword, which is a type name or a list of type names
+func (v *schemaValidator) validateType(schema map[string]interface{}, value interface{}, path string) {
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+	default:
+		return
+	}
+
+	actual := jsonTypeName(value)
+	for _, name := range types {
+		if name == actual || (name == "number" && actual == "integer") {
+			return
+		}
+	}
+	v.addError(path, "must be of type %s", strings.Join(types, " or "))
+}
+
+// validateEnum checks the enum and const keywords
+func (v *schemaValidator) validateEnum(schema map[string]interface{}, value interface{}, path string) {
+	if allowed, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, item := range allowed {
+			if reflect.DeepEqual(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			raw, _ := json.Marshal(allowed)
+			v.addError(path, "must be one of %s", raw)
+		}
+	}
+	if expected, ok := schema["const"]; ok && !reflect.DeepEqual(expected, value) {
+		raw, _ := json.Marshal(expected)
+		v.addError(path, "must be %s", raw)
+	}
+}
+
+// validateNumber checks the number keywords
+func (v *schemaValidator) validateNumber(schema map[string]interface{}, value interface{}, path string) {
+	number, ok := value.(float64)
+	if !ok {
+		return
+	}
+	if limit, ok := schema["minimum"].(float64); ok && number < limit {
+		v.addError(path, "must be at least %v", limit)
+	}
+	if limit, ok := schema["maximum"].(float64); ok && number > limit {
+		v.addError(path, "must be at most %v", limit)
+	}
+	if limit, ok := schema["exclusiveMinimum"].(float64); ok && number <= limit {
+		v.addError(path, "must be greater than %v", limit)
+	}
+	if limit, ok := schema["exclusiveMaximum"].(float64); ok && number >= limit {
+		v.addError(path, "must be less than %v", limit)
+	}
+	if divisor, ok := schema["multipleOf"].(float64); ok && divisor > 0 {
+		quotient := number / divisor
+		if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			v.addError(path, "must be a multiple of %v", divisor)
+		}
+	}
+}
+
+// validateString checks the string keywords
+func (v *schemaValidator) validateString(schema map[string]interface{}, value interface{}, path string) {
+	text, ok := value.(string)
+	if !ok {
+		return
+	}
+	length := float64(utf8.RuneCountInString(text))
+	if limit, ok := schema["minLength"].(float64); ok && length < limit {
+		v.addError(path, "must be at least %v characters", limit)
+	}
+	if limit, ok := schema["maxLength"].(float64); ok && length > limit {
+		v.addError(path, "must be at most %v characters", limit)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := getSchemaPattern(pattern)
+		if err != nil {
+			v.addError(path, "invalid schema pattern %s", pattern)
+		} else if !re.MatchString(text) {
+			v.addError(path, "must match pattern %s", pattern)
+		}
+	}
+	if format, ok := schema["format"].(string); ok && !isValidFormat(format, text) {
+		v.addError(path, "must be a valid %s", format)
+	}
+}
+
+// validateArray checks the array keywords
+func (v *schemaValidator) validateArray(schema map[string]interface{}, value interface{}, path string, depth int) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return
+	}
+	length := float64(len(array))
+	if limit, ok := schema["minItems"].(float64); ok && length < limit {
+		v.addError(path, "must have at least %v items", limit)
+	}
+	if limit, ok := schema["maxItems"].(float64); ok && length > limit {
+		v.addError(path, "must have at most %v items", limit)
+	}
+	if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if reflect.DeepEqual(array[i], array[j]) {
+					v.addError(fmt.Sprintf("%s/%d", path, j), "must be unique")
+				}
+			}
+		}
+	}
+
+	switch items := schema["items"].(type) {
+	case []interface{}:
+		for i, item := range array {
+			if i < len(items) {
+				v.validate(items[i], item, fmt.Sprintf("%s/%d", path, i), depth+1)
+			} else if additional, ok := schema["additionalItems"]; ok {
+				v.validate(additional, item, fmt.Sprintf("%s/%d", path, i), depth+1)
+			}
+		}
+	case map[string]interface{}, bool:
+		for i, item := range array {
+			v.validate(items, item, fmt.Sprintf("%s/%d", path, i), depth+1)
+		}
+	}
+}
+
+// validateObject checks the object keywords
+func (v *schemaValidator) validateObject(schema map[string]interface{}, value interface{}, path string, depth int) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	count := float64(len(object))
+	if limit, ok := schema["minProperties"].(float64); ok && count < limit {
+		v.addError(path, "must have at least %v properties", limit)
+	}
+	if limit, ok := schema["maxProperties"].(float64); ok && count > limit {
+		v.addError(path, "must have at most %v properties", limit)
+	}
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, item := range required {
+			if name, ok := item.(string); ok {
+				if _, found := object[name]; !found {
+					v.addError(path, "missing required property %s", name)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	patterns, _ := schema["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+
+	// sort the keys so the errors are always in the same order
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := path + "/" + strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+		matched := false
+		if child, found := properties[key]; found {
+			matched = true
+			v.validate(child, object[key], childPath, depth+1)
+		}
+		for pattern, child := range patterns {
+			re, err := getSchemaPattern(pattern)
+			if err != nil || !re.MatchString(key) {
+				continue
+			}
+			matched = true
+			v.validate(child, object[key], childPath, depth+1)
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				v.addError(childPath, "property is not allowed")
+			} else {
+				v.validate(additional, object[key], childPath, depth+1)
+			}
+		}
+	}
+}
+
+// validateCombinations checks the allOf, anyOf, oneOf, not, and if/then/else keywords
+func (v *schemaValidator) validateCombinations(schema map[string]interface{}, value interface{}, path string, depth int) {
+	if list, ok := schema["allOf"].([]interface{}); ok {
+		for _, child := range list {
+			v.validate(child, value, path, depth+1)
+		}
+	}
+	if list, ok := schema["anyOf"].([]interface{}); ok {
+		valid := false
+		for _, child := range list {
+			if v.isValid(child, value, path, depth+1) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			v.addError(path, "must match at least one of the allowed schemas")
+		}
+	}
+	if list, ok := schema["oneOf"].([]interface{}); ok {
+		count := 0
+		for _, child := range list {
+			if v.isValid(child, value, path, depth+1) {
+				count++
+			}
+		}
+		if count != 1 {
+			v.addError(path, "must match exactly one of the allowed schemas")
+		}
+	}
+	if child, ok := schema["not"]; ok && v.isValid(child, value, path, depth+1) {
+		v.addError(path, "must not match the schema")
+	}
+	if condition, ok := schema["if"]; ok {
+		if v.isValid(condition, value, path, depth+1) {
+			if then, ok := schema["then"]; ok {
+				v.validate(then, value, path, depth+1)
+			}
+		} else if otherwise, ok := schema["else"]; ok {
+			v.validate(otherwise, value, path, depth+1)
+		}
+	}
+}
+
+// jsonTypeName returns the JSON Schema type name of a decoded JSON value
+func jsonTypeName(value interface{}) string {
+	switch item := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if item == math.Trunc(item) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// getSchemaPattern returns the compiled regular expression for a schema pattern.
+// The caller must hold the settingsSchemaMutex.
+func getSchemaPattern(pattern string) (*regexp.Regexp, error) {
+	if re, found := schemaPatterns[pattern]; found {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	schemaPatterns[pattern] = re
+	return re, nil
+}
+
+// hostnamePattern matches a hostname made of dot separated labels
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// isValidFormat checks the string against the supported formats. Unknown formats are always valid.
+func isValidFormat(format string, text string) bool {
+	switch format {
+	case "ipv4":
+		ip := net.ParseIP(text)
+		return ip != nil && ip.To4() != nil && !strings.Contains(text, ":")
+	case "ipv6":
+		return net.ParseIP(text) != nil && strings.Contains(text, ":")
+	case "hostname":
+		return len(text) <= 253 && hostnamePattern.MatchString(text)
+	case "email":
+		at := strings.LastIndex(text, "@")
+		return at > 0 && at < len(text)-1
+	}
+	return true
+}
@@ -2,6 +2,8 @@ package settings
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,13 +25,20 @@ const settingsFile = "/etc/config/settings.json"
 const defaultsFile = "/etc/config/defaults.json"
 const currentFile = "/etc/config/current.json"
 
+// ErrSettingsModified is returned when a settings change is based on an old ETag
+var ErrSettingsModified = errors.New("Settings have been modified")
+
+// settingsMutex serializes settings changes so each change is made to the latest settings
+var settingsMutex sync.Mutex
+
 // Startup settings service
 func Startup() {
+	startWatcher()
 }
 
 // Shutdown settings service
 func Shutdown() {
-
+	stopWatcher()
 }
 
 // GetCurrentSettings returns the current settings from the specified path
@@ -48,14 +58,39 @@ func GetSettings(segments []string) (interface{}, error) {
 	return GetSettingsFile(segments, settingsFile)
 }
 
+// GetSettingsWithETag returns the settings from the specified path and the ETag of the settings file
+func GetSettingsWithETag(segments []string) (interface{}, string, error) {
+	jsonObject, etag, err := readSettingsFile(settingsFile)
+	if err != nil {
+		return createJSONErrorObject(err), "", err
+	}
+
+	value, err := getSettingsFromJSON(jsonObject, segments)
+	if err != nil {
+		return createJSONErrorObject(err), "", err
+	}
+
+	return value, etag, nil
+}
+
 // SetSettings updates the settings
 func SetSettings(segments []string, value interface{}, force bool) (interface{}, error) {
-	return SetSettingsFile(segments, value, settingsFile, force)
+	return setSettingsFile(segments, value, settingsFile, force, RevisionInfo{})
+}
+
+// SetSettingsAs updates the settings and records the user and comment in the settings revision
+func SetSettingsAs(segments []string, value interface{}, force bool, info RevisionInfo) (interface{}, error) {
+	return setSettingsFile(segments, value, settingsFile, force, info)
 }
 
 // TrimSettings trims the settings
 func TrimSettings(segments []string) (interface{}, error) {
-	return TrimSettingsFile(segments, settingsFile)
+	return trimSettingsFile(segments, settingsFile, RevisionInfo{})
+}
+
+// TrimSettingsAs trims the settings and records the user and comment in the settings revision
+func TrimSettingsAs(segments []string, info RevisionInfo) (interface{}, error) {
+	return trimSettingsFile(segments, settingsFile, info)
 }
 
 // GetDefaultSettings returns the default settings from the specified path
@@ -83,12 +118,20 @@ func GetSettingsFile(segments []string, filename string) (interface{}, error) {
 
 // SetSettingsFile updates the settings
 func SetSettingsFile(segments []string, value interface{}, filename string, force bool) (interface{}, error) {
+	return setSettingsFile(segments, value, filename, force, RevisionInfo{})
+}
+
+// setSettingsFile updates the settings in the specified file
+func setSettingsFile(segments []string, value interface{}, filename string, force bool, info RevisionInfo) (interface{}, error) {
 	var ok bool
 	var err error
 	var jsonSettings map[string]interface{}
 	var newSettings interface{}
 
-	jsonSettings, err = readSettingsFileJSON(filename)
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	jsonSettings, err = readSettingsForUpdate(filename, info)
 	if err != nil {
 		return createJSONErrorObject(err), err
 	}
@@ -103,31 +146,52 @@ func SetSettingsFile(segments []string, value interface{}, filename string, forc
 		return createJSONErrorObject(err), err
 	}
 
-	output, err := syncAndSave(jsonSettings, filename, force)
-	if err != nil {
-		return map[string]interface{}{"error": err.Error(), "output": output}, err
-	}
-
-	return map[string]interface{}{"result": "OK", "output": output}, err
+	return syncAndSaveResult(jsonSettings, filename, force, info)
 }
 
 // readSettingsFileJSON reads the settings file and return the corresponding JSON object
 func readSettingsFileJSON(filename string) (map[string]interface{}, error) {
+	jsonObject, _, err := readSettingsFile(filename)
+	return jsonObject, err
+}
+
+// readSettingsFile reads the settings file and returns the corresponding JSON object
+// and the ETag, which is a hash of the file contents
+func readSettingsFile(filename string) (map[string]interface{}, string, error) {
 	raw, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	var jsonObject interface{}
 	err = json.Unmarshal(raw, &jsonObject)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	j, ok := jsonObject.(map[string]interface{})
 	if ok {
-		return j, nil
+		return j, settingsETag(raw), nil
+	}
+
+	return nil, "", errors.New("Invalid settings file format")
+}
+
+// readSettingsForUpdate reads the settings file to be changed and checks the ETag
+// in the revision info if there is one. The caller must hold the settingsMutex.
+func readSettingsForUpdate(filename string, info RevisionInfo) (map[string]interface{}, error) {
+	jsonObject, etag, err := readSettingsFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.ETag != "" && info.ETag != etag {
+		return nil, ErrSettingsModified
 	}
+	return jsonObject, nil
+}
 
-	return nil, errors.New("Invalid settings file format")
+// settingsETag returns the ETag of the settings file contents
+func settingsETag(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
 }
 
 // writeSettingsFileJSON writes the specified JSON object to the settings file
@@ -225,6 +289,11 @@ func setObjectIndex(obj interface{}, idx string, value interface{}) (interface{}
 
 // TrimSettingsFile trims the settings in the specified file
 func TrimSettingsFile(segments []string, filename string) (interface{}, error) {
+	return trimSettingsFile(segments, filename, RevisionInfo{})
+}
+
+// trimSettingsFile trims the settings in the specified file
+func trimSettingsFile(segments []string, filename string, info RevisionInfo) (interface{}, error) {
 	var ok bool
 	var err error
 	var iterJSONObject map[string]interface{}
@@ -235,7 +304,10 @@ func TrimSettingsFile(segments []string, filename string) (interface{}, error) {
 		return createJSONErrorObject(err), err
 	}
 
-	jsonSettings, err = readSettingsFileJSON(filename)
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	jsonSettings, err = readSettingsForUpdate(filename, info)
 	if err != nil {
 		return createJSONErrorObject(err), err
 	}
@@ -272,12 +344,7 @@ func TrimSettingsFile(segments []string, filename string) (interface{}, error) {
 		}
 	}
 
-	output, err := syncAndSave(jsonSettings, filename, false)
-	if err != nil {
-		return map[string]interface{}{"error": err.Error(), "output": output}, err
-	}
-
-	return map[string]interface{}{"result": "OK", "output": output}, err
+	return syncAndSaveResult(jsonSettings, filename, false, info)
 }
 
 // setSettingsInJSON sets the value attribute specified of the segments path to the specified value
@@ -353,12 +420,21 @@ func runSyncSettings(filename string, force bool) (string, error) {
 	return output, nil
 }
 
-// syncAndSave writes the jsonObject to a tmp file
+// syncAndSave validates the settings against the settings schema,
+// writes the jsonObject to a tmp file
 // calls sync-settings on the tmp file, and if the sync-settings returns 0
 // it copies the tmp file to the destination specified in filename
 // if sync-settings does not succeed it returns the error and output
+// accepted changes to the settings file are also saved as a new revision
 // returns stdout, stderr, and an error
-func syncAndSave(jsonObject map[string]interface{}, filename string, force bool) (string, error) {
+func syncAndSave(jsonObject map[string]interface{}, filename string, force bool, info RevisionInfo) (string, error) {
+	if filename == settingsFile {
+		if err := ValidateSettings(jsonObject); err != nil {
+			logger.Info("Settings failed validation: %v\n", err)
+			return "", err
+		}
+	}
+
 	tmpfile, err := tempFile("", "settings.json.")
 	if err != nil {
 		logger.Warn("Failed to generate tmpfile: %v\n", err.Error())
@@ -398,9 +474,40 @@ func syncAndSave(jsonObject map[string]interface{}, filename string, force bool)
 		return output, err
 	}
 
+	if filename == settingsFile {
+		tmpfile.Seek(0, 0)
+		raw, err := ioutil.ReadAll(tmpfile)
+		if err == nil {
+			err = saveRevision(jsonObject, raw, info)
+		}
+		if err != nil {
+			logger.Warn("Failed to save settings revision: %v\n", err)
+		}
+		wakeWatcher()
+	}
+
 	return output, nil
 }
 
+// syncAndSaveResult calls syncAndSave and returns the result object for the settings API.
+// On success the result includes the new ETag of the settings file.
+// The caller must hold the settingsMutex so the ETag is for these settings.
+func syncAndSaveResult(jsonObject map[string]interface{}, filename string, force bool, info RevisionInfo) (interface{}, error) {
+	output, err := syncAndSave(jsonObject, filename, force, info)
+	if verr, ok := err.(ValidationErrors); ok {
+		return map[string]interface{}{"error": verr.Error(), "errors": verr}, err
+	}
+	if err != nil {
+		return map[string]interface{}{"error": err.Error(), "output": output}, err
+	}
+
+	result := map[string]interface{}{"result": "OK", "output": output}
+	if _, etag, err := readSettingsFile(filename); err == nil {
+		result["etag"] = etag
+	}
+	return result, nil
+}
+
 // tempFile is similar to ioutil.TempFile
 // except with more permissive permissions
 func tempFile(dir, pattern string) (f *os.File, err error) {
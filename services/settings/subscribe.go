@@ -0,0 +1,188 @@
+package settings
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// watchInterval is how often the settings file is checked for external changes
+const watchInterval = 5
+
+// SettingsCallback is called with the old and new values of the subscribed settings path
+// after the settings change. A value is nil if the path does not exist.
+type SettingsCallback func(oldValue interface{}, newValue interface{})
+
+// subscription is a callback registered for a settings path prefix
+type subscription struct {
+	id       int
+	segments []string
+	callback SettingsCallback
+}
+
+var subscriptionList []subscription
+var subscriptionNextID = 1
+var subscriptionMutex sync.Mutex
+
+// watchSettings is the last settings object delivered to the subscribers
+var watchSettings map[string]interface{}
+var watchETag string
+var watchModTime time.Time
+var watchSize int64
+
+var watchShutdown = make(chan bool)
+var watchWakeup = make(chan bool, 1)
+
+// Subscribe registers a callback for changes to the settings at the path prefix, such
+// as "network/interfaces" or "" for all settings. The callback is called from the
+// settings watcher after a change is saved through the settings API or the settings
+// file is changed by another process. Returns an ID that can be passed to Unsubscribe.
+func Subscribe(pathPrefix string, callback SettingsCallback) int {
+	var segments []string
+	for _, item := range strings.Split(pathPrefix, "/") {
+		if item != "" {
+			segments = append(segments, item)
+		}
+	}
+
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+
+	id := subscriptionNextID
+	subscriptionNextID++
+	subscriptionList = append(subscriptionList, subscription{id: id, segments: segments, callback: callback})
+	return id
+}
+
+// Unsubscribe removes the callback with the argumented subscription ID
+func Unsubscribe(id int) {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+
+	for i, item := range subscriptionList {
+		if item.id == id {
+			subscriptionList = append(subscriptionList[:i], subscriptionList[i+1:]...)
+			return
+		}
+	}
+}
+
+// startWatcher loads the current settings and starts the task that notifies the subscribers
+func startWatcher() {
+	if info, err := os.Stat(settingsFile); err == nil {
+		watchModTime = info.ModTime()
+		watchSize = info.Size()
+	}
+	jsonObject, etag, err := readSettingsFile(settingsFile)
+	if err != nil {
+		logger.Info("Unable to read settings for the settings watcher: %v\n", err)
+	}
+	watchSettings = jsonObject
+	watchETag = etag
+
+	go watchTask()
+}
+
+// stopWatcher stops the settings watcher task and waits for it to return
+func stopWatcher() {
+	watchShutdown <- true
+	select {
+	case <-watchShutdown:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown settings watchTask\n")
+	}
+}
+
+// wakeWatcher tells the watcher task the settings file was saved. It does not block
+// so it is safe to call while holding the settingsMutex or if the task is not running.
+func wakeWatcher() {
+	select {
+	case watchWakeup <- true:
+	default:
+	}
+}
+
+// watchTask checks for settings changes when the settings are saved and periodically
+// for changes made by other processes. The subscribers are called from this task so
+// they can safely read or save the settings.
+func watchTask() {
+	for {
+		select {
+		case <-watchShutdown:
+			watchShutdown <- true
+			return
+		case <-watchWakeup:
+			checkSettingsChange(true)
+		case <-time.After(watchInterval * time.Second):
+			checkSettingsChange(false)
+		}
+	}
+}
+
+// checkSettingsChange reads the settings file if it was saved or its modification time
+// or size changed, and calls the subscribers if the contents are different
+func checkSettingsChange(saved bool) {
+	info, err := os.Stat(settingsFile)
+	if err != nil {
+		return
+	}
+	if !saved && info.ModTime().Equal(watchModTime) && info.Size() == watchSize {
+		return
+	}
+	watchModTime = info.ModTime()
+	watchSize = info.Size()
+
+	jsonObject, etag, err := readSettingsFile(settingsFile)
+	if err != nil {
+		logger.Warn("Unable to read changed settings: %v\n", err)
+		return
+	}
+	if etag == watchETag {
+		return
+	}
+
+	if !saved {
+		logger.Info("Detected external change to %s\n", settingsFile)
+	}
+
+	oldSettings := watchSettings
+	watchSettings = jsonObject
+	watchETag = etag
+	notifySubscribers(oldSettings, jsonObject)
+}
+
+// notifySubscribers calls the callback of every subscription where the value at the
+// subscribed path is different in the old and new settings
+func notifySubscribers(oldSettings map[string]interface{}, newSettings map[string]interface{}) {
+	subscriptionMutex.Lock()
+	list := make([]subscription, len(subscriptionList))
+	copy(list, subscriptionList)
+	subscriptionMutex.Unlock()
+
+	for _, item := range list {
+		oldValue := getSubscriptionValue(oldSettings, item.segments)
+		newValue := getSubscriptionValue(newSettings, item.segments)
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		logger.Debug("Settings changed at /%s\n", strings.Join(item.segments, "/"))
+		item.callback(copyJSONValue(oldValue), copyJSONValue(newValue))
+	}
+}
+
+// getSubscriptionValue returns the value at the path in the settings or nil if it does not exist
+func getSubscriptionValue(jsonObject map[string]interface{}, segments []string) interface{} {
+	if jsonObject == nil {
+		return nil
+	}
+	value, err := patchGet(jsonObject, segments)
+	if err != nil {
+		return nil
+	}
+	return value
+}
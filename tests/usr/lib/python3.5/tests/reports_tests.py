@@ -170,6 +170,43 @@ JOIN_REPORT_ENTRY = {
     }
 }
 
+PERCENTILES_REPORT_ENTRY = {
+    "uniqueId": "percentiles_report_entry",
+    "name": "percentiles_report_entry",
+    "category": "category",
+    "description": "description",
+    "displayOrder": 10,
+    "readOnly": True,
+    "type": "PERCENTILES",
+    "table": "sessions join session_stats using (session_id)",
+    "columnDisambiguation": [{
+        "columnName": "time_stamp",
+        "newColumnName": "session_stats.time_stamp"
+    }],
+    "queryDistribution": {
+        "column": "bytes",
+        "groupColumn": "client_address",
+        "percentiles": [50, 90, 99.9],
+        "limit": 5
+    }
+}
+
+DISTRIBUTION_REPORT_ENTRY = {
+    "uniqueId": "distribution_report_entry",
+    "name": "distribution_report_entry",
+    "category": "category",
+    "description": "description",
+    "displayOrder": 10,
+    "readOnly": True,
+    "type": "DISTRIBUTION",
+    "table": "session_stats",
+    "queryDistribution": {
+        "column": "client_bytes + server_bytes",
+        "buckets": [1000, 100000],
+        "timeIntervalSeconds": 60
+    }
+}
+
 def merge(dict1, dict2):
     """Merge the entries from two dictionaries and return a new dictionary"""
     res = {**dict1, **dict2}
@@ -213,6 +250,55 @@ def close_query(query_id):
     else:
         return output
 
+def cancel_query(query_id):
+    """Cancels the specified query ID"""
+    cmd = 'curl -m 5 -X POST -s -o - "http://localhost/api/reports/cancel_query/%s"' % str(query_id)
+    print(cmd)
+    p = subprocess.run(cmd, shell=True, stdout=subprocess.PIPE)
+    output = p.stdout.decode()
+    if p.returncode != 0:
+        return None
+    else:
+        return output
+
+def export_query(report_entry, export_format):
+    """Exports all rows for the specified report_entry in the specified format"""
+    json_string = json.dumps(report_entry)
+    cmd = 'curl -m 30 -X POST -s -o - -H "Content-Type: application/json; charset=utf-8" -d \'%s\' "http://localhost/api/reports/export?format=%s"' % (json_string, export_format)
+    print(cmd)
+    p = subprocess.run(cmd, shell=True, stdout=subprocess.PIPE)
+    output = p.stdout.decode()
+    if p.returncode != 0:
+        return None
+    else:
+        return output
+
+def validate_report(report_entry):
+    """Validates the specified report_entry without running it"""
+    json_string = json.dumps(report_entry)
+    cmd = 'curl -m 5 -X POST -s -o - -H "Content-Type: application/json; charset=utf-8" -d \'%s\' "http://localhost/api/reports/validate"' % json_string
+    print(cmd)
+    p = subprocess.run(cmd, shell=True, stdout=subprocess.PIPE)
+    output = p.stdout.decode()
+    if p.returncode != 0:
+        return None
+    else:
+        return json.loads(output)
+
+def get_library(report_id=None):
+    """Gets the report library or a single entry from it"""
+    url = "http://localhost/api/reports/library"
+    if report_id != None:
+        url += "/" + report_id
+    cmd = 'curl -m 5 -X GET -s -o - "%s"' % url
+    print(cmd)
+    p = subprocess.run(cmd, shell=True, stdout=subprocess.PIPE)
+    output = p.stdout.decode()
+    if p.returncode != 0:
+        return None
+    else:
+        return json.loads(output)
+
 class ReportsTests(unittest.TestCase):
     """ReportsTests"""
 
@@ -397,6 +483,32 @@ class ReportsTests(unittest.TestCase):
         assert result != None
         assert result.get('time_trunc') != None
 
+    def test_055_percentiles_query(self):
+        """Tests PERCENTILES query"""
+        query_id = create_query(PERCENTILES_REPORT_ENTRY)
+        assert query_id != None
+        results = get_data(query_id)
+        close_query(query_id)
+        assert results != None
+        assert isinstance(results, list)
+        assert len(results) <= 5
+        for result in results:
+            assert result["client_address"] != None
+            assert result["p50"] <= result["p90"] <= result["p99_9"]
+
+    def test_056_distribution_query(self):
+        """Tests DISTRIBUTION query by time interval"""
+        query_id = create_query(DISTRIBUTION_REPORT_ENTRY)
+        assert query_id != None
+        results = get_data(query_id)
+        close_query(query_id)
+        assert results != None
+        assert len(results) > 0
+        assert results[0]["time_trunc"] != None
+        assert "<1000" in results[0]
+        assert "1000-100000" in results[0]
+        assert "100000+" in results[0]
+
     def test_060_join_query(self):
         """Tests a report that uses a join in the table"""
         query_id = create_query(JOIN_REPORT_ENTRY)
@@ -413,6 +525,104 @@ class ReportsTests(unittest.TestCase):
             assert "application_name" in results[0]
             assert "value" in results[0]
 
+    def test_065_cancel_query(self):
+        """Tests cancelling a query releases it"""
+        query_id = create_query(BASIC_EVENTS_REPORT_ENTRY)
+        assert query_id != None
+        assert cancel_query(query_id) == "Cancelled"
+        results = get_data(query_id)
+        assert results != None
+        assert "error" in results
+
+    def test_066_cancelled_queries_release_slots(self):
+        """Tests that cancelled queries do not block new queries"""
+        for _ in range(5):
+            query_id = create_query(BASIC_EVENTS_REPORT_ENTRY)
+            assert query_id != None
+            cancel_query(query_id)
+        query_id = create_query(BASIC_TEXT_REPORT_ENTRY)
+        assert query_id != None
+        results = get_data(query_id)
+        close_query(query_id)
+        assert results[0]["session_count"] != None
+
+    def test_070_export_csv(self):
+        """Tests exporting an EVENTS report as CSV"""
+        output = export_query(BASIC_EVENTS_REPORT_ENTRY, "csv")
+        assert output != None
+        lines = output.splitlines()
+        assert len(lines) > 0
+        header = lines[0].split(",")
+        assert "client_address" in header
+        assert "server_address" in header
+
+    def test_071_export_ndjson(self):
+        """Tests exporting an EVENTS report as NDJSON"""
+        output = export_query(merge(BASIC_EVENTS_REPORT_ENTRY, ONE_CONDITION), "ndjson")
+        assert output != None
+        for line in output.splitlines():
+            row = json.loads(line)
+            assert row["ip_protocol"] == 17
+
+    def test_072_export_invalid_format(self):
+        """Tests exporting with an unsupported format"""
+        output = export_query(BASIC_EVENTS_REPORT_ENTRY, "xml")
+        assert output != None
+        assert "error" in json.loads(output)
+
+    def test_080_validate_report(self):
+        """Tests validating the basic report entries"""
+        for report_entry in [BASIC_TEXT_REPORT_ENTRY, BASIC_EVENTS_REPORT_ENTRY, BASIC_CATEGORIES_REPORT_ENTRY,
+                             BASIC_SERIES_REPORT_ENTRY, BASIC_CATEGORIES_SERIES_REPORT_ENTRY, JOIN_REPORT_ENTRY]:
+            result = validate_report(report_entry)
+            assert result != None
+            assert result["valid"]
+
+    def test_081_validate_invalid_report(self):
+        """Tests validating a report entry with invalid fields"""
+        report_entry = merge(BASIC_CATEGORIES_REPORT_ENTRY, {
+            "table": "no_such_table",
+            "queryCategories": {
+                "groupColumn": "client_address",
+                "aggregationFunction": "median",
+                "aggregationValue": "*"
+            }
+        })
+        result = validate_report(report_entry)
+        assert result != None
+        assert not result["valid"]
+        fields = [e["field"] for e in result["errors"]]
+        assert "table" in fields
+        assert "queryCategories.aggregationFunction" in fields
+
+    def test_082_create_query_invalid_report(self):
+        """Tests that an invalid report entry is rejected before it is run"""
+        report_entry = merge(BASIC_TEXT_REPORT_ENTRY, {"queryText": {"columns": ["load_extension('x')"]}})
+        # the error response is not a query id
+        with self.assertRaises(ValueError):
+            create_query(report_entry)
+
+    def test_085_library(self):
+        """Tests listing the report library"""
+        library = get_library()
+        assert library != None
+        assert isinstance(library, list)
+        for report_entry in library:
+            assert report_entry["uniqueId"] != None
+            assert report_entry["readOnly"]
+            entry = get_library(report_entry["uniqueId"])
+            assert entry["uniqueId"] == report_entry["uniqueId"]
+
+    def test_090_snapshot(self):
+        """Tests downloading a snapshot of the reports database"""
+        cmd = 'curl -m 30 -X GET -s -o /tmp/reports_snapshot.db -w "%{http_code}" "http://localhost/api/reports/snapshot"'
+        print(cmd)
+        p = subprocess.run(cmd, shell=True, stdout=subprocess.PIPE)
+        assert p.returncode == 0
+        assert p.stdout.decode() == "200"
+        with open("/tmp/reports_snapshot.db", "rb") as snapshot:
+            assert snapshot.read(16) == b"SQLite format 3\x00"
+
     def final_tear_down(self):
         """final_tear_down unittest method"""
         pass
@@ -6,6 +6,7 @@ import subprocess
 import unittest
 import json
 import sys
+import time
 import runtests.test_registry as test_registry
 
 def get_settings(attributes=None, seperator="/"):
@@ -238,6 +239,128 @@ class SettingsTests(unittest.TestCase):
         assert result3 != None
         assert result3.get('error') != None
 
+    def test_040_set_credentials_cleartext(self):
+        """Set a cleartext password and check it is saved as a hash"""
+        fname = sys._getframe().f_code.co_name
+        credentials = get_settings(['accounts', 'credentials']) or []
+        credentials.append({'username': fname, 'passwordCleartext': 'passw0rd'})
+        result1 = set_settings(['accounts', 'credentials'], credentials)
+        result2 = get_settings(['accounts', 'credentials'])
+        assert result1 != None
+        assert result1.get('result') == 'OK'
+        assert result2 != None
+        cred = [c for c in result2 if c.get('username') == fname][0]
+        assert cred.get('passwordCleartext') is None
+        assert cred.get('passwordHashMD5') is None
+        assert cred.get('passwordHashSHA512').startswith('$6$')
+
+        # cleartext can not be written directly by its path or with a JSON Patch
+        index = result2.index(cred)
+        result3 = set_settings(['accounts', 'credentials', index, 'passwordCleartext'], 'secret')
+        assert result3.get('error') != None
+        patch = json.dumps([{'op': 'add', 'path': '/accounts/credentials/%d/passwordCleartext' % index, 'value': 'secret'}])
+        result = subprocess.run('curl -m 5 -X PATCH -s -o /dev/null -w "%%{http_code}" -d \'%s\' "http://localhost/api/settings"' % patch, shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "400"
+        cred = get_settings(['accounts', 'credentials', index])
+        assert cred.get('passwordCleartext') is None
+
+    def test_041_settings_audit(self):
+        """Change a setting and check the change is in the audit log"""
+        fname = sys._getframe().f_code.co_name
+        result1 = set_settings(['fakeaudit1'], {'fakepart2': fname})
+        assert result1 != None
+        assert result1.get('result') == 'OK'
+        records = []
+        # the audit records are written to the database in batches
+        for _ in range(10):
+            result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/audit?path=/fakeaudit1"', shell=True, stdout=subprocess.PIPE)
+            records = json.loads(result.stdout.decode('utf-8'))
+            if len(records) > 0:
+                break
+            time.sleep(1)
+        assert len(records) > 0
+        assert records[0].get('action') == 'set'
+        assert records[0].get('status') == 'success'
+        diff = json.loads(records[0].get('diff'))
+        assert {'op': 'add', 'path': '/fakeaudit1/fakepart2', 'new': fname} in diff or {'op': 'add', 'path': '/fakeaudit1', 'new': {'fakepart2': fname}} in diff
+        trim_settings(['fakeaudit1'])
+
+    def test_042_settings_revisions(self):
+        """Change a setting with a comment, check the revision and roll it back"""
+        fname = sys._getframe().f_code.co_name
+        result1 = set_settings(['fakerevision1?comment=%s' % fname], fname)
+        revisions = get_settings(['revisions'])
+        assert result1 != None
+        assert result1.get('result') == 'OK'
+        assert revisions != None
+        assert len(revisions) >= 2
+        assert revisions[-1].get('comment') == fname
+        previous = revisions[-2].get('revision')
+        diff = get_settings(['revisions', previous, 'diff'])
+        assert {'op': 'add', 'path': '/fakerevision1', 'new': fname} in diff
+        result = subprocess.run('curl -m 5 -X POST -s -o - "http://localhost/api/settings/revisions/%d/rollback"' % previous, shell=True, stdout=subprocess.PIPE)
+        result2 = json.loads(result.stdout.decode('utf-8'))
+        result3 = get_settings(['fakerevision1'])
+        assert result2.get('result') == 'OK'
+        assert result3.get('error') != None
+
+        # a rollback keeps the current accounts, so a token created since is still there
+        revisions = get_settings(['revisions'])
+        previous = revisions[-1].get('revision')
+        result = subprocess.run('curl -m 10 -X POST -s -o - -H "Content-Type: application/json" -d \'{"name":"%s","scopes":["status"]}\' "http://localhost/api/tokens"' % fname, shell=True, stdout=subprocess.PIPE)
+        token_id = json.loads(result.stdout.decode('utf-8')).get('id')
+        result = subprocess.run('curl -m 5 -X POST -s -o - "http://localhost/api/settings/revisions/%d/rollback"' % previous, shell=True, stdout=subprocess.PIPE)
+        assert json.loads(result.stdout.decode('utf-8')).get('result') == 'OK'
+        result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/tokens"', shell=True, stdout=subprocess.PIPE)
+        assert token_id in [t.get('id') for t in json.loads(result.stdout.decode('utf-8'))]
+        subprocess.run('curl -m 10 -X DELETE -s -o /dev/null "http://localhost/api/tokens/%s"' % token_id, shell=True)
+
+    def test_043_settings_patch_etag(self):
+        """Patch the settings with If-Match and check an old ETag is rejected"""
+        fname = sys._getframe().f_code.co_name
+        set_settings(['fakepatch1'], {'fakepart1': 1, 'fakepart2': [1, 2]})
+        result = subprocess.run('curl -m 5 -s -o /dev/null -D - "http://localhost/api/settings/fakepatch1"', shell=True, stdout=subprocess.PIPE)
+        etag = [line.split(':', 1)[1].strip() for line in result.stdout.decode('utf-8').splitlines() if line.lower().startswith('etag:')][0]
+        patch = [{'op': 'test', 'path': '/fakepart1', 'value': 1},
+                 {'op': 'replace', 'path': '/fakepart1', 'value': fname},
+                 {'op': 'add', 'path': '/fakepart2/-', 'value': 3},
+                 {'op': 'remove', 'path': '/fakepart2/0'}]
+        command = 'curl -m 60 -X PATCH -s -o /dev/null -w "%%{http_code}" -H \'If-Match: %s\' -H "Content-Type: application/json-patch+json" -d \'%s\' "http://localhost/api/settings/fakepatch1"'
+        result1 = subprocess.run(command % (etag, json.dumps(patch)), shell=True, stdout=subprocess.PIPE)
+        result2 = get_settings(['fakepatch1'])
+        result3 = subprocess.run(command % (etag, json.dumps(patch)), shell=True, stdout=subprocess.PIPE)
+        assert result1.stdout.decode('utf-8') == '200'
+        assert result2 == {'fakepart1': fname, 'fakepart2': [2, 3]}
+        assert result3.stdout.decode('utf-8') == '412'
+        trim_settings(['fakepatch1'])
+
+    def test_044_settings_validate(self):
+        """Check invalid settings are rejected by the schema before sync-settings runs"""
+        result1 = set_settings(['validate', 'accounts', 'passwordPolicy'], {'algorithm': 'sha512'})
+        result2 = set_settings(['validate', 'accounts', 'passwordPolicy'], {'algorithm': 'rot13'})
+        result3 = set_settings(['accounts', 'passwordPolicy'], {'algorithm': 'rot13'})
+        result4 = get_settings(['accounts'])
+        assert result1 != None
+        assert result1.get('result') == 'OK'
+        assert result2 != None
+        assert result2.get('errors')[0].get('path') == '/accounts/passwordPolicy/algorithm'
+        assert result3 != None
+        assert result3.get('errors') != None
+        assert result4.get('passwordPolicy', {}).get('algorithm') != 'rot13'
+
+    def test_045_application_signatures(self):
+        """Check application signatures are validated and saved"""
+        signature = {'id': 'INTERNAL_CRM', 'name': 'Internal CRM', 'category': 'Business', 'productivity': 5, 'risk': 1,
+                     'hostnames': ['*.crm.example.com'], 'ports': ['443', '8443-8444'], 'protocols': ['tcp']}
+        result1 = set_settings(['validate', 'classify', 'signatures'], [dict(signature, ports=['http'])])
+        result2 = set_settings(['validate', 'classify', 'signatures'], [dict(signature, ja3=['xyz'])])
+        result3 = set_settings(['classify', 'signatures'], [signature])
+        result4 = get_settings(['classify', 'signatures'])
+        assert result1.get('errors')[0].get('path') == '/classify/signatures/0/ports/0'
+        assert result2.get('errors')[0].get('path') == '/classify/signatures/0/ja3/0'
+        assert result3.get('result') == 'OK'
+        assert result4[0].get('id') == 'INTERNAL_CRM'
+
     def final_tear_down(self):
         """final_tear_down unittest method"""
         set_settings(None, self.initial_settings)
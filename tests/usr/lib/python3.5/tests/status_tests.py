@@ -15,6 +15,11 @@ def get_status(call):
     else:
         return json.loads(result.stdout.decode('utf-8'))
 
+def get_tokens():
+    """Gets the list of API tokens"""
+    result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/tokens"', shell=True, stdout=subprocess.PIPE)
+    return json.loads(result.stdout.decode('utf-8'))
+
 class StatusTests(unittest.TestCase):
     """StatusTests tests the status API"""
 
@@ -61,6 +66,196 @@ class StatusTests(unittest.TestCase):
         assert hardware_status.get("cpuinfo").get("processors") != None
         assert len(hardware_status.get("cpuinfo").get("processors")) > 0
 
+    def test_004_stream_sessions(self):
+        """Open the session event stream and check the ready event and filter validation"""
+        result = subprocess.run('curl -m 3 -N -X GET -s -o - "http://localhost/api/stream/sessions?interface=1&application=HTTP"', shell=True, stdout=subprocess.PIPE)
+        # curl times out since the stream stays open
+        assert result.returncode == 28
+        lines = result.stdout.decode('utf-8').splitlines()
+        assert lines[0] == "event:ready"
+        ready = json.loads(lines[1][len("data:"):])
+        assert ready.get("interface") == "1"
+        assert ready.get("application") == "HTTP"
+        for line in lines:
+            if line.startswith("event:"):
+                assert line[len("event:"):] in ("ready", "new", "update", "end")
+
+        result = subprocess.run('curl -m 5 -X GET -s -o /dev/null -w "%{http_code}" "http://localhost/api/stream/sessions?interface=bad"', shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "400"
+
+    def test_005_session_actions(self):
+        """Kill and block requests for missing or invalid sessions"""
+        for action in ("kill", "block"):
+            result = subprocess.run('curl -m 5 -X POST -s -o /dev/null -w "%%{http_code}" "http://localhost/api/sessions/abc/%s"' % action, shell=True, stdout=subprocess.PIPE)
+            assert result.stdout.decode('utf-8') == "400"
+            result = subprocess.run('curl -m 5 -X POST -s -o /dev/null -w "%%{http_code}" "http://localhost/api/sessions/4294967295/%s?reset=true"' % action, shell=True, stdout=subprocess.PIPE)
+            assert result.stdout.decode('utf-8') == "404"
+
+    def test_006_query_sessions(self):
+        """Filter, sort, page and project the sessions"""
+        sessions = get_status("sessions?limit=1&fields=session_id,ip_protocol")
+        assert isinstance(sessions, list)
+        assert len(sessions) <= 1
+        for session in sessions:
+            assert set(session.keys()) <= set(["session_id", "ip_protocol"])
+
+        sessions = get_status("sessions?protocol=tcp&sort=-bytes")
+        assert isinstance(sessions, list)
+        for session in sessions:
+            assert session.get("ip_protocol") == 6
+        for first, second in zip(sessions, sessions[1:]):
+            assert first.get("bytes", 0) >= second.get("bytes", 0)
+
+        result = subprocess.run('curl -m 5 -X GET -s -o /dev/null -D - "http://localhost/api/status/sessions?limit=1"', shell=True, stdout=subprocess.PIPE)
+        assert "x-total-count:" in result.stdout.decode('utf-8').lower()
+
+        for query in ("address=bogus", "port=70000", "limit=0", "after=1&sort=bytes"):
+            result = subprocess.run('curl -m 5 -X GET -s -o /dev/null -w "%%{http_code}" "http://localhost/api/status/sessions?%s"' % query, shell=True, stdout=subprocess.PIPE)
+            assert result.stdout.decode('utf-8') == "400"
+
+    def test_007_api_tokens(self):
+        """Create a scoped API token, use it, and revoke it"""
+        result = subprocess.run('curl -m 10 -X POST -s -o - -H "Content-Type: application/json" -d \'{"name":"test_007","scopes":["status"],"expires_in_days":1}\' "http://localhost/api/tokens"', shell=True, stdout=subprocess.PIPE)
+        created = json.loads(result.stdout.decode('utf-8'))
+        token = created.get("token")
+        assert token.startswith("pdt_")
+
+        tokens = get_tokens()
+        listed = [t for t in tokens if t.get("id") == created.get("id")][0]
+        assert listed.get("hash") is None
+        assert listed.get("scopes") == ["status"]
+
+        for path, code in (("status/system", "200"), ("settings", "403")):
+            result = subprocess.run('curl -m 5 -X GET -s -o /dev/null -w "%%{http_code}" -H "Authorization: Bearer %s" "http://localhost/api/%s"' % (token, path), shell=True, stdout=subprocess.PIPE)
+            assert result.stdout.decode('utf-8') == code
+
+        tokens = get_tokens()
+        listed = [t for t in tokens if t.get("id") == created.get("id")][0]
+        assert listed.get("last_used") > 0
+
+        result = subprocess.run('curl -m 10 -X DELETE -s -o /dev/null -w "%%{http_code}" "http://localhost/api/tokens/%s"' % created.get("id"), shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "200"
+        result = subprocess.run('curl -m 5 -X GET -s -o /dev/null -w "%%{http_code}" -H "Authorization: Bearer %s" "http://localhost/api/status/system"' % token, shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "403"
+
+    def test_010_get_metrics(self):
+        """Get the metrics in the Prometheus text format"""
+        result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/metrics"', shell=True, stdout=subprocess.PIPE)
+        assert result.returncode == 0
+        samples = {}
+        for line in result.stdout.decode('utf-8').splitlines():
+            if line.startswith("#") or line == "":
+                continue
+            name, value = line.rsplit(" ", 1)
+            samples[name] = float(value)
+        assert samples.get("go_goroutines", 0) > 0
+        assert "packetd_sessions" in samples
+        assert "packetd_conntrack_entries" in samples
+        assert 'packetd_reports_queue_length{queue="events"}' in samples
+
+    def test_011_get_debug_json(self):
+        """Get the overseer metrics as JSON and as a delta with rates"""
+        result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/debug/json"', shell=True, stdout=subprocess.PIPE)
+        assert result.returncode == 0
+        snapshot = json.loads(result.stdout.decode('utf-8'))
+        assert snapshot.get("time") != None
+        assert isinstance(snapshot.get("counters"), list)
+        for histogram in snapshot.get("histograms") or []:
+            assert len(histogram.get("bounds")) == len(histogram.get("counts"))
+
+        result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/debug/json?interval=1"', shell=True, stdout=subprocess.PIPE)
+        assert result.returncode == 0
+        delta = json.loads(result.stdout.decode('utf-8'))
+        assert delta.get("seconds") >= 1
+        for counter in delta.get("counters") or []:
+            assert counter.get("delta") >= 0
+
+    def test_012_import_certificate(self):
+        """Import a certificate for the admin interface and check it is used for HTTPS"""
+        subprocess.run('openssl req -x509 -newkey rsa:2048 -nodes -days 2 -subj "/CN=packetd-test" -addext "subjectAltName=DNS:localhost" -keyout /tmp/test_cert.key -out /tmp/test_cert.pem', shell=True, stdout=subprocess.PIPE, stderr=subprocess.PIPE)
+        with open('/tmp/test_cert.pem') as cert_file, open('/tmp/test_cert.key') as key_file:
+            request = {'certificate': cert_file.read(), 'key': key_file.read()}
+        with open('/tmp/test_cert.json', 'w') as request_file:
+            json.dump(request, request_file)
+        result = subprocess.run('curl -m 5 -X POST -s -o - -d @/tmp/test_cert.json "http://localhost/api/certificate"', shell=True, stdout=subprocess.PIPE)
+        imported = json.loads(result.stdout.decode('utf-8'))
+        result = subprocess.run('curl -m 5 -k -s -v -o /dev/null "https://localhost/ping" 2>&1 | grep "subject:"', shell=True, stdout=subprocess.PIPE)
+        subject = result.stdout.decode('utf-8')
+        result = subprocess.run('curl -m 5 -X DELETE -s -o - "http://localhost/api/certificate"', shell=True, stdout=subprocess.PIPE)
+        removed = json.loads(result.stdout.decode('utf-8'))
+        assert imported.get('source') == 'configured'
+        assert imported.get('dns_names') == ['localhost']
+        assert 'packetd-test' in subject
+        assert removed.get('result') == 'OK'
+
+        request['key'] = request['key'].replace('A', 'B', 1)
+        with open('/tmp/test_cert.json', 'w') as request_file:
+            json.dump(request, request_file)
+        result = subprocess.run('curl -m 5 -X POST -s -o - -d @/tmp/test_cert.json "http://localhost/api/certificate"', shell=True, stdout=subprocess.PIPE)
+        assert json.loads(result.stdout.decode('utf-8')).get('error') != None
+
+    def test_013_local_ca_and_csr(self):
+        """Download the local CA, check it issued the admin certificate, and create a CSR"""
+        result = subprocess.run('curl -m 5 -X GET -s -o /tmp/test_ca.crt -D - "http://localhost/api/certificate/ca"', shell=True, stdout=subprocess.PIPE)
+        assert "attachment" in result.stdout.decode('utf-8').lower()
+        result = subprocess.run('curl -m 5 -s -o /dev/null -w "%{http_code}" --cacert /tmp/test_ca.crt "https://localhost/ping"', shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "200"
+
+        info = json.loads(subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/certificate"', shell=True, stdout=subprocess.PIPE).stdout.decode('utf-8'))
+        assert info.get('source') == 'local'
+        assert 'localhost' in info.get('dns_names')
+        assert '127.0.0.1' in info.get('ip_addresses')
+
+        result = subprocess.run('curl -m 10 -X POST -s -o - -d \'{"common_name":"packetd-test","dns_names":["packetd-test.example.com"],"key_type":"ecdsa"}\' "http://localhost/api/certificate/csr"', shell=True, stdout=subprocess.PIPE)
+        csr = json.loads(result.stdout.decode('utf-8')).get('csr')
+        with open('/tmp/test_csr.pem', 'w') as csr_file:
+            csr_file.write(csr)
+        result = subprocess.run('openssl req -in /tmp/test_csr.pem -noout -verify -text', shell=True, stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+        text = result.stdout.decode('utf-8')
+        assert result.returncode == 0
+        assert 'CN = packetd-test' in text or 'CN=packetd-test' in text
+        assert 'DNS:packetd-test.example.com' in text
+
+        result = subprocess.run('curl -m 5 -X POST -s -o /dev/null -w "%{http_code}" -d \'{"key_type":"dsa"}\' "http://localhost/api/certificate/csr"', shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "400"
+
+    def test_014_search_applications(self):
+        """Search the application table and look up applications by GUID, index, and name"""
+        result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/classify/applications/search?q=goo&limit=5"', shell=True, stdout=subprocess.PIPE)
+        apps = json.loads(result.stdout.decode('utf-8'))
+        assert isinstance(apps, list)
+        assert len(apps) <= 5
+        for app in apps:
+            result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/classify/applications/%s"' % app.get('guid'), shell=True, stdout=subprocess.PIPE)
+            assert json.loads(result.stdout.decode('utf-8')).get('guid') == app.get('guid')
+            result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/classify/applications/%d"' % app.get('index'), shell=True, stdout=subprocess.PIPE)
+            assert json.loads(result.stdout.decode('utf-8')).get('index') == app.get('index')
+
+        result = subprocess.run('curl -m 5 -X GET -s -o - "http://localhost/api/classify/applications/search?min_risk=4"', shell=True, stdout=subprocess.PIPE)
+        for app in json.loads(result.stdout.decode('utf-8')):
+            assert app.get('risk') >= 4
+
+        result = subprocess.run('curl -m 5 -X GET -s -o /dev/null -w "%{http_code}" "http://localhost/api/classify/applications/NO_SUCH_APPLICATION"', shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "404"
+        result = subprocess.run('curl -m 5 -X GET -s -o /dev/null -w "%{http_code}" "http://localhost/api/classify/applications/search?min_risk=x"', shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "400"
+
+    def test_015_api_token_accounts(self):
+        """Check settings tokens can not read or change the accounts"""
+        result = subprocess.run('curl -m 10 -X POST -s -o - -H "Content-Type: application/json" -d \'{"name":"test_015","scopes":["settings:read","settings:write"],"expires_in_days":1}\' "http://localhost/api/tokens"', shell=True, stdout=subprocess.PIPE)
+        created = json.loads(result.stdout.decode('utf-8'))
+        token = created.get("token")
+
+        result = subprocess.run('curl -m 5 -X GET -s -o - -H "Authorization: Bearer %s" "http://localhost/api/settings"' % token, shell=True, stdout=subprocess.PIPE)
+        assert json.loads(result.stdout.decode('utf-8')).get("accounts") is None
+
+        for method, path in (("GET", "settings/accounts"), ("GET", "settings//accounts/credentials"), ("GET", "settings/revisions"), ("POST", "settings/accounts/apiTokens"), ("POST", "settings")):
+            result = subprocess.run('curl -m 5 -X %s -s -o /dev/null -w "%%{http_code}" -H "Authorization: Bearer %s" -d \'[]\' "http://localhost/api/%s"' % (method, token, path), shell=True, stdout=subprocess.PIPE)
+            assert result.stdout.decode('utf-8') == "403"
+
+        result = subprocess.run('curl -m 10 -X DELETE -s -o /dev/null -w "%%{http_code}" "http://localhost/api/tokens/%s"' % created.get("id"), shell=True, stdout=subprocess.PIPE)
+        assert result.stdout.decode('utf-8') == "200"
+
     def final_tear_down(self):
         """final_tear_down unittest method"""
         pass